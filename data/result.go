@@ -71,4 +71,70 @@ type NDT7Result struct {
 	Download *model.ArchivalData `json:",omitempty"`
 }
 
-type NDTQUICResult = NDT7Result
\ No newline at end of file
+// NDT7SessionResult is the struct that is serialized as JSON to disk as the
+// archival record of a multi-flow NDT7 session, i.e. of the download or upload
+// subtests run in parallel by a client over several connections.
+type NDT7SessionResult struct {
+	// GitShortCommit is the Git commit (short form) of the running server code.
+	GitShortCommit string
+	// Version is the symbolic version (if any) of the running server code.
+	Version string
+
+	// SessionID is the identifier shared by the flows of the session.
+	SessionID string
+	// RequestedFlows is the number of flows requested by the client, while
+	// Flows contains the results of the flows that ran.
+	RequestedFlows int
+
+	StartTime time.Time
+	EndTime   time.Time
+
+	// MeanThroughputMbps is the sum of the MeanThroughputMbps of the flows,
+	// which is computed from TCPInfo when available.
+	MeanThroughputMbps float64
+	Flows              []*NDT7Result
+}
+
+// NDTQUICResultSchemaVersion is the version of the NDTQUICResult schema.
+const NDTQUICResultSchemaVersion = 2
+
+// NDTQUICResult is the struct that is serialized as JSON to disk as the
+// archival record of an ndtQUIC test, i.e. an ndt7 test run over WebTransport.
+// It extends the NDT7Result with details about the QUIC connection.
+type NDTQUICResult struct {
+	// SchemaVersion is the version of the schema of this struct.
+	SchemaVersion int
+	// GitShortCommit is the Git commit (short form) of the running server code.
+	GitShortCommit string
+	// Version is the symbolic version (if any) of the running server code.
+	Version string
+
+	// All data members should all be self-describing. In the event of confusion,
+	// rename them to add clarity rather than adding a comment.
+	ServerIP   string
+	ServerPort int
+	ClientIP   string
+	ClientPort int
+
+	StartTime time.Time
+	EndTime   time.Time
+
+	// QUIC connection. HandshakeDuration is measured in microseconds.
+	// ConnectionUUID is the UUID of the connection, which may differ from
+	// the UUID of the subtest since a connection may carry several subtests.
+	ConnectionUUID    string
+	QUICVersion       string
+	ALPN              string
+	TLSCipherSuite    string
+	TLSDidResume      bool
+	Used0RTT          bool
+	HandshakeDuration int64
+	WebTransportDraft string
+
+	// ndt7
+	Upload   *model.ArchivalData `json:",omitempty"`
+	Download *model.ArchivalData `json:",omitempty"`
+	// Datagram contains the data of the datagram subtest, which is only
+	// available over WebTransport.
+	Datagram *model.ArchivalData `json:",omitempty"`
+}
\ No newline at end of file
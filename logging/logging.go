@@ -10,6 +10,7 @@ import (
 	"github.com/apex/log"
 	"github.com/apex/log/handlers/json"
 	"github.com/gorilla/handlers"
+	"github.com/lucas-clemente/quic-go/http3"
 )
 
 // Logger is a logger that logs messages on the standard error
@@ -26,6 +27,37 @@ var Logger = log.Logger{
 // the way in which Apache and Nginx are dockerised. We do not emit JSON
 // access logs, because access logs are a fairly standard format that
 // has been around for a long time now, so better to follow such standard.
+//
+// The handler also works with HTTP/3 servers: the http3.Hijacker implemented
+// by their response writers, which is required to upgrade requests to
+// WebTransport, is preserved.
 func MakeAccessLogHandler(handler http.Handler) http.Handler {
-	return handlers.LoggingHandler(golog.Writer(), handler)
+	out := golog.Writer()
+	logger := handlers.LoggingHandler(out, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hijacker, ok := w.(http3.Hijacker)
+		if !ok {
+			logger.ServeHTTP(w, r)
+			return
+		}
+		// The response writer wrapped by handlers.LoggingHandler hides the
+		// http3.Hijacker, so restore it.
+		handlers.LoggingHandler(out, http.HandlerFunc(func(lw http.ResponseWriter, r *http.Request) {
+			handler.ServeHTTP(&h3ResponseWriter{ResponseWriter: lw, Hijacker: hijacker}, r)
+		})).ServeHTTP(w, r)
+	})
+}
+
+// h3ResponseWriter is an http.ResponseWriter that is also an http.Flusher
+// and an http3.Hijacker, like the ones provided by HTTP/3 servers.
+type h3ResponseWriter struct {
+	http.ResponseWriter
+	http3.Hijacker
+}
+
+// Flush implements http.Flusher.
+func (w *h3ResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
 }
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/lucas-clemente/quic-go/http3"
 	"github.com/m-lab/go/httpx"
 	"github.com/m-lab/go/rtx"
 )
@@ -38,3 +40,24 @@ func TestMakeAccessLogHandler(t *testing.T) {
 		t.Error("We should not have had an empty string")
 	}
 }
+
+type fakeH3ResponseWriter struct {
+	http.ResponseWriter
+	http3.Hijacker
+}
+
+func (w *fakeH3ResponseWriter) Flush() {}
+
+func TestMakeAccessLogHandler_HTTP3(t *testing.T) {
+	var hijacked, flushed bool
+	f := MakeAccessLogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, hijacked = w.(http3.Hijacker)
+		_, flushed = w.(http.Flusher)
+		w.WriteHeader(200)
+	}))
+	w := &fakeH3ResponseWriter{ResponseWriter: httptest.NewRecorder()}
+	f.ServeHTTP(w, httptest.NewRequest(http.MethodConnect, "/", nil))
+	if !hijacked || !flushed {
+		t.Errorf("MakeAccessLogHandler() hijacker = %t, flusher = %t, want true, true", hijacked, flushed)
+	}
+}
@@ -24,7 +24,9 @@ var (
 				100, 150, 250, 400, 600,
 				1000},
 		},
-		[]string{"protocol", "direction", "monitoring"},
+		// The flows label is the number of parallel connections of the
+		// test, i.e. 1 except for multi-flow ndt7 sessions.
+		[]string{"protocol", "direction", "monitoring", "flows"},
 	)
 )
 
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
@@ -22,13 +23,19 @@ import (
 	"github.com/m-lab/ndt-server/metadata"
 	ndt5handler "github.com/m-lab/ndt-server/ndt5/handler"
 	"github.com/m-lab/ndt-server/ndt5/plain"
+	"github.com/m-lab/ndt-server/ndt7/feed"
 	"github.com/m-lab/ndt-server/ndt7/handler"
 	"github.com/m-lab/ndt-server/ndt7/listener"
+	"github.com/m-lab/ndt-server/ndt7/results"
+	"github.com/m-lab/ndt-server/ndt7/session"
 	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/netx"
 	"github.com/m-lab/ndt-server/platformx"
+	"github.com/m-lab/ndt-server/quicx"
 	"github.com/m-lab/ndt-server/version"
 	"github.com/marten-seemann/webtransport-go"
 
+	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/http3"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -37,7 +44,27 @@ import (
 var (
 	// Flags that can be passed in on the command line
 	ndtQUICAddr       = flag.String("ndtquic_addr", ":4443", "The address and port to use for the ndtQUIC test")
+	ndtQUICRawAddr    = flag.String("ndtquic_raw_addr", "", "The address and port to use for the ndtQUIC test over raw QUIC, i.e. without HTTP/3. Empty means that the test is not offered")
 	ndtQUICKeylogFile = flag.String("ndtquic_keyog_file", "", "the file to write keylogs in")
+	ndtQUICQLogRate   = flag.Float64("ndtquic_qlog_rate", 0, "The fraction of ndtQUIC connections, between 0 and 1, for which a qlog trace is saved in the datadir")
+	ndtQUICQLogMax    = flag.Int64("ndtquic_qlog_max_bytes", 32<<20, "The maximum size of the uncompressed qlog trace of a connection. Events beyond it are discarded. Zero means no limit")
+
+	// QUIC transport parameters of the ndtQUIC server.
+	ndtQUICIdleTimeout     = flag.Duration("ndtquic_max_idle_timeout", 0, "The QUIC idle timeout of ndtQUIC connections. Zero means the quic-go default (30s)")
+	ndtQUICStreamWindow    = flag.Uint64("ndtquic_initial_stream_window", 0, "The initial QUIC stream-level receive window, in bytes. Zero means the quic-go default (512 KiB)")
+	ndtQUICMaxStreamWindow = flag.Uint64("ndtquic_max_stream_window", 0, "The maximum QUIC stream-level receive window, in bytes. Zero means the quic-go default (6 MiB)")
+	ndtQUICConnWindow      = flag.Uint64("ndtquic_initial_conn_window", 0, "The initial QUIC connection-level receive window, in bytes. Zero means the quic-go default (768 KiB)")
+	ndtQUICMaxConnWindow   = flag.Uint64("ndtquic_max_conn_window", 0, "The maximum QUIC connection-level receive window, in bytes. Zero means the quic-go default (15 MiB)")
+	ndtQUICMaxStreams      = flag.Int64("ndtquic_max_streams", 0, "The maximum number of concurrent bidirectional QUIC streams a client may open. Zero means the quic-go default (100)")
+	ndtQUICMaxUniStreams   = flag.Int64("ndtquic_max_uni_streams", 0, "The maximum number of concurrent unidirectional QUIC streams a client may open. Zero means the quic-go default (100)")
+
+	// Defaults and bounds of the runtime and of the sampling interval of the
+	// ndt7 and ndtQUIC subtests, which clients may request.
+	ndt7Runtime             = flag.Duration("ndt7_runtime", spec.DefaultRuntime, "The runtime of ndt7 and ndtQUIC subtests whose client does not request one")
+	ndt7MaxRuntime          = flag.Duration("ndt7_max_runtime", spec.DefaultRuntime, "The maximum runtime that ndt7 and ndtQUIC clients may request with the duration_ms parameter")
+	ndt7SamplingInterval    = flag.Duration("ndt7_sampling_interval", spec.AveragePoissonSamplingInterval, "The average sampling interval of ndt7 and ndtQUIC subtests whose client does not request one")
+	ndt7MinSamplingInterval = flag.Duration("ndt7_min_sampling_interval", spec.AveragePoissonSamplingInterval, "The minimum average sampling interval that ndt7 and ndtQUIC clients may request with the sampling_interval_ms parameter")
+
 	ndt7Addr          = flag.String("ndt7_addr", ":443", "The address and port to use for the ndt7 test")
 	ndt7AddrCleartext = flag.String("ndt7_addr_cleartext", ":80", "The address and port to use for the ndt7 cleartext test")
 	ndt5Addr          = flag.String("ndt5_addr", ":3001", "The address and port to use for the unencrypted ndt5 test")
@@ -76,7 +103,7 @@ func init() {
 	flag.Var(&deploymentLabels, "label", "Labels to identify the type of deployment.")
 }
 
-func catchSigterm() {
+func catchSigterm(enterLameDuck context.CancelFunc) {
 	// Disable lame duck status.
 	setLameDuck(0)
 
@@ -94,6 +121,7 @@ func catchSigterm() {
 	}
 	// Set lame duck status. This will remain set until exit.
 	setLameDuck(1)
+	enterLameDuck()
 	// When we receive a second SIGTERM, cancel the context and shut everything
 	// down. This should cause main() to exit cleanly.
 	select {
@@ -132,6 +160,43 @@ func httpServer(addr string, handler http.Handler) *http.Server {
 		// servers.
 		ReadTimeout:  time.Minute,
 		WriteTimeout: time.Minute,
+		// Allows handlers to find the connection underlying a request, e.g.
+		// to measure ndt7 subtests over HTTP/2.
+		ConnContext: netx.ConnContext,
+	}
+}
+
+// newQLogWriter returns the file where the qlog trace of the ndtQUIC connection
+// with the given uuid should be written, or nil if the connection is not
+// sampled for tracing.
+func newQLogWriter(uuid string) io.WriteCloser {
+	if rand.Float64() >= *ndtQUICQLogRate {
+		return nil
+	}
+	fp, err := results.NewQLogFile(uuid, *dataDir, *ndtQUICQLogMax)
+	if err != nil {
+		// NewQLogFile already logged the error.
+		return nil
+	}
+	return fp
+}
+
+// ndtQUICConfig returns the QUIC configuration of the ndtQUIC servers.
+func ndtQUICConfig() *quic.Config {
+	// The quicx.Tracer keeps track of QUIC connections, which allows
+	// handlers to find the connection underlying a session, and
+	// writes the qlog traces of the sampled connections.
+	return &quic.Config{
+		MaxIdleTimeout:                 *ndtQUICIdleTimeout,
+		InitialStreamReceiveWindow:     *ndtQUICStreamWindow,
+		MaxStreamReceiveWindow:         *ndtQUICMaxStreamWindow,
+		InitialConnectionReceiveWindow: *ndtQUICConnWindow,
+		MaxConnectionReceiveWindow:     *ndtQUICMaxConnWindow,
+		MaxIncomingStreams:             *ndtQUICMaxStreams,
+		MaxIncomingUniStreams:          *ndtQUICMaxUniStreams,
+		// Enforces the per-subtest limits requested by clients.
+		AllowConnectionWindowIncrease: quicx.AllowConnectionWindowIncrease,
+		Tracer:                        &quicx.Tracer{QLog: newQLogWriter},
 	}
 }
 
@@ -158,16 +223,15 @@ func http3WebTransportServer(addr string, handler http.Handler, certFile string,
 		Certificates: certs,
 		KeyLogWriter: keyLog,
 	}
-	
-
 
 	// create a new webtransport.Server, listening on (UDP) port 443
 	return &webtransport.Server{
-    	H3: http3.Server{
-			Addr:      addr,
-			Handler:   handler,
-			TLSConfig: config,
-	
+		H3: http3.Server{
+			Addr:       addr,
+			Handler:    handler,
+			TLSConfig:  config,
+			QuicConfig: ndtQUICConfig(),
+
 			// ReadTimeout
 			// Writetimeout
 		},
@@ -175,6 +239,19 @@ func http3WebTransportServer(addr string, handler http.Handler, certFile string,
 	}, nil
 }
 
+// rawQUICServer returns the server of ndtQUIC tests over raw QUIC connections,
+// which are negotiated using the spec.QUICALPN protocol. The certificates and
+// the key log writer are taken from tlsConfig.
+func rawQUICServer(addr string, tlsConfig *tls.Config) *listener.QUICServer {
+	config := tlsConfig.Clone()
+	config.NextProtos = []string{spec.QUICALPN}
+	return &listener.QUICServer{
+		Addr:       addr,
+		TLSConfig:  config,
+		QUICConfig: ndtQUICConfig(),
+	}
+}
+
 // parseDeploymentLabels() returns an array of key-value pairs of type
 // []metadata.NameValue with the deployment label pairs passed in through
 // the "label" flag.
@@ -220,9 +297,19 @@ func main() {
 	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not parse env args")
 
 	serverMetadata := parseDeploymentLabels()
+	limits := spec.Limits{
+		Runtime:             *ndt7Runtime,
+		MaxRuntime:          *ndt7MaxRuntime,
+		SamplingInterval:    *ndt7SamplingInterval,
+		MinSamplingInterval: *ndt7MinSamplingInterval,
+	}
+	rtx.Must(limits.Validate(), "Invalid ndt7 runtime or sampling interval flags")
 
 	// TODO: Decide if signal handling is the right approach here.
-	go catchSigterm()
+	// lameDuckCtx is canceled when the server enters lame duck mode.
+	lameDuckCtx, enterLameDuck := context.WithCancel(ctx)
+	defer enterLameDuck()
+	go catchSigterm(enterLameDuck)
 
 	promSrv := prometheusx.MustServeMetrics()
 	defer promSrv.Close()
@@ -235,7 +322,7 @@ func main() {
 	// verifier is handled safely by Setup and only prints a warning when access
 	// token verification is disabled.
 	v, err := token.NewVerifier(tokenVerifyKey.Get()...)
-	if (tokenRequired5 || tokenRequired7) && err != nil {
+	if (tokenRequired5 || tokenRequired7 || tokenRequiredQUIC) && err != nil {
 		rtx.Must(err, "Failed to load verifier for when tokens are required")
 	}
 
@@ -244,31 +331,40 @@ func main() {
 	ndt5Paths := controller.Paths{
 		"/ndt_protocol": true,
 	}
-	// Enforce Tx limits only on downloads.
+	// Enforce Tx limits only on downloads, including bidirectional subtests.
 	ndt7TxPaths := controller.Paths{
-		spec.DownloadURLPath: true,
+		spec.DownloadURLPath:      true,
+		spec.HTTPDownloadURLPath:  true,
+		spec.BidirectionalURLPath: true,
 	}
-	// Enforce tokens on uploads and downloads.
+	// Enforce tokens on uploads, downloads and bidirectional subtests.
 	ndt7TokenPaths := controller.Paths{
-		spec.DownloadURLPath: true,
-		spec.UploadURLPath:   true,
+		spec.DownloadURLPath:      true,
+		spec.UploadURLPath:        true,
+		spec.HTTPDownloadURLPath:  true,
+		spec.HTTPUploadURLPath:    true,
+		spec.BidirectionalURLPath: true,
 	}
-	// Enforce Tx limits only on downloads.
+	// Enforce Tx limits only on downloads, including combined subtests.
 	ndtQUICTxPaths := controller.Paths{
-		spec.DownloadURLPath: true,
+		spec.DownloadURLPath:     true,
+		spec.HTTPDownloadURLPath: true,
+		spec.CombinedURLPath:     true,
 	}
-	// Enforce tokens on uploads and downloads.
+	// Enforce tokens on uploads, downloads, datagram and combined subtests.
 	ndtQUICTokenPaths := controller.Paths{
-		spec.DownloadURLPath: true,
-		spec.UploadURLPath:   true,
+		spec.DownloadURLPath:     true,
+		spec.UploadURLPath:       true,
+		spec.HTTPDownloadURLPath: true,
+		spec.HTTPUploadURLPath:   true,
+		spec.DatagramURLPath:     true,
+		spec.CombinedURLPath:     true,
 	}
 	// NDT5 uses a raw server, which requires tx5. NDT7 is HTTP only.
 	ac5, tx5 := controller.Setup(ctx, v, tokenRequired5, tokenMachine, ndt5Paths, ndt5Paths)
 	ac7, _ := controller.Setup(ctx, v, tokenRequired7, tokenMachine, ndt7TxPaths, ndt7TokenPaths)
 	acQUIC, _ := controller.Setup(ctx, v, tokenRequiredQUIC, tokenMachine, ndtQUICTxPaths, ndtQUICTokenPaths)
 
-	fmt.Printf("acQUIC: %v\n", acQUIC)
-
 	// The ndt5 protocol serving non-HTTP-based tests - forwards to Ws-based
 	// server if the first three bytes are "GET".
 	ndt5Server := plain.NewServer(*dataDir+"/ndt5", *ndt5WsAddr, serverMetadata)
@@ -299,9 +395,18 @@ func main() {
 		SecurePort:     *ndt7Addr,
 		InsecurePort:   *ndt7AddrCleartext,
 		ServerMetadata: serverMetadata,
+		Limits:         limits,
+		Sessions:       session.NewRegistry(),
+		Feeds:          feed.NewRegistry(),
 	}
 	ndt7Mux.Handle(spec.DownloadURLPath, http.HandlerFunc(ndt7Handler.Download))
 	ndt7Mux.Handle(spec.UploadURLPath, http.HandlerFunc(ndt7Handler.Upload))
+	ndt7Mux.Handle(spec.BidirectionalURLPath, http.HandlerFunc(ndt7Handler.Bidirectional))
+	// The plain HTTP subtests are only available over HTTP/2, i.e. on the
+	// TLS server.
+	ndt7Mux.Handle(spec.HTTPDownloadURLPath, http.HandlerFunc(ndt7Handler.HTTPDownload))
+	ndt7Mux.Handle(spec.HTTPUploadURLPath, http.HandlerFunc(ndt7Handler.HTTPUpload))
+	ndt7Mux.Handle(spec.HTTPMeasurementsURLPath, http.HandlerFunc(ndt7Handler.HTTPMeasurements))
 	ndt7ServerCleartext := httpServer(
 		*ndt7AddrCleartext,
 		ac7.Then(logging.MakeAccessLogHandler(ndt7Mux)),
@@ -315,31 +420,42 @@ func main() {
 	ndtQUICMux := http.NewServeMux()
 
 	ndtQUICMux.Handle("/", http.FileServer(http.Dir(*htmlDir)))
-
-
+	// Access tokens are read from the query string of the WebTransport CONNECT
+	// requests, exactly like for the ndt7 WebSocket upgrade requests. The
+	// drainer lets in-flight subtests complete when shutting down.
+	ndtQUICDrainer := &listener.Drainer{}
 	ndtQUICServer, err := http3WebTransportServer(
 		*ndtQUICAddr,
-		// acQUIC.Then(logging.MakeAccessLogHandler(ndtQUICMux)),
-		// logging.MakeAccessLogHandler(ndtQUICMux),
-		// acQUIC.Then(ndtQUICMux),
-		ndtQUICMux,
+		ndtQUICDrainer.Then(acQUIC.Then(logging.MakeAccessLogHandler(ndtQUICMux))),
 		*certFile,
 		*keyFile,
 	)
 
-	
-
 	ndtQUICHandler := &handler.QUICHandler{
 		Handler: handler.Handler {
 			DataDir:        *dataDir,
 			SecurePort:     *ndtQUICAddr,
 			ServerMetadata: serverMetadata,
+			Limits:         limits,
+			Feeds:          feed.NewRegistry(),
 		},
 		Server: ndtQUICServer,
 	}
 
 	ndtQUICMux.Handle(spec.DownloadURLPath, http.HandlerFunc(ndtQUICHandler.Download))
 	ndtQUICMux.Handle(spec.UploadURLPath, http.HandlerFunc(ndtQUICHandler.Upload))
+	ndtQUICMux.Handle(spec.HTTPDownloadURLPath, http.HandlerFunc(ndtQUICHandler.HTTPDownload))
+	ndtQUICMux.Handle(spec.HTTPUploadURLPath, http.HandlerFunc(ndtQUICHandler.HTTPUpload))
+	ndtQUICMux.Handle(spec.HTTPMeasurementsURLPath, http.HandlerFunc(ndtQUICHandler.HTTPMeasurements))
+	ndtQUICMux.Handle(spec.DatagramURLPath, http.HandlerFunc(ndtQUICHandler.Datagram))
+	ndtQUICMux.Handle(spec.CombinedURLPath, http.HandlerFunc(ndtQUICHandler.Combined))
+
+	// The service-discovery endpoint lists the tests of the servers started
+	// below, and of the TLS ones only if they are started.
+	discovery := handler.Discovery{
+		NDT7AddrCleartext: ndt7ServerCleartext.Addr,
+		NDT5Addr:          *ndt5Addr,
+	}
 
 	// Only start TLS-based services if certs and keys are provided
 	if *certFile != "" && *keyFile != "" {
@@ -354,24 +470,79 @@ func main() {
 		log.Println("About to listen for ndt5 WsS tests on " + *ndt5WssAddr)
 		rtx.Must(listener.ListenAndServeTLSAsync(ndt5WssServer, *certFile, *keyFile), "Could not start ndt5 WsS server")
 		defer ndt5WssServer.Close()
-
-		// The ndt7 listener serving up WSS based tests
-		ndt7Server := httpServer(
-			*ndt7Addr,
-			ac7.Then(logging.MakeAccessLogHandler(ndt7Mux)),
-		)
-		log.Println("About to listen for ndt7 tests on " + *ndt7Addr)
-		rtx.Must(listener.ListenAndServeTLSAsync(ndt7Server, *certFile, *keyFile), "Could not start ndt7 server")
-		defer ndt7Server.Close()
+		discovery.NDT5WssAddr = ndt5WssServer.Addr
 
 		// ndtQUIC
 		log.Println("About to listen for ndtQUIC tests on " + *ndtQUICAddr)
 		rtx.Must(listener.ListenAndServeH3Async(ndtQUICServer), "Could not start ndt7 QUIC server")
-		defer ndtQUICServer.Close()
+		discovery.NDTQUICAddr = ndtQUICServer.H3.Addr
+
+		// The ndt7 listener serving up WSS based tests. The ndtQUIC server
+		// serves the discovery endpoint and the plain HTTP subtests like the
+		// ndt7 server, but over HTTP/3, so it is advertised in the responses
+		// to these requests only, and only if both servers require tokens
+		// alike. The WebSocket subtests are not served over HTTP/3.
+		ndt7ServerHandler := ac7.Then(logging.MakeAccessLogHandler(ndt7Mux))
+		if tokenRequired7 == tokenRequiredQUIC {
+			ndt7ServerHandler, err = listener.AltSvc(
+				ndtQUICServer.H3.Addr,
+				map[string]bool{
+					spec.DiscoveryURLPath:        true,
+					spec.HTTPDownloadURLPath:     true,
+					spec.HTTPUploadURLPath:       true,
+					spec.HTTPMeasurementsURLPath: true,
+				},
+				ndt7ServerHandler,
+			)
+			rtx.Must(err, "Could not advertise the ndtQUIC server")
+		}
+		ndt7Server := httpServer(*ndt7Addr, ndt7ServerHandler)
+		log.Println("About to listen for ndt7 tests on " + *ndt7Addr)
+		rtx.Must(listener.ListenAndServeTLSAsync(ndt7Server, *certFile, *keyFile), "Could not start ndt7 server")
+		defer ndt7Server.Close()
+		discovery.NDT7Addr = ndt7Server.Addr
+		// The ndtQUIC listener serving up NDT7 tests over raw QUIC
+		// connections, i.e. without HTTP/3 and WebTransport, if enabled. It
+		// shares the drainer with the WebTransport server, so that both are
+		// drained at the same time.
+		var ndtQUICRawServer *listener.QUICServer
+		if *ndtQUICRawAddr != "" {
+			ndtQUICRawServer = rawQUICServer(*ndtQUICRawAddr, ndtQUICServer.H3.TLSConfig)
+			ndtQUICRawHandler := *ndtQUICHandler
+			ndtQUICRawHandler.QUICConfig = ndtQUICRawServer.QUICConfig
+			ndtQUICRawServer.Handler = ndtQUICDrainer.ThenQUIC(ndtQUICRawHandler.ServeQUIC)
+			log.Println("About to listen for ndtQUIC raw tests on " + *ndtQUICRawAddr)
+			rtx.Must(listener.ListenAndServeQUICAsync(ndtQUICRawServer), "Could not start ndt7 raw QUIC server")
+			discovery.NDTQUICRawAddr = ndtQUICRawServer.Addr
+		}
+		// Unlike TCP connections, QUIC connections are all closed with the
+		// server, hence drain the server as soon as we enter lame duck mode.
+		// The drain lasts until the longest subtest, i.e. a combined subtest
+		// running the download and the upload one after the other, is over,
+		// or until the process context is canceled, e.g. by a second SIGTERM.
+		ndtQUICDrained := make(chan struct{})
+		go func() {
+			defer close(ndtQUICDrained)
+			<-lameDuckCtx.Done()
+			drainCtx, drainCancel := context.WithTimeout(ctx, 2*(limits.MaxRuntime+spec.RuntimeGrace))
+			defer drainCancel()
+			if err := ndtQUICDrainer.Shutdown(drainCtx, ndtQUICServer); err != nil {
+				log.Println("Could not shut down ndtQUIC server:", err)
+			}
+			if ndtQUICRawServer == nil {
+				return
+			}
+			if err := ndtQUICRawServer.Close(); err != nil {
+				log.Println("Could not shut down ndtQUIC raw server:", err)
+			}
+		}()
+		defer func() { <-ndtQUICDrained }()
 
 	} else {
 		log.Printf("Cert=%q and Key=%q means no TLS services will be started.\n", *certFile, *keyFile)
 	}
+	ndt7Mux.Handle(spec.DiscoveryURLPath, discovery)
+	ndtQUICMux.Handle(spec.DiscoveryURLPath, discovery)
 
 	// Set up handler for /health endpoint.
 	healthMux := http.NewServeMux()
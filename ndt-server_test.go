@@ -79,6 +79,8 @@ func setupMain() func() {
 		{"NDT5_WS_ADDR", ports[2]},
 		{"NDT5_WSS_ADDR", ports[3]},
 		{"NDT7_ADDR_CLEARTEXT", ports[4]},
+		{"NDTQUIC_ADDR", "127.0.0.1:0"},
+		{"NDTQUIC_RAW_ADDR", "127.0.0.1:0"},
 		{"CERT", certFile},
 		{"KEY", keyFile},
 		{"DATADIR", dir},
@@ -207,7 +207,7 @@ func handleControlChannel(conn protocol.Connection, s ndt.Server, isMon string)
 		record.C2S, err = c2s.ManageTest(ctx, conn, s)
 		if record.C2S != nil && record.C2S.MeanThroughputMbps != 0 {
 			c2sRate = record.C2S.MeanThroughputMbps
-			metrics.TestRate.WithLabelValues(connType, "c2s", isMon).Observe(c2sRate)
+			metrics.TestRate.WithLabelValues(connType, "c2s", isMon, "1").Observe(c2sRate)
 		}
 		r := metrics.GetResultLabel(err, record.C2S.MeanThroughputMbps)
 		ndt5metrics.ClientTestResults.WithLabelValues(connType, "c2s", r).Inc()
@@ -217,7 +217,7 @@ func handleControlChannel(conn protocol.Connection, s ndt.Server, isMon string)
 		record.S2C, err = s2c.ManageTest(ctx, conn, s)
 		if record.S2C != nil && record.S2C.MeanThroughputMbps != 0 {
 			s2cRate = record.S2C.MeanThroughputMbps
-			metrics.TestRate.WithLabelValues(connType, "s2c", isMon).Observe(s2cRate)
+			metrics.TestRate.WithLabelValues(connType, "s2c", isMon, "1").Observe(s2cRate)
 		}
 		r := metrics.GetResultLabel(err, record.S2C.MeanThroughputMbps)
 		ndt5metrics.ClientTestResults.WithLabelValues(connType, "s2c", r).Inc()
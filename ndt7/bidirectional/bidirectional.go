@@ -0,0 +1,42 @@
+// Package bidirectional implements the ndt7/server bidirectional subtest, which
+// runs the download and the upload at the same time on the same WebSocket
+// connection, to measure how the link behaves when it is loaded in both
+// directions.
+package bidirectional
+
+import (
+	"context"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/ndt-server/ndt7/download/sender"
+	"github.com/m-lab/ndt-server/ndt7/measurer"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/ndt7/receiver"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+)
+
+// Do implements the bidirectional subtest. The ctx argument is the parent
+// context for the subtest. The conn argument is the open WebSocket connection.
+// The down and up arguments are the archival data where the results of the
+// download and of the upload are saved. All arguments are owned by the caller
+// of this function. The params argument contains the subtest parameters
+// requested by the client.
+func Do(ctx context.Context, conn *websocket.Conn, down, up *model.ArchivalData, params spec.Params) error {
+	// Implementation note: use child contexts so the sender is strictly time
+	// bounded. After timeout, the sender closes the conn, which results in the
+	// receiver completing.
+
+	// Both measurers sample the same connection, but count the bytes sent
+	// and received respectively.
+	downMr := measurer.New(conn, down.UUID)
+	upMr := measurer.New(conn, up.UUID)
+	// Receive and save client-provided measurements and bulk data.
+	recv := receiver.StartBidirectionalReceiverAsync(ctx, conn, down, up, upMr)
+
+	// Perform download and save server-measurements of both directions.
+	err := sender.StartBidirectional(ctx, conn, down, up, downMr, upMr, params)
+
+	// Block on the receiver completing to guarantee that access to data is synchronous.
+	<-recv.Done()
+	return err
+}
@@ -0,0 +1,84 @@
+// Package budget enforces the byte budget requested by ndt7 clients, e.g. on
+// metered connections.
+package budget
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/m-lab/ndt-server/ndt7/model"
+)
+
+// Budget counts the bytes transferred during a subtest, and tells when they
+// reach the byte budget of the subtest. A nil Budget is never exhausted.
+type Budget struct {
+	// app and kernel must be accessed atomically.
+	app    int64
+	kernel int64
+	max    int64
+	once   sync.Once
+	done   chan struct{}
+}
+
+// New returns a new Budget of max bytes, or nil if max is zero.
+func New(max int64) *Budget {
+	if max == 0 {
+		return nil
+	}
+	return &Budget{max: max, done: make(chan struct{})}
+}
+
+// Add counts n more application-level bytes, sent or received, and returns
+// whether the budget is exhausted.
+func (b *Budget) Add(n int64) bool {
+	if b == nil {
+		return false
+	}
+	return b.check(atomic.AddInt64(&b.app, n))
+}
+
+// Observe counts the n bytes transferred since the beginning of the subtest
+// according to the kernel (e.g. TCPInfo BytesAcked or BytesReceived), which
+// includes the framing overhead, and returns whether the budget is exhausted.
+func (b *Budget) Observe(n int64) bool {
+	if b == nil {
+		return false
+	}
+	for {
+		old := atomic.LoadInt64(&b.kernel)
+		if n <= old || atomic.CompareAndSwapInt64(&b.kernel, old, n) {
+			break
+		}
+	}
+	return b.check(n)
+}
+
+func (b *Budget) check(n int64) bool {
+	if n < b.max {
+		return false
+	}
+	b.once.Do(func() { close(b.done) })
+	return true
+}
+
+// Done returns a channel that is closed once the budget is exhausted. If b is
+// nil, the channel is nil, i.e. it is never ready.
+func (b *Budget) Done() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.done
+}
+
+// Info returns the budget and the bytes used so far, i.e. the largest count
+// of Add and Observe, or nil if b is nil.
+func (b *Budget) Info() *model.ByteBudget {
+	if b == nil {
+		return nil
+	}
+	used := atomic.LoadInt64(&b.app)
+	if kernel := atomic.LoadInt64(&b.kernel); kernel > used {
+		used = kernel
+	}
+	return &model.ByteBudget{MaxBytes: b.max, UsedBytes: used}
+}
@@ -0,0 +1,49 @@
+package budget
+
+import (
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt7/model"
+)
+
+func TestBudget(t *testing.T) {
+	b := New(1000)
+	if b.Add(600) {
+		t.Errorf("Add(600) exhausted a budget of 1000")
+	}
+	if b.Observe(700) {
+		t.Errorf("Observe(700) exhausted a budget of 1000")
+	}
+	select {
+	case <-b.Done():
+		t.Fatalf("Done() closed before exhausting the budget")
+	default:
+	}
+	// Kernel counts are cumulative, so older counts are ignored.
+	if b.Observe(500) {
+		t.Errorf("Observe(500) exhausted a budget of 1000")
+	}
+	if got, want := *b.Info(), (model.ByteBudget{MaxBytes: 1000, UsedBytes: 700}); got != want {
+		t.Errorf("Info() = %+v, want %+v", got, want)
+	}
+	if !b.Add(400) || !b.Observe(1100) {
+		t.Errorf("Add and Observe did not exhaust the budget")
+	}
+	<-b.Done()
+	if got, want := *b.Info(), (model.ByteBudget{MaxBytes: 1000, UsedBytes: 1100}); got != want {
+		t.Errorf("Info() = %+v, want %+v", got, want)
+	}
+}
+
+func TestBudget_nil(t *testing.T) {
+	b := New(0)
+	if b != nil {
+		t.Fatalf("New(0) = %v, want nil", b)
+	}
+	if b.Add(1<<40) || b.Observe(1<<40) {
+		t.Errorf("nil Budget is exhausted")
+	}
+	if b.Done() != nil || b.Info() != nil {
+		t.Errorf("nil Budget has a Done channel or Info")
+	}
+}
@@ -1,4 +1,4 @@
-// Package closer implements the WebSocket closer.
+// Package closer implements the WebSocket and WebTransport closers.
 package closer
 
 import (
@@ -6,8 +6,40 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/m-lab/ndt-server/logging"
+	ndt7metrics "github.com/m-lab/ndt-server/ndt7/metrics"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/quicx"
 )
 
+// endReasonLabels maps the reasons why a subtest ends to the labels they are
+// counted with in the sender metrics.
+var endReasonLabels = map[string]string{
+	spec.EndReasonRuntime:  "measurer-closed",
+	spec.EndReasonStable:   "early-exit",
+	spec.EndReasonMaxBytes: "max-bytes",
+}
+
+// Finish ends the WebSocket subtest of the given kind, whose archival data is
+// data, for the given reason, i.e. one of the spec.EndReason values. It saves
+// the reason in data, counts it in the sender metrics with the proto label,
+// and starts closing conn.
+func Finish(conn *websocket.Conn, proto string, kind spec.SubtestKind, data *model.ArchivalData, reason string) {
+	data.EndReason = reason
+	StartClosing(conn)
+	ndt7metrics.ClientSenderErrors.WithLabelValues(
+		proto, string(kind), endReasonLabels[reason]).Inc()
+}
+
+// FinishWebTransport is like Finish but for ndtQUIC subtests, whose ctrl
+// stream starts closing.
+func FinishWebTransport(ctrl quicx.Stream, proto string, kind spec.SubtestKind, data *model.ArchivalData, reason string) {
+	data.EndReason = reason
+	StartClosingWebTransport(ctrl)
+	ndt7metrics.ClientSenderErrors.WithLabelValues(
+		proto, string(kind), endReasonLabels[reason]).Inc()
+}
+
 // StartClosing will start closing the websocket connection.
 func StartClosing(conn *websocket.Conn) {
 	msg := websocket.FormatCloseMessage(
@@ -20,3 +52,14 @@ func StartClosing(conn *websocket.Conn) {
 	}
 	logging.Logger.Debug("sender: sending Close message")
 }
+
+// StartClosingWebTransport will start closing the WebTransport session by
+// closing the send side of the control stream. The client is expected to stop
+// sending and close its side of the control stream in response.
+func StartClosingWebTransport(ctrl quicx.Stream) {
+	if err := ctrl.Close(); err != nil {
+		logging.Logger.WithError(err).Warn("sender: ctrl.Close failed")
+		return
+	}
+	logging.Logger.Debug("sender: closing control stream")
+}
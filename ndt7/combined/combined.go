@@ -0,0 +1,89 @@
+// Package combined implements the ndt7/server combined subtest, which runs the
+// download and upload subtests in the same WebTransport session, so that the
+// connection setup cost is paid once.
+package combined
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt7/download"
+	ndt7metrics "github.com/m-lab/ndt-server/ndt7/metrics"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/ndt7/upload"
+	"github.com/m-lab/ndt-server/quicx"
+	"github.com/marten-seemann/webtransport-go"
+)
+
+// DoWebTransport implements the combined subtest over WebTransport sessions.
+// The ctx argument is the parent context for the subtest. The down and up
+// arguments are the archival data where the results of the download and of the
+// upload are saved. The params argument contains the subtest parameters
+// requested by the client, which apply to both subtests. If dc is not nil, the
+// bulk data of the download is sent in datagrams on dc. All arguments are
+// owned by the caller of this function.
+//
+// Unless params.Simultaneous is true, the upload starts once the download is
+// over. Otherwise, both subtests run at the same time, and the first message
+// sent on each control stream tells the client which subtest it belongs to,
+// since streams may be accepted in any order.
+func DoWebTransport(ctx context.Context, sess *webtransport.Session, dc quicx.DatagramConn, down, up *model.ArchivalData, params spec.Params) error {
+	if !params.Simultaneous {
+		if err := download.DoWebTransport(ctx, sess, dc, down, params); err != nil {
+			return err
+		}
+		return upload.DoWebTransport(ctx, sess, up, params)
+	}
+
+	qsess := quicx.FromWebTransport(sess)
+	downCtrl, err := openControlStream(ctx, qsess, spec.SubtestDownload)
+	if err != nil {
+		return err
+	}
+	upCtrl, err := openControlStream(ctx, qsess, spec.SubtestUpload)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	var downErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		downErr = download.DoConcurrentWebTransport(ctx, sess, downCtrl, dc, down, params)
+	}()
+	upErr := upload.DoConcurrentWebTransport(ctx, sess, upCtrl, up, params)
+	wg.Wait()
+	if downErr != nil {
+		return downErr
+	}
+	return upErr
+}
+
+// subtestMessage is the first message sent on the control streams of
+// simultaneous subtests.
+type subtestMessage struct {
+	Subtest spec.SubtestKind
+}
+
+// openControlStream opens the control stream of a subtest of the given kind,
+// on which both the server and the client send their measurement messages, and
+// sends the subtestMessage on it.
+func openControlStream(ctx context.Context, sess quicx.Session, kind spec.SubtestKind) (quicx.Stream, error) {
+	ctrl, err := sess.OpenStreamSync(ctx)
+	if err == nil {
+		err = json.NewEncoder(ctrl).Encode(subtestMessage{Subtest: kind})
+	}
+	if err != nil {
+		logging.Logger.WithError(err).Warn("combined: opening the control stream failed")
+		proto := ndt7metrics.SessionLabel(sess)
+		ndt7metrics.ClientSenderErrors.WithLabelValues(
+			proto, string(kind), "open-ctrl-stream").Inc()
+		ndt7metrics.ClientReceiverErrors.WithLabelValues(
+			proto, string(kind), "open-ctrl-stream").Inc()
+		return nil, err
+	}
+	return ctrl, nil
+}
@@ -0,0 +1,64 @@
+// Package datagram implements the ndt7/server datagram subtest, which measures
+// the one-way delay variation, the loss and the reordering of unreliable
+// datagrams sent in both directions at a paced rate.
+package datagram
+
+import (
+	"context"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt7/datagram/sender"
+	"github.com/m-lab/ndt-server/ndt7/measurer"
+	ndt7metrics "github.com/m-lab/ndt-server/ndt7/metrics"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/ndt7/receiver"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/quicx"
+	"github.com/marten-seemann/webtransport-go"
+)
+
+// DoWebTransport implements the datagram subtest over WebTransport sessions.
+// The ctx argument is the parent context for the subtest. The dc argument
+// sends and receives the datagrams of sess. The data argument is the archival
+// data where results are saved. The params argument contains the subtest
+// parameters requested by the client. All arguments are owned by the caller of
+// this function.
+func DoWebTransport(ctx context.Context, sess *webtransport.Session, dc quicx.DatagramConn, data *model.ArchivalData, params spec.Params) error {
+	qsess := quicx.FromWebTransport(sess)
+
+	// Open the control stream, on which both the server and the client send
+	// their measurement messages.
+	ctrl, err := qsess.OpenStreamSync(ctx)
+	if err == nil {
+		// Streams are only announced to the client when they are first
+		// written to, so write the (empty) stream header right away.
+		_, err = ctrl.Write(nil)
+	}
+	if err != nil {
+		logging.Logger.WithError(err).Warn("datagram: opening the control stream failed")
+		proto := ndt7metrics.SessionLabel(qsess)
+		ndt7metrics.ClientSenderErrors.WithLabelValues(
+			proto, string(spec.SubtestDatagram), "open-ctrl-stream").Inc()
+		ndt7metrics.ClientReceiverErrors.WithLabelValues(
+			proto, string(spec.SubtestDatagram), "open-ctrl-stream").Inc()
+		return err
+	}
+
+	mr := measurer.NewWebTransport(qsess, data.UUID)
+	c := mr.NewDatagramCounter()
+	// Receive and count the datagrams of the client, and save
+	// client-provided measurements in data.
+	recv := receiver.StartWebTransportDatagramReceiverAsync(ctx, qsess, ctrl, dc, data, mr, c)
+
+	// Send datagrams and save server-measurements in data.
+	err = sender.StartWebTransport(ctx, qsess, ctrl, dc, data, mr, c, params)
+	if err != nil {
+		// Close the session, so that the receiver does not wait for the
+		// client or for the deadline of the subtest to complete.
+		qsess.Close()
+	}
+
+	// Block on the receiver completing to guarantee that access to data is synchronous.
+	<-recv.Done()
+	return err
+}
@@ -0,0 +1,145 @@
+// Package sender implements the datagram sender.
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt7/closer"
+	"github.com/m-lab/ndt-server/ndt7/measurer"
+	ndt7metrics "github.com/m-lab/ndt-server/ndt7/metrics"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/ndt7/ping"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/quicx"
+)
+
+// writeJSON writes v to the control stream as a newline-delimited JSON message.
+func writeJSON(str quicx.SendStream, v interface{}) error {
+	return json.NewEncoder(str).Encode(v)
+}
+
+// StartWebTransport sends datagrams to the client on dc, at the rate and with
+// the size requested in params, and measurement messages on the ctrl stream.
+// The sent datagrams are counted by c, whose statistics are included in the
+// measurements. Each measurement message will also be saved to data.
+//
+// Liveness guarantee: the sender will not be stuck sending measurements for
+// more than the MaxRuntime of the subtest. This is enforced by setting the
+// write deadline of ctrl to Time.Now() + MaxRuntime. Sending a datagram, which
+// blocks while the connection is congestion limited, is interrupted once the
+// subtest ends.
+func StartWebTransport(ctx context.Context, sess quicx.Session, ctrl quicx.Stream, dc quicx.DatagramConn, data *model.ArchivalData, mr *measurer.WebTransportMeasurer, c *measurer.DatagramCounter, params spec.Params) error {
+	logging.Logger.Debug("sender: start")
+	proto := ndt7metrics.SessionLabel(sess)
+
+	// Start collecting connection measurements. Measurements will be sent to
+	// src until the runtime of the subtest, when the src channel is closed.
+	src := mr.Start(ctx, params.SubtestRuntime(), params.SubtestSamplingInterval())
+	defer logging.Logger.Debug("sender: stop")
+	defer mr.Stop(src)
+
+	deadline := time.Now().Add(params.SubtestMaxRuntime())
+	err := ctrl.SetWriteDeadline(deadline) // Liveness!
+	if err != nil {
+		logging.Logger.WithError(err).Warn("sender: ctrl.SetWriteDeadline failed")
+		ndt7metrics.ClientSenderErrors.WithLabelValues(
+			proto, string(spec.SubtestDatagram), "ctrl-set-write-deadline").Inc()
+		return err
+	}
+
+	// Record measurement start time, and prepare recording of the endtime on return.
+	data.StartTime = time.Now().UTC()
+	defer func() {
+		data.EndTime = time.Now().UTC()
+	}()
+
+	// Send datagrams from a separate goroutine, until stop is called.
+	sendctx, cancel := context.WithCancel(ctx)
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := sendDatagrams(sendctx, dc, c, params); err != nil {
+			errs <- err
+		}
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			wg.Wait()
+		})
+	}
+	defer stop()
+
+	for {
+		select {
+		case m, ok := <-src:
+			if !ok { // This means that the measurer has terminated
+				stop()
+				closer.StartClosingWebTransport(ctrl)
+				ndt7metrics.ClientSenderErrors.WithLabelValues(
+					proto, string(spec.SubtestDatagram), "measurer-closed").Inc()
+				return nil
+			}
+			if err := writeJSON(ctrl, m); err != nil {
+				logging.Logger.WithError(err).Warn("sender: writeJSON failed")
+				ndt7metrics.ClientSenderErrors.WithLabelValues(
+					proto, string(spec.SubtestDatagram), "write-json").Inc()
+				return err
+			}
+			// Only save measurements sent to the client.
+			data.ServerMeasurements = append(data.ServerMeasurements, m)
+			if err := ping.SendTicksWebTransport(ctrl); err != nil {
+				logging.Logger.WithError(err).Warn("sender: ping.SendTicks failed")
+				ndt7metrics.ClientSenderErrors.WithLabelValues(
+					proto, string(spec.SubtestDatagram), "ping-send-ticks").Inc()
+				return err
+			}
+		case err := <-errs:
+			logging.Logger.WithError(err).Warn("sender: sendDatagrams failed")
+			ndt7metrics.ClientSenderErrors.WithLabelValues(
+				proto, string(spec.SubtestDatagram), "send-datagram").Inc()
+			return err
+		}
+	}
+}
+
+// sendDatagrams sends sequenced and timestamped datagrams on dc at a paced
+// rate until ctx is done, and counts them using c.
+func sendDatagrams(ctx context.Context, dc quicx.DatagramConn, c *measurer.DatagramCounter, params spec.Params) error {
+	rate, size := params.DatagramRate, params.DatagramSize
+	if rate == 0 {
+		rate = spec.DefaultDatagramRate
+	}
+	if size == 0 {
+		size = spec.DefaultDatagramSize
+	}
+	buf := make([]byte, size)
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	for seq := uint64(0); ; seq++ {
+		h := model.DatagramHeader{
+			Seq:       seq,
+			Timestamp: int64(time.Since(c.Start()) / time.Microsecond),
+		}
+		h.Marshal(buf)
+		if err := dc.SendDatagram(ctx, buf); err != nil {
+			if ctx.Err() != nil {
+				return nil // The send has been interrupted by the sender.
+			}
+			return err
+		}
+		c.AddSent()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
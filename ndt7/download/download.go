@@ -3,51 +3,131 @@ package download
 
 import (
 	"context"
+	"net/http"
 
 	"github.com/gorilla/websocket"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt7/budget"
 	"github.com/m-lab/ndt-server/ndt7/download/sender"
+	"github.com/m-lab/ndt-server/ndt7/feed"
 	"github.com/m-lab/ndt-server/ndt7/measurer"
+	ndt7metrics "github.com/m-lab/ndt-server/ndt7/metrics"
 	"github.com/m-lab/ndt-server/ndt7/model"
 	"github.com/m-lab/ndt-server/ndt7/receiver"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/quicx"
 	"github.com/marten-seemann/webtransport-go"
 )
 
 // Do implements the download subtest. The ctx argument is the parent context
 // for the subtest. The conn argument is the open WebSocket connection. The data
 // argument is the archival data where results are saved. All arguments are
-// owned by the caller of this function.
-func Do(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData) error {
+// owned by the caller of this function. The params argument contains the
+// subtest parameters requested by the client.
+func Do(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData, params spec.Params) error {
 	// Implementation note: use child contexts so the sender is strictly time
 	// bounded. After timeout, the sender closes the conn, which results in the
 	// receiver completing.
 
+	mr := measurer.New(conn, data.UUID)
+	b := budget.New(params.MaxBytes)
 	// Receive and save client-provided measurements in data.
-	recv := receiver.StartDownloadReceiverAsync(ctx, conn, data)
+	recv := receiver.StartDownloadReceiverAsync(ctx, conn, data, mr)
 
 	// Perform download and save server-measurements in data.
 	// TODO: move sender.Start logic to this file.
-	err := sender.Start(ctx, conn, data)
+	err := sender.Start(ctx, conn, data, mr, params, b)
 
 	// Block on the receiver completing to guarantee that access to data is synchronous.
 	<-recv.Done()
+	data.ByteBudget = b.Info()
 	return err
 }
 
-// Dame as Do but for WebTransport
-func DoWebTransport(ctx context.Context, sess *webtransport.Session, data *model.ArchivalData) error {
+// DoWebTransport is like Do but for WebTransport sessions. The params argument
+// contains the subtest parameters requested by the client. If dc is not nil,
+// the bulk data is sent in datagrams on dc rather than on streams.
+func DoWebTransport(ctx context.Context, sess *webtransport.Session, dc quicx.DatagramConn, data *model.ArchivalData, params spec.Params) error {
+	return doSession(ctx, quicx.FromWebTransport(sess), nil, dc, data, params, false)
+}
+
+// DoConcurrentWebTransport is like DoWebTransport but for downloads running at
+// the same time as an upload in the same session. The ctrl argument is the
+// control stream opened by the caller, and the unidirectional streams opened
+// by the client are left to the upload.
+func DoConcurrentWebTransport(ctx context.Context, sess *webtransport.Session, ctrl quicx.Stream, dc quicx.DatagramConn, data *model.ArchivalData, params spec.Params) error {
+	return doSession(ctx, quicx.FromWebTransport(sess), ctrl, dc, data, params, true)
+}
+
+// DoQUIC is like DoWebTransport but for raw QUIC connections. The ctrl argument
+// is the bidirectional stream opened by the client to send its request, which
+// is used as the control stream.
+func DoQUIC(ctx context.Context, conn quic.Connection, ctrl quic.Stream, data *model.ArchivalData, params spec.Params) error {
+	return doSession(ctx, quicx.FromQUIC(conn), quicx.FromQUICStream(ctrl), nil, data, params, false)
+}
+
+// doSession implements the download subtest for ndtQUIC sessions. If ctrl is
+// nil, the control stream is opened by the server. If dc is not nil, the bulk
+// data is sent in datagrams on dc. If concurrent is true, an upload is running
+// at the same time in sess.
+func doSession(ctx context.Context, sess quicx.Session, ctrl quicx.Stream, dc quicx.DatagramConn, data *model.ArchivalData, params spec.Params, concurrent bool) error {
 	// Implementation note: use child contexts so the sender is strictly time
 	// bounded. After timeout, the sender closes the conn, which results in the
 	// receiver completing.
 
+	if ctrl == nil {
+		// Open the control stream, on which both the server and the client
+		// send their measurement messages.
+		var err error
+		ctrl, err = sess.OpenStreamSync(ctx)
+		if err == nil {
+			// Streams are only announced to the client when they are first
+			// written to, so write the (empty) stream header right away. This
+			// allows the client to accept the control stream before any
+			// message is sent.
+			_, err = ctrl.Write(nil)
+		}
+		if err != nil {
+			logging.Logger.WithError(err).Warn("download: opening the control stream failed")
+			proto := ndt7metrics.SessionLabel(sess)
+			ndt7metrics.ClientSenderErrors.WithLabelValues(
+				proto, string(spec.SubtestDownload), "open-ctrl-stream").Inc()
+			ndt7metrics.ClientReceiverErrors.WithLabelValues(
+				proto, string(spec.SubtestDownload), "open-ctrl-stream").Inc()
+			return err
+		}
+	}
+
 	mr := measurer.NewWebTransport(sess, data.UUID)
 	// Receive and save client-provided measurements in data.
-	recv := receiver.StartWebTransportDownloadReceiverAsync(ctx, sess, data, mr)
+	var recv context.Context
+	if concurrent {
+		recv = receiver.StartWebTransportConcurrentDownloadReceiverAsync(ctx, sess, ctrl, data, mr)
+	} else {
+		recv = receiver.StartWebTransportDownloadReceiverAsync(ctx, sess, ctrl, data, mr)
+	}
 
 	// Perform download and save server-measurements in data.
 	// TODO: move sender.Start logic to this file.
-	err := sender.StartWebTransport(ctx, sess, data, mr)
+	err := sender.StartWebTransport(ctx, sess, ctrl, dc, data, mr, params)
+	if err != nil {
+		// Close the session, so that the receiver does not wait for the
+		// client or for the deadline of the subtest to complete.
+		sess.Close()
+	}
 
 	// Block on the receiver completing to guarantee that access to data is synchronous.
 	<-recv.Done()
 	return err
 }
+
+// DoHTTP is like Do but for subtests over plain HTTP streams, where the bulk
+// download is sent in the body of the response rw, and measurements are sent
+// to f, if it is not nil. The client cannot send measurements. The proto
+// argument is the protocol label used in metrics, and mr measures the
+// connection underlying rw.
+func DoHTTP(ctx context.Context, rw http.ResponseWriter, proto string, data *model.ArchivalData, mr measurer.Sampler, f *feed.Feed, params spec.Params) error {
+	// Perform download and save server-measurements in data.
+	return sender.StartHTTP(ctx, rw, proto, data, mr, f, params)
+}
@@ -5,17 +5,22 @@ import (
 	"context"
 	"encoding/json"
 	"math/rand"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt7/budget"
 	"github.com/m-lab/ndt-server/ndt7/closer"
+	"github.com/m-lab/ndt-server/ndt7/earlyexit"
+	"github.com/m-lab/ndt-server/ndt7/feed"
 	"github.com/m-lab/ndt-server/ndt7/measurer"
 	ndt7metrics "github.com/m-lab/ndt-server/ndt7/metrics"
 	"github.com/m-lab/ndt-server/ndt7/model"
 	"github.com/m-lab/ndt-server/ndt7/ping"
 	"github.com/m-lab/ndt-server/ndt7/spec"
-	"github.com/marten-seemann/webtransport-go"
+	"github.com/m-lab/ndt-server/quicx"
 )
 
 func makePreparedMessage(size int) (*websocket.PreparedMessage, error) {
@@ -39,19 +44,20 @@ func makeWebTransportMessage(size int) ([]byte, error) {
 
 // Start sends binary messages (bulk download) and measurement messages (status
 // messages) to the client conn. Each measurement message will also be saved to
-// data.
+// data. If params.EarlyExit is true, the download ends once its throughput is
+// stable. The download also ends once the bytes sent or acknowledged exhaust
+// the budget b, if any.
 //
 // Liveness guarantee: the sender will not be stuck sending for more than the
 // MaxRuntime of the subtest. This is enforced by setting the write deadline to
 // Time.Now() + MaxRuntime.
-func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData) error {
+func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData, mr *measurer.Measurer, params spec.Params, b *budget.Budget) error {
 	logging.Logger.Debug("sender: start")
 	proto := ndt7metrics.ConnLabel(conn)
 
 	// Start collecting connection measurements. Measurements will be sent to
-	// src until DefaultRuntime, when the src channel is closed.
-	mr := measurer.New(conn, data.UUID)
-	src := mr.Start(ctx, spec.DefaultRuntime)
+	// src until the runtime of the subtest, when the src channel is closed.
+	src := mr.Start(ctx, params.SubtestRuntime(), params.SubtestSamplingInterval())
 	defer logging.Logger.Debug("sender: stop")
 	defer mr.Stop(src)
 
@@ -64,7 +70,7 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 			proto, string(spec.SubtestDownload), "make-prepared-message").Inc()
 		return err
 	}
-	deadline := time.Now().Add(spec.MaxRuntime)
+	deadline := time.Now().Add(params.SubtestMaxRuntime())
 	err = conn.SetWriteDeadline(deadline) // Liveness!
 	if err != nil {
 		logging.Logger.WithError(err).Warn("sender: conn.SetWriteDeadline failed")
@@ -78,15 +84,18 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 	defer func() {
 		data.EndTime = time.Now().UTC()
 	}()
+	// finish ends the download for the given reason.
+	finish := func(reason string) error {
+		closer.Finish(conn, proto, spec.SubtestDownload, data, reason)
+		return nil
+	}
+	stable := earlyexit.Start(spec.SubtestDownload, params, data)
 	var totalSent int64
 	for {
 		select {
 		case m, ok := <-src:
 			if !ok { // This means that the measurer has terminated
-				closer.StartClosing(conn)
-				ndt7metrics.ClientSenderErrors.WithLabelValues(
-					proto, string(spec.SubtestDownload), "measurer-closed").Inc()
-				return nil
+				return finish(spec.EndReasonRuntime)
 			}
 			if err := conn.WriteJSON(m); err != nil {
 				logging.Logger.WithError(err).Warn("sender: conn.WriteJSON failed")
@@ -96,6 +105,12 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 			}
 			// Only save measurements sent to the client.
 			data.ServerMeasurements = append(data.ServerMeasurements, m)
+			if stable.Stable(m) {
+				return finish(spec.EndReasonStable)
+			}
+			if m.TCPInfo != nil && b.Observe(m.TCPInfo.BytesAcked) {
+				return finish(spec.EndReasonMaxBytes)
+			}
 			if err := ping.SendTicks(conn, deadline); err != nil {
 				logging.Logger.WithError(err).Warn("sender: ping.SendTicks failed")
 				ndt7metrics.ClientSenderErrors.WithLabelValues(
@@ -110,6 +125,10 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 					proto, string(spec.SubtestDownload), "write-prepared-message").Inc()
 				return err
 			}
+			mr.AddBytes(int64(bulkMessageSize))
+			if b.Add(int64(bulkMessageSize)) {
+				return finish(spec.EndReasonMaxBytes)
+			}
 			// The following block of code implements the scaling of message size
 			// as recommended in the spec's appendix. We're not accounting for the
 			// size of JSON messages because that is small compared to the bulk
@@ -136,56 +155,164 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 	}
 }
 
-
-func writeJSON(str webtransport.SendStream, v interface{}) error {
-	err1 := json.NewEncoder(str).Encode(v)
-	return err1
-}
-
-
-// Start sends binary messages (bulk download) and measurement messages (status
-// messages) to the client conn. Each measurement message will also be saved to
-// data.
+// StartBidirectional is like Start but for bidirectional subtests, where the
+// client uploads binary messages on conn during the download. The down and up
+// arguments are the archival data of the download and of the upload, whose
+// bytes are counted by downMr and upMr respectively. The measurements of both
+// are sent to the client, with their Test field set to tell them apart, and
+// saved in the corresponding archival data. Both end when the runtime of the
+// subtest elapses.
 //
 // Liveness guarantee: the sender will not be stuck sending for more than the
 // MaxRuntime of the subtest. This is enforced by setting the write deadline to
 // Time.Now() + MaxRuntime.
-func StartWebTransport(ctx context.Context, sess *webtransport.Session, data *model.ArchivalData, mr *measurer.WebTransportMeasurer) error {
+func StartBidirectional(ctx context.Context, conn *websocket.Conn, down, up *model.ArchivalData, downMr, upMr *measurer.Measurer, params spec.Params) error {
 	logging.Logger.Debug("sender: start")
-	// proto := ndt7metrics.ConnLabel(conn)
-	proto := "ndt+webtransport"
+	proto := ndt7metrics.ConnLabel(conn)
+	kind := string(spec.SubtestBidirectional)
 
-	// Start collecting connection measurements. Measurements will be sent to
-	// src until DefaultRuntime, when the src channel is closed.
-	src := mr.Start(ctx, spec.DefaultRuntime)
+	// Start collecting connection measurements for both directions.
+	// Measurements will be sent to downSrc and upSrc until the runtime of the
+	// subtest, when both channels are closed.
+	downSrc := downMr.Start(ctx, params.SubtestRuntime(), params.SubtestSamplingInterval())
+	defer downMr.Stop(downSrc)
+	upSrc := upMr.Start(ctx, params.SubtestRuntime(), params.SubtestSamplingInterval())
+	defer upMr.Stop(upSrc)
 	defer logging.Logger.Debug("sender: stop")
-	defer mr.Stop(src)
 
 	logging.Logger.Debug("sender: generating random buffer")
 	bulkMessageSize := 1 << 13
-	bulkDataToSend, err := makeWebTransportMessage(bulkMessageSize)
+	preparedMessage, err := makePreparedMessage(bulkMessageSize)
 	if err != nil {
-		logging.Logger.WithError(err).Warn("sender: bulkDataToSend failed")
+		logging.Logger.WithError(err).Warn("sender: makePreparedMessage failed")
 		ndt7metrics.ClientSenderErrors.WithLabelValues(
-			proto, string(spec.SubtestDownload), "make-prepared-message").Inc()
+			proto, kind, "make-prepared-message").Inc()
 		return err
 	}
-	deadline := time.Now().Add(spec.MaxRuntime)
-	str, err := sess.OpenUniStream()
+	deadline := time.Now().Add(params.SubtestMaxRuntime())
+	err = conn.SetWriteDeadline(deadline) // Liveness!
 	if err != nil {
-		logging.Logger.WithError(err).Warn("sender: sess.OpenUniStream failed")
+		logging.Logger.WithError(err).Warn("sender: conn.SetWriteDeadline failed")
 		ndt7metrics.ClientSenderErrors.WithLabelValues(
-			proto, string(spec.SubtestDownload), "open-uni-stream").Inc()
+			proto, kind, "set-write-deadline").Inc()
 		return err
 	}
-	
-	err = str.SetWriteDeadline(deadline) // Liveness!
+
+	// Record measurement start time, and prepare recording of the endtime on return.
+	down.StartTime = time.Now().UTC()
+	up.StartTime = down.StartTime
+	defer func() {
+		down.EndTime = time.Now().UTC()
+		up.EndTime = down.EndTime
+	}()
+	// send sends the measurement m of the given subtest to the client, and
+	// saves it in data.
+	send := func(m model.Measurement, test spec.SubtestKind, data *model.ArchivalData) error {
+		m.Test = string(test)
+		if err := conn.WriteJSON(m); err != nil {
+			logging.Logger.WithError(err).Warn("sender: conn.WriteJSON failed")
+			ndt7metrics.ClientSenderErrors.WithLabelValues(
+				proto, kind, "write-json").Inc()
+			return err
+		}
+		// Only save measurements sent to the client.
+		data.ServerMeasurements = append(data.ServerMeasurements, m)
+		if err := ping.SendTicks(conn, deadline); err != nil {
+			logging.Logger.WithError(err).Warn("sender: ping.SendTicks failed")
+			ndt7metrics.ClientSenderErrors.WithLabelValues(
+				proto, kind, "ping-send-ticks").Inc()
+			return err
+		}
+		return nil
+	}
+	// finish ends both subtests once the runtime has elapsed, i.e. once one
+	// of the measurers has terminated.
+	finish := func() error {
+		down.EndReason = spec.EndReasonRuntime
+		up.EndReason = spec.EndReasonRuntime
+		closer.StartClosing(conn)
+		ndt7metrics.ClientSenderErrors.WithLabelValues(
+			proto, kind, "measurer-closed").Inc()
+		return nil
+	}
+	var totalSent int64
+	for {
+		select {
+		case m, ok := <-downSrc:
+			if !ok {
+				return finish()
+			}
+			if err := send(m, spec.SubtestDownload, down); err != nil {
+				return err
+			}
+		case m, ok := <-upSrc:
+			if !ok {
+				return finish()
+			}
+			if err := send(m, spec.SubtestUpload, up); err != nil {
+				return err
+			}
+		default:
+			if err := conn.WritePreparedMessage(preparedMessage); err != nil {
+				logging.Logger.WithError(err).Warn(
+					"sender: conn.WritePreparedMessage failed")
+				ndt7metrics.ClientSenderErrors.WithLabelValues(
+					proto, kind, "write-prepared-message").Inc()
+				return err
+			}
+			downMr.AddBytes(int64(bulkMessageSize))
+			// The following block of code implements the scaling of message size
+			// as recommended in the spec's appendix.
+			totalSent += int64(bulkMessageSize)
+			if int64(bulkMessageSize) >= spec.MaxScaledMessageSize {
+				continue // No further scaling is required
+			}
+			if int64(bulkMessageSize) > totalSent/spec.ScalingFraction {
+				continue // message size still too big compared to sent data
+			}
+			bulkMessageSize *= 2
+			preparedMessage, err = makePreparedMessage(bulkMessageSize)
+			if err != nil {
+				logging.Logger.WithError(err).Warn("sender: makePreparedMessage failed")
+				ndt7metrics.ClientSenderErrors.WithLabelValues(
+					proto, kind, "make-prepared-message").Inc()
+				return err
+			}
+		}
+	}
+}
+
+// StartHTTP is like Start but for subtests over plain HTTP streams, where
+// binary data (bulk download) is sent in the response body. Since there is no
+// room for measurement messages in the body, the measurements are sent to f, if
+// it is not nil, and the last measurement is sent in the
+// spec.MeasurementTrailer trailer, if the HTTP version supports trailers. The
+// proto argument is the protocol label used in metrics.
+//
+// Liveness guarantee: the sender will not be stuck sending for more than the
+// MaxRuntime of the subtest, provided that the caller closes the connection
+// underlying rw after MaxRuntime, since HTTP responses have no write deadline.
+func StartHTTP(ctx context.Context, rw http.ResponseWriter, proto string, data *model.ArchivalData, mr measurer.Sampler, f *feed.Feed, params spec.Params) error {
+	logging.Logger.Debug("sender: start")
+
+	// Start collecting connection measurements. Measurements will be sent to
+	// src until the runtime of the subtest, when the src channel is closed.
+	src := mr.Start(ctx, params.SubtestRuntime(), params.SubtestSamplingInterval())
+	defer logging.Logger.Debug("sender: stop")
+	defer mr.Stop(src)
+
+	logging.Logger.Debug("sender: generating random buffer")
+	bulkMessageSize := 1 << 13
+	bulkDataToSend, err := makeWebTransportMessage(bulkMessageSize)
 	if err != nil {
-		logging.Logger.WithError(err).Warn("sender: str.SetWriteDeadline failed")
+		logging.Logger.WithError(err).Warn("sender: makeWebTransportMessage failed")
 		ndt7metrics.ClientSenderErrors.WithLabelValues(
-			proto, string(spec.SubtestDownload), "str-set-write-deadline").Inc()
+			proto, string(spec.SubtestDownload), "make-prepared-message").Inc()
 		return err
 	}
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Trailer", spec.MeasurementTrailer)
+	rw.WriteHeader(http.StatusOK)
 
 	// Record measurement start time, and prepare recording of the endtime on return.
 	data.StartTime = time.Now().UTC()
@@ -197,49 +324,30 @@ func StartWebTransport(ctx context.Context, sess *webtransport.Session, data *mo
 		select {
 		case m, ok := <-src:
 			if !ok { // This means that the measurer has terminated
-				str.Close()
+				if n := len(data.ServerMeasurements); n > 0 {
+					last, err := json.Marshal(data.ServerMeasurements[n-1])
+					if err == nil {
+						rw.Header().Set(spec.MeasurementTrailer, string(last))
+					}
+				}
 				ndt7metrics.ClientSenderErrors.WithLabelValues(
 					proto, string(spec.SubtestDownload), "measurer-closed").Inc()
 				return nil
 			}
-			// TODO: write JSON on another stream
-			if err := writeJSON(str, m); err != nil {
-				logging.Logger.WithError(err).Warn("sender: conn.WriteJSON failed")
-				ndt7metrics.ClientSenderErrors.WithLabelValues(
-					proto, string(spec.SubtestDownload), "write-json").Inc()
-				return err
+			if f != nil {
+				f.Send(m)
 			}
-			// Only save measurements sent to the client.
 			data.ServerMeasurements = append(data.ServerMeasurements, m)
-			if err := ping.SendTicksWebTransport(sess, deadline); err != nil {
-				logging.Logger.WithError(err).Warn("sender: ping.SendTicks failed")
-				ndt7metrics.ClientSenderErrors.WithLabelValues(
-					proto, string(spec.SubtestDownload), "ping-send-ticks").Inc()
-				return err
-			}
 		default:
-			// if err := conn.WritePreparedMessage(preparedMessage); err != nil {
-			// 	logging.Logger.WithError(err).Warn(
-			// 		"sender: conn.WritePreparedMessage failed")
-			// 	ndt7metrics.ClientSenderErrors.WithLabelValues(
-			// 		proto, string(spec.SubtestDownload), "write-prepared-message").Inc()
-			// 	return err
-			// }
-			
-			if n, err := str.Write(bulkDataToSend); err != nil || n != bulkMessageSize {
-				logging.Logger.WithError(err).Warn(
-					"sender: conn.WritePreparedMessage failed")
+			if _, err := rw.Write(bulkDataToSend); err != nil {
+				logging.Logger.WithError(err).Warn("sender: rw.Write failed")
 				ndt7metrics.ClientSenderErrors.WithLabelValues(
-					proto, string(spec.SubtestDownload), "write-prepared-message").Inc()
+					proto, string(spec.SubtestDownload), "write-body").Inc()
 				return err
 			}
+			mr.AddBytes(int64(bulkMessageSize))
 			// The following block of code implements the scaling of message size
-			// as recommended in the spec's appendix. We're not accounting for the
-			// size of JSON messages because that is small compared to the bulk
-			// message size. The net effect is slightly slowing down the scaling,
-			// but this is currently fine. We need to gather data from large
-			// scale deployments of this algorithm anyway, so there's no point
-			// in engaging in fine grained calibration before knowing.
+			// as recommended in the spec's appendix.
 			totalSent += int64(bulkMessageSize)
 			if int64(bulkMessageSize) >= spec.MaxScaledMessageSize {
 				continue // No further scaling is required
@@ -250,7 +358,7 @@ func StartWebTransport(ctx context.Context, sess *webtransport.Session, data *mo
 			bulkMessageSize *= 2
 			bulkDataToSend, err = makeWebTransportMessage(bulkMessageSize)
 			if err != nil {
-				logging.Logger.WithError(err).Warn("sender: bulkDataToSend failed")
+				logging.Logger.WithError(err).Warn("sender: makeWebTransportMessage failed")
 				ndt7metrics.ClientSenderErrors.WithLabelValues(
 					proto, string(spec.SubtestDownload), "make-prepared-message").Inc()
 				return err
@@ -258,3 +366,214 @@ func StartWebTransport(ctx context.Context, sess *webtransport.Session, data *mo
 		}
 	}
 }
+
+// writeJSON writes v to the control stream as a newline-delimited JSON message.
+func writeJSON(str quicx.SendStream, v interface{}) error {
+	return json.NewEncoder(str).Encode(v)
+}
+
+// StartWebTransport is like Start but for ndtQUIC sessions, i.e. WebTransport
+// sessions or raw QUIC connections. Binary data
+// (bulk download) is sent on params.Streams concurrent unidirectional streams,
+// while measurement messages are sent on the ctrl stream. If dc is not nil,
+// binary data is instead sent in datagrams of params.BulkDatagramSize bytes on
+// dc, as fast as the congestion controller allows. If params.EarlyExit is
+// true, the download ends once its throughput is stable.
+//
+// Liveness guarantee: the sender will not be stuck sending for more than the
+// MaxRuntime of the subtest. This is enforced by setting the write deadline of
+// all the streams to Time.Now() + MaxRuntime. Sending datagrams is interrupted
+// once the download ends.
+func StartWebTransport(ctx context.Context, sess quicx.Session, ctrl quicx.Stream, dc quicx.DatagramConn, data *model.ArchivalData, mr *measurer.WebTransportMeasurer, params spec.Params) error {
+	logging.Logger.Debug("sender: start")
+	// proto := ndt7metrics.ConnLabel(conn)
+	proto := ndt7metrics.SessionLabel(sess)
+
+	// Start collecting connection measurements. Measurements will be sent to
+	// src until the runtime of the subtest, when the src channel is closed.
+	src := mr.Start(ctx, params.SubtestRuntime(), params.SubtestSamplingInterval())
+	defer logging.Logger.Debug("sender: stop")
+	defer mr.Stop(src)
+
+	deadline := time.Now().Add(params.SubtestMaxRuntime())
+	err := ctrl.SetWriteDeadline(deadline) // Liveness!
+	if err != nil {
+		logging.Logger.WithError(err).Warn("sender: ctrl.SetWriteDeadline failed")
+		ndt7metrics.ClientSenderErrors.WithLabelValues(
+			proto, string(spec.SubtestDownload), "ctrl-set-write-deadline").Inc()
+		return err
+	}
+	var streams []quicx.SendStream
+	for i := 0; dc == nil && i < params.Streams; i++ {
+		str, err := sess.OpenUniStream()
+		if err != nil {
+			logging.Logger.WithError(err).Warn("sender: sess.OpenUniStream failed")
+			ndt7metrics.ClientSenderErrors.WithLabelValues(
+				proto, string(spec.SubtestDownload), "open-uni-stream").Inc()
+			return err
+		}
+		err = str.SetWriteDeadline(deadline) // Liveness!
+		if err != nil {
+			logging.Logger.WithError(err).Warn("sender: str.SetWriteDeadline failed")
+			ndt7metrics.ClientSenderErrors.WithLabelValues(
+				proto, string(spec.SubtestDownload), "str-set-write-deadline").Inc()
+			return err
+		}
+		streams = append(streams, str)
+	}
+
+	// Record measurement start time, and prepare recording of the endtime on return.
+	data.StartTime = time.Now().UTC()
+	defer func() {
+		data.EndTime = time.Now().UTC()
+	}()
+
+	// Send bulk data on each stream from a separate goroutine, until stop is
+	// called. Pending writes are unblocked by resetting the write deadline.
+	bulkctx, cancel := context.WithCancel(ctx)
+	errs := make(chan bulkError, len(streams)+1)
+	var wg sync.WaitGroup
+	for _, str := range streams {
+		wg.Add(1)
+		go func(str quicx.SendStream, c *measurer.StreamCounter) {
+			defer wg.Done()
+			if e := sendBulk(bulkctx, str, c); e != nil {
+				errs <- *e
+			}
+		}(str, mr.NewStreamCounter())
+	}
+	if dc != nil {
+		wg.Add(1)
+		go func(c *measurer.DatagramCounter) {
+			defer wg.Done()
+			if e := sendBulkDatagrams(bulkctx, dc, mr, c, params.BulkDatagramSize()); e != nil {
+				errs <- *e
+			}
+		}(mr.NewDatagramCounter())
+	}
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			for _, str := range streams {
+				str.SetWriteDeadline(time.Now())
+			}
+			wg.Wait()
+		})
+	}
+	defer stop()
+	// finish ends the download for the given reason, once the bulk data is
+	// no longer sent.
+	finish := func(reason string) error {
+		stop()
+		for _, str := range streams {
+			str.Close()
+		}
+		closer.FinishWebTransport(ctrl, proto, spec.SubtestDownload, data, reason)
+		return nil
+	}
+
+	stable := earlyexit.Start(spec.SubtestDownload, params, data)
+	for {
+		select {
+		case m, ok := <-src:
+			if !ok { // This means that the measurer has terminated
+				return finish(spec.EndReasonRuntime)
+			}
+			if err := writeJSON(ctrl, m); err != nil {
+				logging.Logger.WithError(err).Warn("sender: writeJSON failed")
+				ndt7metrics.ClientSenderErrors.WithLabelValues(
+					proto, string(spec.SubtestDownload), "write-json").Inc()
+				return err
+			}
+			// Only save measurements sent to the client.
+			data.ServerMeasurements = append(data.ServerMeasurements, m)
+			if stable.Stable(m) {
+				return finish(spec.EndReasonStable)
+			}
+			if err := ping.SendTicksWebTransport(ctrl); err != nil {
+				logging.Logger.WithError(err).Warn("sender: ping.SendTicks failed")
+				ndt7metrics.ClientSenderErrors.WithLabelValues(
+					proto, string(spec.SubtestDownload), "ping-send-ticks").Inc()
+				return err
+			}
+		case e := <-errs:
+			logging.Logger.WithError(e.err).Warn("sender: sendBulk failed")
+			ndt7metrics.ClientSenderErrors.WithLabelValues(
+				proto, string(spec.SubtestDownload), e.label).Inc()
+			return e.err
+		}
+	}
+}
+
+// bulkError is an error occurred while sending bulk data, along with the
+// metrics error label.
+type bulkError struct {
+	label string
+	err   error
+}
+
+// sendBulk sends binary messages on str until ctx is done, and counts the sent
+// bytes using c.
+func sendBulk(ctx context.Context, str quicx.SendStream, c *measurer.StreamCounter) *bulkError {
+	bulkMessageSize := 1 << 13
+	bulkDataToSend, err := makeWebTransportMessage(bulkMessageSize)
+	if err != nil {
+		return &bulkError{"make-prepared-message", err}
+	}
+	var totalSent int64
+	for ctx.Err() == nil {
+		if _, err := str.Write(bulkDataToSend); err != nil {
+			if ctx.Err() != nil {
+				return nil // The write has been interrupted by the sender.
+			}
+			return &bulkError{"write-prepared-message", err}
+		}
+		c.AddBytes(int64(bulkMessageSize))
+		// The following block of code implements the scaling of message size
+		// as recommended in the spec's appendix. We're not accounting for the
+		// size of JSON messages because they are sent on the control stream.
+		totalSent += int64(bulkMessageSize)
+		if int64(bulkMessageSize) >= spec.MaxScaledMessageSize {
+			continue // No further scaling is required
+		}
+		if int64(bulkMessageSize) > totalSent/spec.ScalingFraction {
+			continue // message size still too big compared to sent data
+		}
+		bulkMessageSize *= 2
+		bulkDataToSend, err = makeWebTransportMessage(bulkMessageSize)
+		if err != nil {
+			return &bulkError{"make-prepared-message", err}
+		}
+	}
+	return nil
+}
+
+// sendBulkDatagrams sends datagrams of the given size on dc until ctx is done,
+// and counts them using mr and c. Each datagram starts with a
+// model.DatagramHeader, so that the client can count the received datagrams.
+func sendBulkDatagrams(ctx context.Context, dc quicx.DatagramConn, mr *measurer.WebTransportMeasurer, c *measurer.DatagramCounter, size int) *bulkError {
+	buf, err := makeWebTransportMessage(size)
+	if err != nil {
+		return &bulkError{"make-prepared-message", err}
+	}
+	for seq := uint64(0); ctx.Err() == nil; seq++ {
+		h := model.DatagramHeader{
+			Seq:       seq,
+			Timestamp: int64(time.Since(c.Start()) / time.Microsecond),
+		}
+		h.Marshal(buf)
+		// Sending blocks until the datagram is packed, which only happens
+		// when the congestion controller allows sending a packet, or until
+		// ctx is done, e.g. when the peer stops acknowledging packets.
+		if err := dc.SendDatagram(ctx, buf); err != nil {
+			if ctx.Err() != nil {
+				return nil // The send has been interrupted by the sender.
+			}
+			return &bulkError{"send-datagram", err}
+		}
+		c.AddSent()
+		mr.AddBytes(int64(size))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Package earlyexit detects when the throughput of an ndt7 subtest is stable,
+// so that the subtest can end before its runtime when the client requests it.
+package earlyexit
+
+import (
+	"math"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+)
+
+// Detector detects when the throughput of a subtest is stable, according to
+// the criterion described by model.EarlyExit. The throughput is computed from
+// the bytes transferred according to each server measurement, as returned by
+// model.Measurement.Transferred, like the rate of the subtest. Since the mean
+// rate since the beginning of the subtest damps recent variations, the rates
+// compared are those between consecutive measurements.
+type Detector struct {
+	kind    spec.SubtestKind
+	samples []sample
+}
+
+// sample is the number of bytes transferred according to a measurement.
+type sample struct {
+	elapsed time.Duration
+	bytes   int64
+}
+
+// Start returns a new Detector for a subtest of the given kind and records its
+// criterion in data, if params.EarlyExit is true. Otherwise, it returns nil.
+func Start(kind spec.SubtestKind, params spec.Params, data *model.ArchivalData) *Detector {
+	if !params.EarlyExit {
+		return nil
+	}
+	data.EarlyExit = &model.EarlyExit{
+		MinRuntime: int64(spec.EarlyExitMinRuntime / time.Microsecond),
+		Window:     int64(spec.EarlyExitWindow / time.Microsecond),
+		Tolerance:  spec.EarlyExitTolerance,
+	}
+	return &Detector{kind: kind}
+}
+
+// Stable adds the throughput of m and returns whether the throughput is
+// stable. It always returns false if d is nil.
+func (d *Detector) Stable(m model.Measurement) bool {
+	if d == nil {
+		return false
+	}
+	s, ok := d.sample(m)
+	if !ok {
+		return false
+	}
+	if n := len(d.samples); n > 0 && s.elapsed <= d.samples[n-1].elapsed {
+		return false // Not a later measurement.
+	}
+	d.samples = append(d.samples, s)
+	if s.elapsed < spec.EarlyExitMinRuntime {
+		return false
+	}
+	// Forget the samples older than the window, except the most recent of
+	// them, which tells whether the samples cover the whole window.
+	start := s.elapsed - spec.EarlyExitWindow
+	for len(d.samples) > 1 && d.samples[1].elapsed <= start {
+		d.samples = d.samples[1:]
+	}
+	if d.samples[0].elapsed > start {
+		return false
+	}
+	// Compare the rate between each pair of consecutive samples with the
+	// mean rate over the window.
+	mean := rate(d.samples[0], s)
+	if mean <= 0 {
+		return false
+	}
+	for i := 1; i < len(d.samples); i++ {
+		if math.Abs(rate(d.samples[i-1], d.samples[i])-mean) > spec.EarlyExitTolerance*mean {
+			return false
+		}
+	}
+	return true
+}
+
+// sample returns the bytes transferred according to m, if any.
+func (d *Detector) sample(m model.Measurement) (sample, bool) {
+	n, elapsed, _ := m.Transferred(d.kind)
+	if elapsed <= 0 {
+		return sample{}, false
+	}
+	return sample{
+		elapsed: time.Duration(elapsed) * time.Microsecond,
+		bytes:   n,
+	}, true
+}
+
+// rate returns the rate in Mbps between the samples from and to.
+func rate(from, to sample) float64 {
+	return model.Mbps(to.bytes-from.bytes, int64((to.elapsed-from.elapsed)/time.Microsecond))
+}
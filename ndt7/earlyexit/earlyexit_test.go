@@ -0,0 +1,127 @@
+package earlyexit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// appInfo returns a measurement of a rate in Mbps after elapsed.
+func appInfo(elapsed time.Duration, rate float64) model.Measurement {
+	us := int64(elapsed / time.Microsecond)
+	return model.Measurement{
+		AppInfo: &model.AppInfo{NumBytes: int64(rate * float64(us) / 8), ElapsedTime: us},
+	}
+}
+
+// appInfos returns the measurements taken every 500ms of a transfer whose
+// rate in Mbps during each interval between measurements is given by rates.
+func appInfos(rates ...float64) []model.Measurement {
+	var m []model.Measurement
+	var bits float64
+	for i, rate := range rates {
+		bits += rate * 500000
+		m = append(m, model.Measurement{
+			AppInfo: &model.AppInfo{NumBytes: int64(bits / 8), ElapsedTime: int64(i+1) * 500000},
+		})
+	}
+	return m
+}
+
+func TestStart(t *testing.T) {
+	data := &model.ArchivalData{}
+	if d := Start(spec.SubtestDownload, spec.Params{}, data); d != nil || data.EarlyExit != nil {
+		t.Errorf("Start() without EarlyExit = %v, criterion %v", d, data.EarlyExit)
+	}
+	if d := Start(spec.SubtestDownload, spec.Params{EarlyExit: true}, data); d == nil {
+		t.Errorf("Start() with EarlyExit = nil")
+	}
+	want := model.EarlyExit{MinRuntime: 3000000, Window: 2000000, Tolerance: 0.05}
+	if data.EarlyExit == nil || *data.EarlyExit != want {
+		t.Errorf("Start() criterion = %v, want %v", data.EarlyExit, want)
+	}
+	var d *Detector
+	if d.Stable(appInfo(5*time.Second, 10)) {
+		t.Errorf("nil Detector is stable")
+	}
+}
+
+func TestDetector_Stable(t *testing.T) {
+	tests := []struct {
+		name  string
+		kind  spec.SubtestKind
+		m     []model.Measurement
+		wantN int // Index of the first stable measurement, or -1.
+	}{
+		{
+			name:  "stable-after-min-runtime",
+			kind:  spec.SubtestDownload,
+			m:     appInfos(50, 100, 100, 100, 100, 102, 101, 100),
+			wantN: 5,
+		},
+		{
+			name:  "ramping-up",
+			kind:  spec.SubtestDownload,
+			m:     appInfos(20, 40, 60, 80, 90, 95, 100, 100, 100, 100, 100),
+			wantN: 8,
+		},
+		{
+			// The mean rate since the beginning stays within 5% of 100
+			// Mbps after three seconds, while the rate between
+			// measurements does not.
+			name:  "oscillating",
+			kind:  spec.SubtestDownload,
+			m:     appInfos(80, 120, 80, 120, 80, 120, 80, 120, 80, 120, 80, 120),
+			wantN: -1,
+		},
+		{
+			name: "window-not-covered",
+			kind: spec.SubtestDownload,
+			m: []model.Measurement{
+				appInfo(1500*time.Millisecond, 100),
+				appInfo(3*time.Second, 100),
+				appInfo(3400*time.Millisecond, 100),
+			},
+			wantN: -1,
+		},
+		{
+			name: "upload-tcpinfo",
+			kind: spec.SubtestUpload,
+			m: []model.Measurement{
+				{TCPInfo: &model.TCPInfo{
+					LinuxTCPInfo: tcp.LinuxTCPInfo{BytesAcked: 1, BytesReceived: 10000000},
+					ElapsedTime:  1000000,
+				}},
+				{TCPInfo: &model.TCPInfo{
+					LinuxTCPInfo: tcp.LinuxTCPInfo{BytesAcked: 1, BytesReceived: 30000000},
+					ElapsedTime:  3000000,
+				}},
+			},
+			wantN: 1,
+		},
+		{
+			name:  "no-rate",
+			kind:  spec.SubtestDownload,
+			m:     []model.Measurement{{}, appInfo(1*time.Second, 0), appInfo(4*time.Second, 0)},
+			wantN: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Detector{kind: tt.kind}
+			got := -1
+			for i, m := range tt.m {
+				if d.Stable(m) {
+					got = i
+					break
+				}
+			}
+			if got != tt.wantN {
+				t.Errorf("Stable() first true at %d, want %d", got, tt.wantN)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Package feed relays the measurements of the download subtests over plain
+// HTTP streams to a parallel request of their clients. The body of a download
+// response carries bulk data, and HTTP/3 has no trailers in this
+// implementation, so that the measurements cannot be sent with the download.
+package feed
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	"github.com/m-lab/ndt-server/ndt7/model"
+)
+
+// ErrUnknown means that no feed in progress has the requested ID, or that the
+// feed is already read.
+var ErrUnknown = errors.New("feed: unknown feed")
+
+// backlog is the number of measurements of a feed that may wait to be read.
+// Further measurements are dropped.
+const backlog = 256
+
+// Registry keeps the feeds in progress by ID. Its methods are safe for
+// concurrent use.
+type Registry struct {
+	mu    sync.Mutex
+	feeds map[string]*Feed
+}
+
+// NewRegistry returns a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{feeds: make(map[string]*Feed)}
+}
+
+// Feed relays the measurements of a subtest, returned by Registry.Create.
+type Feed struct {
+	r    *Registry
+	id   string
+	ch   chan model.Measurement
+	once sync.Once
+}
+
+// Create creates a feed. Its ID is chosen at random, so that only the client
+// of the subtest, which receives it, may read the feed. The caller must call
+// Close once the subtest is over.
+func (r *Registry) Create() (*Feed, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	f := &Feed{
+		r:  r,
+		id: hex.EncodeToString(b),
+		ch: make(chan model.Measurement, backlog),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.feeds[f.id] = f
+	return f, nil
+}
+
+// Read returns the measurements of the feed with the given ID, which are
+// closed once the feed is closed. A feed can only be read once, and it fails
+// with ErrUnknown afterwards.
+func (r *Registry) Read(id string) (<-chan model.Measurement, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.feeds[id]
+	if !ok {
+		return nil, ErrUnknown
+	}
+	delete(r.feeds, id)
+	return f.ch, nil
+}
+
+// ID returns the ID of the feed.
+func (f *Feed) ID() string {
+	return f.id
+}
+
+// Send sends m to the reader of the feed, without blocking. When the reader
+// lags behind by more than the backlog, m is dropped. Send must not be called
+// after Close.
+func (f *Feed) Send(m model.Measurement) {
+	select {
+	case f.ch <- m:
+	default:
+	}
+}
+
+// Close removes the feed from its registry, if it is not read yet, and ends
+// the measurements of its reader.
+func (f *Feed) Close() {
+	f.once.Do(func() {
+		f.r.mu.Lock()
+		if f.r.feeds[f.id] == f {
+			delete(f.r.feeds, f.id)
+		}
+		f.r.mu.Unlock()
+		close(f.ch)
+	})
+}
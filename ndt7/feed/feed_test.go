@@ -0,0 +1,59 @@
+package feed
+
+import (
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt7/model"
+)
+
+func TestRegistry_Read(t *testing.T) {
+	r := NewRegistry()
+	if _, err := r.Read("a"); err != ErrUnknown {
+		t.Errorf("Read() of an unknown feed error = %v, want %v", err, ErrUnknown)
+	}
+	f, err := r.Create()
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if other, _ := r.Create(); other.ID() == f.ID() {
+		t.Errorf("Create() returned the feed ID %q twice", f.ID())
+	}
+	// Measurements sent before the feed is read are kept.
+	f.Send(model.Measurement{AppInfo: &model.AppInfo{NumBytes: 1}})
+	ch, err := r.Read(f.ID())
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if _, err := r.Read(f.ID()); err != ErrUnknown {
+		t.Errorf("Read() of a read feed error = %v, want %v", err, ErrUnknown)
+	}
+	f.Send(model.Measurement{AppInfo: &model.AppInfo{NumBytes: 2}})
+	f.Close()
+	var got []int64
+	for m := range ch {
+		got = append(got, m.AppInfo.NumBytes)
+	}
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("Read() measurements = %v, want [1 2]", got)
+	}
+}
+
+func TestFeed_Close(t *testing.T) {
+	r := NewRegistry()
+	f, err := r.Create()
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	// Measurements beyond the backlog are dropped.
+	for i := 0; i < backlog+1; i++ {
+		f.Send(model.Measurement{})
+	}
+	f.Close()
+	f.Close()
+	if _, err := r.Read(f.ID()); err != ErrUnknown {
+		t.Errorf("Read() of a closed feed error = %v, want %v", err, ErrUnknown)
+	}
+	if n := len(f.ch); n != backlog {
+		t.Errorf("got %d measurements, want %d", n, backlog)
+	}
+}
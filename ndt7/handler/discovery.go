@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+)
+
+// ndt5URLPath is the URL path of the ndt5 WebSocket tests.
+const ndt5URLPath = "/ndt_protocol"
+
+// Discovery handles service-discovery requests, replying with the URLs of the
+// tests offered by the server, so that clients can pick a transport. The
+// fields are the addresses of the servers, e.g. ":443". Servers with an empty
+// address are not enabled, and their tests are not listed.
+type Discovery struct {
+	// NDT7Addr is the address of the ndt7 WebSocket and HTTP/2 TLS server.
+	NDT7Addr string
+	// NDT7AddrCleartext is the address of the ndt7 WebSocket cleartext server.
+	NDT7AddrCleartext string
+	// NDTQUICAddr is the address of the ndtQUIC WebTransport and HTTP/3 server.
+	NDTQUICAddr string
+	// NDTQUICRawAddr is the address of the ndtQUIC raw QUIC server.
+	NDTQUICRawAddr string
+	// NDT5Addr is the address of the ndt5 server, which serves both the raw
+	// and the WebSocket tests.
+	NDT5Addr string
+	// NDT5WssAddr is the address of the ndt5 WebSocket TLS server.
+	NDT5WssAddr string
+}
+
+// ServeHTTP replies with a model.Discovery. The URLs use the host requested
+// by the client.
+func (d Discovery) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	host := (&url.URL{Host: req.Host}).Hostname()
+	data, err := json.Marshal(model.Discovery{FQDN: host, URLs: d.urls(host)})
+	if err != nil {
+		logging.Logger.WithError(err).Warn("Discovery: json.Marshal failed")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Write(data)
+}
+
+// urls returns the URLs of the enabled tests on host.
+func (d Discovery) urls(host string) map[string]string {
+	urls := make(map[string]string)
+	// add adds the URL of the test with the given path to urls, identifying
+	// the transport with the scheme of the key.
+	add := func(key, scheme, addr, path string) {
+		if addr == "" {
+			return
+		}
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			// The servers could not have been started with such an address.
+			return
+		}
+		u := &url.URL{Scheme: scheme, Host: net.JoinHostPort(host, port), Path: path}
+		urls[key] = u.String()
+	}
+	for _, path := range []string{spec.DownloadURLPath, spec.UploadURLPath} {
+		add("ws://"+path, "ws", d.NDT7AddrCleartext, path)
+		add("wss://"+path, "wss", d.NDT7Addr, path)
+		add("webtransport://"+path, "https", d.NDTQUICAddr, path)
+		add("quic://"+path, "quic", d.NDTQUICRawAddr, path)
+	}
+	add("ws://"+spec.BidirectionalURLPath, "ws", d.NDT7AddrCleartext, spec.BidirectionalURLPath)
+	add("wss://"+spec.BidirectionalURLPath, "wss", d.NDT7Addr, spec.BidirectionalURLPath)
+	add("webtransport://"+spec.DatagramURLPath, "https", d.NDTQUICAddr, spec.DatagramURLPath)
+	add("webtransport://"+spec.CombinedURLPath, "https", d.NDTQUICAddr, spec.CombinedURLPath)
+	for _, path := range []string{spec.HTTPDownloadURLPath, spec.HTTPUploadURLPath} {
+		add("h2://"+path, "https", d.NDT7Addr, path)
+		add("h3://"+path, "https", d.NDTQUICAddr, path)
+	}
+	// The raw ndt5 tests have no URL path. The ndt5 WebSocket tests are
+	// also served on the raw server.
+	add("tcp://"+ndt5URLPath, "tcp", d.NDT5Addr, "")
+	add("ws://"+ndt5URLPath, "ws", d.NDT5Addr, ndt5URLPath)
+	add("wss://"+ndt5URLPath, "wss", d.NDT5WssAddr, ndt5URLPath)
+	return urls
+}
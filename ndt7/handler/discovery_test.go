@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt7/model"
+)
+
+func TestDiscovery_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		d        Discovery
+		method   string
+		host     string
+		wantCode int
+		want     *model.Discovery
+	}{
+		{
+			name: "all-enabled",
+			d: Discovery{
+				NDT7Addr:          ":443",
+				NDT7AddrCleartext: ":80",
+				NDTQUICAddr:       ":4443",
+				NDTQUICRawAddr:    ":4444",
+				NDT5Addr:          ":3001",
+				NDT5WssAddr:       ":3010",
+			},
+			method:   http.MethodGet,
+			host:     "ndt.example.org:443",
+			wantCode: http.StatusOK,
+			want: &model.Discovery{
+				FQDN: "ndt.example.org",
+				URLs: map[string]string{
+					"ws:///ndt/v7/download":           "ws://ndt.example.org:80/ndt/v7/download",
+					"ws:///ndt/v7/upload":             "ws://ndt.example.org:80/ndt/v7/upload",
+					"ws:///ndt/v7/bidirectional":      "ws://ndt.example.org:80/ndt/v7/bidirectional",
+					"wss:///ndt/v7/download":          "wss://ndt.example.org:443/ndt/v7/download",
+					"wss:///ndt/v7/upload":            "wss://ndt.example.org:443/ndt/v7/upload",
+					"wss:///ndt/v7/bidirectional":     "wss://ndt.example.org:443/ndt/v7/bidirectional",
+					"h2:///ndt/v7/http/download":      "https://ndt.example.org:443/ndt/v7/http/download",
+					"h2:///ndt/v7/http/upload":        "https://ndt.example.org:443/ndt/v7/http/upload",
+					"webtransport:///ndt/v7/download": "https://ndt.example.org:4443/ndt/v7/download",
+					"webtransport:///ndt/v7/upload":   "https://ndt.example.org:4443/ndt/v7/upload",
+					"webtransport:///ndt/v7/datagram": "https://ndt.example.org:4443/ndt/v7/datagram",
+					"webtransport:///ndt/v7/combined": "https://ndt.example.org:4443/ndt/v7/combined",
+					"h3:///ndt/v7/http/download":      "https://ndt.example.org:4443/ndt/v7/http/download",
+					"h3:///ndt/v7/http/upload":        "https://ndt.example.org:4443/ndt/v7/http/upload",
+					"quic:///ndt/v7/download":         "quic://ndt.example.org:4444/ndt/v7/download",
+					"quic:///ndt/v7/upload":           "quic://ndt.example.org:4444/ndt/v7/upload",
+					"tcp:///ndt_protocol":             "tcp://ndt.example.org:3001",
+					"ws:///ndt_protocol":              "ws://ndt.example.org:3001/ndt_protocol",
+					"wss:///ndt_protocol":             "wss://ndt.example.org:3010/ndt_protocol",
+				},
+			},
+		},
+		{
+			name: "cleartext-only-ipv6",
+			d: Discovery{
+				NDT7AddrCleartext: "[::]:80",
+				NDT5Addr:          ":3001",
+			},
+			method:   http.MethodGet,
+			host:     "[2001:db8::1]",
+			wantCode: http.StatusOK,
+			want: &model.Discovery{
+				FQDN: "2001:db8::1",
+				URLs: map[string]string{
+					"ws:///ndt/v7/download":      "ws://[2001:db8::1]:80/ndt/v7/download",
+					"ws:///ndt/v7/upload":        "ws://[2001:db8::1]:80/ndt/v7/upload",
+					"ws:///ndt/v7/bidirectional": "ws://[2001:db8::1]:80/ndt/v7/bidirectional",
+					"tcp:///ndt_protocol":        "tcp://[2001:db8::1]:3001",
+					"ws:///ndt_protocol":         "ws://[2001:db8::1]:3001/ndt_protocol",
+				},
+			},
+		},
+		{
+			name:     "bad-method",
+			d:        Discovery{NDT7Addr: ":443"},
+			method:   http.MethodPost,
+			host:     "ndt.example.org",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/ndt/v7/discovery", nil)
+			req.Host = tt.host
+			rw := httptest.NewRecorder()
+			tt.d.ServeHTTP(rw, req)
+			if rw.Code != tt.wantCode {
+				t.Fatalf("ServeHTTP() code = %d, want %d", rw.Code, tt.wantCode)
+			}
+			if tt.want == nil {
+				return
+			}
+			if ct := rw.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("ServeHTTP() Content-Type = %q", ct)
+			}
+			got := &model.Discovery{}
+			if err := json.Unmarshal(rw.Body.Bytes(), got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ServeHTTP() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
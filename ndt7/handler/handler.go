@@ -3,15 +3,22 @@ package handler
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
-	"log"
 
 	"github.com/gorilla/websocket"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
 
 	"github.com/m-lab/access/controller"
 	"github.com/m-lab/go/prometheusx"
@@ -20,13 +27,20 @@ import (
 	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metadata"
 	"github.com/m-lab/ndt-server/metrics"
+	"github.com/m-lab/ndt-server/ndt7/bidirectional"
+	"github.com/m-lab/ndt-server/ndt7/combined"
+	"github.com/m-lab/ndt-server/ndt7/datagram"
 	"github.com/m-lab/ndt-server/ndt7/download"
+	"github.com/m-lab/ndt-server/ndt7/feed"
+	"github.com/m-lab/ndt-server/ndt7/measurer"
 	ndt7metrics "github.com/m-lab/ndt-server/ndt7/metrics"
 	"github.com/m-lab/ndt-server/ndt7/model"
 	"github.com/m-lab/ndt-server/ndt7/results"
+	"github.com/m-lab/ndt-server/ndt7/session"
 	"github.com/m-lab/ndt-server/ndt7/spec"
 	"github.com/m-lab/ndt-server/ndt7/upload"
 	"github.com/m-lab/ndt-server/netx"
+	"github.com/m-lab/ndt-server/quicx"
 	"github.com/m-lab/ndt-server/version"
 	"github.com/marten-seemann/webtransport-go"
 )
@@ -41,12 +55,28 @@ type Handler struct {
 	InsecurePort string
 	// ServerMetadata contains deployment-specific metadata.
 	ServerMetadata []metadata.NameValue
+	// Limits are the defaults and bounds of the runtime and of the sampling
+	// interval of subtests. A zero Limits means spec.DefaultLimits.
+	Limits spec.Limits
+	// Sessions correlates the flows of multi-flow sessions. If nil,
+	// multi-flow sessions are not supported.
+	Sessions *session.Registry
+	// Feeds relays the measurements of the download subtests over plain HTTP
+	// streams to HTTPMeasurements. If nil, they are only sent in a trailer.
+	Feeds *feed.Registry
 }
 
+// webTransportDraftHeader is the response header where the WebTransport server
+// reports the negotiated draft version.
+const webTransportDraftHeader = "Sec-Webtransport-Http3-Draft"
+
 // QUICHandler handles ndtQUIC subtests.
 type QUICHandler struct {
 	Handler
 	Server *webtransport.Server
+	// QUICConfig is the configuration of the server accepting the raw QUIC
+	// connections handled by ServeQUIC.
+	QUICConfig *quic.Config
 }
 
 // warnAndClose emits message as a warning and the sends a Bad Request
@@ -67,22 +97,64 @@ func (h Handler) Upload(rw http.ResponseWriter, req *http.Request) {
 	h.runMeasurement(spec.SubtestUpload, rw, req)
 }
 
-
+// Bidirectional handles the bidirectional subtest.
+func (h Handler) Bidirectional(rw http.ResponseWriter, req *http.Request) {
+	h.runMeasurement(spec.SubtestBidirectional, rw, req)
+}
 
 // Download handles the download subtest.
 func (h QUICHandler) Download(rw http.ResponseWriter, req *http.Request) {
-	log.Println("DOWNLOAD")
 	h.runH3Measurement(h.Server, spec.SubtestDownload, rw, req)
 }
 
 // Upload handles the upload subtest.
 func (h QUICHandler) Upload(rw http.ResponseWriter, req *http.Request) {
-	log.Println("UPLOAD")
 	h.runH3Measurement(h.Server, spec.SubtestUpload, rw, req)
 }
-// runMeasurement conditionally runs either download or upload based on kind.
-// The kind argument must be spec.SubtestDownload or spec.SubtestUpload.
+
+// Datagram handles the datagram subtest.
+func (h QUICHandler) Datagram(rw http.ResponseWriter, req *http.Request) {
+	h.runH3Measurement(h.Server, spec.SubtestDatagram, rw, req)
+}
+
+// Combined handles the combined subtest.
+func (h QUICHandler) Combined(rw http.ResponseWriter, req *http.Request) {
+	h.runH3Measurement(h.Server, spec.SubtestCombined, rw, req)
+}
+
+// runMeasurement conditionally runs either download, upload, datagram or
+// combined based on kind. The kind argument must be spec.SubtestDownload,
+// spec.SubtestUpload, spec.SubtestDatagram or spec.SubtestCombined.
 func (h QUICHandler) runH3Measurement(server *webtransport.Server, kind spec.SubtestKind, rw http.ResponseWriter, req *http.Request) {
+	params, err := getParams(req.URL.Query())
+	if err != nil {
+		warnAndClose(rw, "runH3Measurement: invalid parameters: "+err.Error())
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "params-error").Inc()
+		return
+	}
+	params = h.Limits.Negotiate(params)
+	if params.BulkDatagrams && kind != spec.SubtestDownload && kind != spec.SubtestCombined {
+		warnAndClose(rw, "runH3Measurement: bulk datagrams are only supported by downloads")
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "params-error").Inc()
+		return
+	}
+	if params.Simultaneous && kind != spec.SubtestCombined {
+		warnAndClose(rw, "runH3Measurement: simultaneous is only supported by combined subtests")
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "params-error").Inc()
+		return
+	}
+	var dc quicx.DatagramConn
+	if kind == spec.SubtestDatagram || params.BulkDatagrams {
+		dc, err = webTransportDatagrams(rw, req)
+		if err != nil {
+			warnAndClose(rw, "runH3Measurement: "+err.Error())
+			ndt7metrics.ClientConnections.WithLabelValues(string(kind), "datagram-error").Inc()
+			return
+		}
+		// Stop receiving the datagrams of the session once the subtest
+		// ends, since later sessions may run over the same connection.
+		defer dc.Close()
+	}
 	// Setup websocket connection.
 	sess, err := setupH3Conn(server, rw, req)
 	if sess == nil || err != nil {
@@ -90,85 +162,473 @@ func (h QUICHandler) runH3Measurement(server *webtransport.Server, kind spec.Sub
 		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "websocket-error").Inc()
 		return
 	}
-	// Make sure that the connection is closed after (at most) MaxRuntime.
-	// Download and upload tests have their own timeouts, but we have observed
-	// that under particular network conditions the connection can remain open
-	// while the receiver goroutine is blocked on a read syscall, long after
-	// the client is gone. This is a workaround for that.
-	ctx, cancel := context.WithTimeout(req.Context(), spec.MaxRuntime)
+	// Make sure that the connection is closed after (at most) the maximum
+	// runtime of the subtest. Download and upload tests have their own
+	// timeouts, but we have observed that under particular network conditions
+	// the connection can remain open while the receiver goroutine is blocked
+	// on a read syscall, long after the client is gone. This is a workaround
+	// for that. Combined subtests running one subtest after the other take
+	// twice as long.
+	runtime := params.SubtestMaxRuntime()
+	if kind == spec.SubtestCombined && !params.Simultaneous {
+		runtime *= 2
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), runtime)
 	defer cancel()
 	go func() {
 		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			// Only close the session, since other sessions may run over
+			// the same connection, but tell the client why.
+			if streamer, ok := req.Body.(http3.HTTPStreamer); ok {
+				streamer.HTTPStream().CancelWrite(spec.QUICErrorTimeout)
+			}
+		}
 		warnonerror.Close(sess, "runMeasurement: ignoring conn.Close result")
 	}()
 	// Create measurement archival data.
-	data, err := getWebTransportData(sess)
+	data, err := getQUICData(quicx.FromWebTransport(sess))
 	if err != nil {
 		// TODO: test failure.
 		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "uuid-error").Inc()
 		return
 	}
+	// Apply the per-subtest QUIC parameters and record those in effect.
+	var conf *quic.Config
+	if server != nil {
+		conf = server.H3.QuicConfig
+	}
+	quicParams, restore, err := setupQUICParams(quicx.FromWebTransport(sess), conf, params)
+	if err != nil {
+		// TODO: test failure.
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "quic-params-error").Inc()
+		return
+	}
+	defer restore()
+	data.QUICParams = quicParams
+	data.Timing = getTiming(params)
 	// We are guaranteed to collect a result at this point (even if it's with an error)
 	ndt7metrics.ClientConnections.WithLabelValues(string(kind), "result").Inc()
 
 	// Collect most client metadata from request parameters.
 	appendClientMetadata(data, req.URL.Query())
 	data.ServerMetadata = h.ServerMetadata
+	proto := ndt7metrics.SessionLabel(quicx.FromWebTransport(sess))
+	data.Protocol = proto
 	// Create ultimate result.
-	result := setupWebTransportResult(sess)
+	result := setupWebTransportResult(sess, rw)
 	result.StartTime = time.Now().UTC()
 
 	// Guarantee results are written even if function panics.
 	defer func() {
 		result.EndTime = time.Now().UTC()
-		h.writeResult(data.UUID, kind, result)
+		h.writeQUICResult(data.UUID, kind, result)
 	}()
 
 	// Run measurement.
-	var rate float64
 	if kind == spec.SubtestDownload {
 		result.Download = data
-		err = download.DoWebTransport(ctx, sess, data)
-		rate = downRate(data.ServerMeasurements)
+		err = download.DoWebTransport(ctx, sess, dc, data, params)
 	} else if kind == spec.SubtestUpload {
 		result.Upload = data
-		err = upload.DoWebTransport(ctx, sess, data)
-		rate = upRate(data.ServerMeasurements)
+		err = upload.DoWebTransport(ctx, sess, data, params)
+	} else if kind == spec.SubtestDatagram {
+		result.Datagram = data
+		err = datagram.DoWebTransport(ctx, sess, dc, data, params)
+	} else if kind == spec.SubtestCombined {
+		// Both subtests share the connection, hence the UUID, the QUIC
+		// parameters and the metadata.
+		up := *data
+		result.Download = data
+		result.Upload = &up
+		err = combined.DoWebTransport(ctx, sess, dc, result.Download, result.Upload, params)
+	}
+	if params.BulkDatagrams {
+		data.DatagramThroughput = datagramThroughput(data, params.BulkDatagramSize())
 	}
 
-	// proto := ndt7metrics.ConnLabel(conn)
-	proto := "ndt+webtransport"
-	ndt7metrics.ClientTestResults.WithLabelValues(
-		proto, string(kind), metrics.GetResultLabel(err, rate)).Inc()
-	if rate > 0 {
-		isMon := fmt.Sprintf("%t", controller.IsMonitoring(controller.GetClaim(req.Context())))
-		// Update the common (ndt5+ndt7) measurement rates histogram.
-		metrics.TestRate.WithLabelValues(proto, string(kind), isMon).Observe(rate)
+	if kind == spec.SubtestCombined {
+		observeRate(req.Context(), proto, spec.SubtestDownload, result.Download, err)
+		observeRate(req.Context(), proto, spec.SubtestUpload, result.Upload, err)
+	} else {
+		observeRate(req.Context(), proto, kind, data, err)
+	}
+	sess.Close()
+}
+
+// warnAndCloseQUIC emits message as a warning and then closes conn with the
+// spec.QUICErrorBadRequest application error code.
+func warnAndCloseQUIC(conn quic.Connection, message string) {
+	logging.Logger.Warn(message)
+	conn.CloseWithError(spec.QUICErrorBadRequest, message)
+}
+
+// ServeQUIC handles a raw QUIC connection, negotiated with the spec.QUICALPN
+// protocol. The client opens a bidirectional stream and sends its request
+// line, i.e. the URL path and query string of the subtest followed by a
+// newline. The subtest then runs like over WebTransport, except that this
+// stream is used as the control stream. Each connection runs one subtest.
+func (h QUICHandler) ServeQUIC(conn quic.Connection) {
+	// Make sure that the connection is closed after (at most) the maximum
+	// runtime of a subtest while waiting for the request.
+	reqCtx, reqCancel := context.WithTimeout(conn.Context(), h.Limits.SubtestMaxRuntime())
+	defer reqCancel()
+	ctrl, err := conn.AcceptStream(reqCtx)
+	if err != nil {
+		logging.Logger.WithError(err).Warn("ServeQUIC: accepting the request stream failed")
+		ndt7metrics.ClientConnections.WithLabelValues("unknown", "request-error").Inc()
+		conn.CloseWithError(spec.QUICErrorNone, "")
+		return
+	}
+	// The receiver sets the read deadline of the subtest later.
+	err = ctrl.SetReadDeadline(time.Now().Add(h.Limits.SubtestMaxRuntime()))
+	var reqURL *url.URL
+	if err == nil {
+		reqURL, err = readQUICRequest(ctrl)
+	}
+	if err != nil {
+		warnAndCloseQUIC(conn, "ServeQUIC: invalid request: "+err.Error())
+		ndt7metrics.ClientConnections.WithLabelValues("unknown", "request-error").Inc()
+		return
+	}
+	var kind spec.SubtestKind
+	switch reqURL.Path {
+	case spec.DownloadURLPath:
+		kind = spec.SubtestDownload
+	case spec.UploadURLPath:
+		kind = spec.SubtestUpload
+	default:
+		warnAndCloseQUIC(conn, "ServeQUIC: unknown path "+reqURL.Path)
+		ndt7metrics.ClientConnections.WithLabelValues("unknown", "request-error").Inc()
+		return
 	}
+	values := reqURL.Query()
+	params, err := getParams(values)
+	if err != nil {
+		warnAndCloseQUIC(conn, "ServeQUIC: invalid parameters: "+err.Error())
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "params-error").Inc()
+		return
+	}
+	if params.BulkDatagrams {
+		warnAndCloseQUIC(conn, "ServeQUIC: bulk datagrams are only supported over WebTransport")
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "params-error").Inc()
+		return
+	}
+	params = h.Limits.Negotiate(params)
+	// Make sure that the connection is closed after (at most) the maximum
+	// runtime of the subtest.
+	ctx, cancel := context.WithTimeout(conn.Context(), params.SubtestMaxRuntime())
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			conn.CloseWithError(spec.QUICErrorTimeout, "")
+			return
+		}
+		conn.CloseWithError(spec.QUICErrorNone, "")
+	}()
+	sess := quicx.FromQUIC(conn)
+	// Create measurement archival data.
+	data, err := getQUICData(sess)
+	if err != nil {
+		// TODO: test failure.
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "uuid-error").Inc()
+		return
+	}
+	// Apply the per-subtest QUIC parameters and record those in effect.
+	quicParams, restore, err := setupQUICParams(sess, h.QUICConfig, params)
+	if err != nil {
+		// TODO: test failure.
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "quic-params-error").Inc()
+		return
+	}
+	defer restore()
+	data.QUICParams = quicParams
+	data.Timing = getTiming(params)
+	// We are guaranteed to collect a result at this point (even if it's with an error)
+	ndt7metrics.ClientConnections.WithLabelValues(string(kind), "result").Inc()
+
+	// Collect most client metadata from request parameters.
+	appendClientMetadata(data, values)
+	data.ServerMetadata = h.ServerMetadata
+	data.Protocol = ndt7metrics.SessionLabel(sess)
+	// Create ultimate result.
+	cs := conn.ConnectionState()
+	result := setupQUICResult(sess, &cs)
+	result.StartTime = time.Now().UTC()
+
+	// Guarantee results are written even if function panics.
+	defer func() {
+		result.EndTime = time.Now().UTC()
+		h.writeQUICResult(data.UUID, kind, result)
+	}()
+
+	// Run measurement.
+	if kind == spec.SubtestDownload {
+		result.Download = data
+		err = download.DoQUIC(ctx, conn, ctrl, data, params)
+	} else if kind == spec.SubtestUpload {
+		result.Upload = data
+		err = upload.DoQUIC(ctx, conn, ctrl, data, params)
+	}
+
+	observeRate(conn.Context(), data.Protocol, kind, data, err)
 	sess.Close()
 }
 
-// runMeasurement conditionally runs either download or upload based on kind.
-// The kind argument must be spec.SubtestDownload or spec.SubtestUpload.
+// readQUICRequest reads the request line sent by a raw QUIC client on r and
+// parses the URL it contains. The request line is read one byte at a time, so
+// that the measurement messages that may follow it are left unread.
+func readQUICRequest(r io.Reader) (*url.URL, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < spec.MaxQUICRequestSize {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return url.ParseRequestURI(strings.TrimSuffix(string(line), "\r"))
+		}
+		line = append(line, b[0])
+	}
+	return nil, errors.New("request line too long")
+}
+
+// runMeasurement conditionally runs either download, upload or bidirectional
+// based on kind. The kind argument must be spec.SubtestDownload,
+// spec.SubtestUpload or spec.SubtestBidirectional.
 func (h Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter, req *http.Request) {
+	params, err := getWebSocketParams(req.URL.Query())
+	if err != nil {
+		warnAndClose(rw, "runMeasurement: invalid parameters: "+err.Error())
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "params-error").Inc()
+		return
+	}
+	if kind == spec.SubtestBidirectional && (params.EarlyExit || params.MaxBytes > 0 || params.Flows > 0) {
+		warnAndClose(rw, "runMeasurement: early_exit, max_bytes and flows are not supported by bidirectional subtests")
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "params-error").Inc()
+		return
+	}
+	params = h.Limits.Negotiate(params)
+	// Join the multi-flow session of the subtest, if any. The result of the
+	// subtest is then written with those of the other flows of the session.
+	var flow *session.Flow
+	var result *data.NDT7Result
+	if params.Flows > 0 {
+		if h.Sessions == nil {
+			warnAndClose(rw, "runMeasurement: multi-flow sessions are not supported")
+			ndt7metrics.ClientConnections.WithLabelValues(string(kind), "params-error").Inc()
+			return
+		}
+		// The first flow creates the session, whose ID is returned to the
+		// client for the other flows to join it.
+		if params.SessionID == "" {
+			flow, err = h.Sessions.Create(kind, params.Flows)
+		} else {
+			flow, err = h.Sessions.Join(params.SessionID, kind, params.Flows)
+		}
+		if err != nil {
+			warnAndClose(rw, "runMeasurement: "+err.Error())
+			ndt7metrics.ClientConnections.WithLabelValues(string(kind), "session-error").Inc()
+			return
+		}
+		defer func() {
+			h.endFlow(req.Context(), flow, kind, params, result)
+		}()
+	}
 	// Setup websocket connection.
-	conn := setupConn(rw, req)
+	headers := http.Header{}
+	if flow != nil {
+		headers.Set(spec.SessionIDHeader, flow.SessionID())
+	}
+	conn := setupConn(rw, req, headers)
 	if conn == nil {
 		// TODO: test failure.
 		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "websocket-error").Inc()
 		return
 	}
-	// Make sure that the connection is closed after (at most) MaxRuntime.
-	// Download and upload tests have their own timeouts, but we have observed
-	// that under particular network conditions the connection can remain open
-	// while the receiver goroutine is blocked on a read syscall, long after
-	// the client is gone. This is a workaround for that.
-	ctx, cancel := context.WithTimeout(req.Context(), spec.MaxRuntime)
+	if flow != nil {
+		// Wait for the other flows, so that they start together.
+		if err := flow.Start(req.Context()); err != nil {
+			logging.Logger.WithError(err).Warn("runMeasurement: flow.Start failed")
+			ndt7metrics.ClientConnections.WithLabelValues(string(kind), "session-error").Inc()
+			warnonerror.Close(conn, "runMeasurement: ignoring conn.Close result")
+			return
+		}
+	}
+	// Make sure that the connection is closed after (at most) the maximum
+	// runtime of the subtest. Download and upload tests have their own
+	// timeouts, but we have observed that under particular network conditions
+	// the connection can remain open while the receiver goroutine is blocked
+	// on a read syscall, long after the client is gone. This is a workaround
+	// for that.
+	ctx, cancel := context.WithTimeout(req.Context(), params.SubtestMaxRuntime())
 	defer cancel()
 	go func() {
 		<-ctx.Done()
 		warnonerror.Close(conn, "runMeasurement: ignoring conn.Close result")
 	}()
+	// The flows of a session stop together, i.e. when the first one ends.
+	subtestCtx := ctx
+	if flow != nil {
+		subtestCtx = flow.Context(ctx)
+	}
+	// Create measurement archival data.
+	data, err := getData(conn.UnderlyingConn())
+	if err != nil {
+		// TODO: test failure.
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "uuid-error").Inc()
+		return
+	}
+	data.Timing = getTiming(params)
+	// We are guaranteed to collect a result at this point (even if it's with an error)
+	ndt7metrics.ClientConnections.WithLabelValues(string(kind), "result").Inc()
+
+	// Collect most client metadata from request parameters.
+	appendClientMetadata(data, req.URL.Query())
+	data.ServerMetadata = h.ServerMetadata
+	proto := ndt7metrics.ConnLabel(conn)
+	data.Protocol = proto
+	// Create ultimate result.
+	result = setupResult(conn.UnderlyingConn())
+	result.StartTime = time.Now().UTC()
+
+	// Guarantee results are written even if function panics.
+	defer func() {
+		result.EndTime = time.Now().UTC()
+		if flow == nil {
+			h.writeResult(data.UUID, kind, result)
+		}
+	}()
+
+	// Run measurement. The measurers only sample the connection, since
+	// several of them may sample it during bidirectional subtests.
+	measurer.EnableBBR(conn.UnderlyingConn())
+	if kind == spec.SubtestDownload {
+		result.Download = data
+		err = download.Do(subtestCtx, conn, data, params)
+	} else if kind == spec.SubtestUpload {
+		result.Upload = data
+		err = upload.Do(subtestCtx, conn, data, params)
+	} else if kind == spec.SubtestBidirectional {
+		// Both directions share the connection, hence the UUID and the
+		// metadata.
+		up := *data
+		result.Download = data
+		result.Upload = &up
+		err = bidirectional.Do(subtestCtx, conn, result.Download, result.Upload, params)
+	}
+
+	if kind == spec.SubtestBidirectional {
+		observeRate(req.Context(), proto, spec.SubtestDownload, result.Download, err)
+		observeRate(req.Context(), proto, spec.SubtestUpload, result.Upload, err)
+		return
+	}
+	if flow != nil {
+		// The rate of the session is observed once all its flows end.
+		saveRate(proto, kind, data, err)
+		return
+	}
+	observeRate(req.Context(), proto, kind, data, err)
+}
+
+// endFlow ends the flow of a multi-flow session, whose result is the given
+// one, or nil if the flow did not run. Once all the flows of the session
+// end, it writes the result of the session, whose rate is the sum of the
+// rates of its flows, and observes it in the test rate metric with the
+// number of flows. The ctx argument carries the access token claim of the client, if
+// any.
+func (h Handler) endFlow(ctx context.Context, flow *session.Flow, kind spec.SubtestKind, params spec.Params, result *data.NDT7Result) {
+	flows := flow.End(result)
+	if len(flows) == 0 {
+		return
+	}
+	sessionResult := &data.NDT7SessionResult{
+		GitShortCommit: prometheusx.GitShortCommit,
+		Version:        version.Version,
+		SessionID:      flow.SessionID(),
+		RequestedFlows: params.Flows,
+		StartTime:      flows[0].StartTime,
+		EndTime:        flows[0].EndTime,
+		Flows:          flows,
+	}
+	for _, r := range flows {
+		sessionResult.MeanThroughputMbps += flowData(r, kind).MeanThroughputMbps
+		if r.StartTime.Before(sessionResult.StartTime) {
+			sessionResult.StartTime = r.StartTime
+		}
+		if r.EndTime.After(sessionResult.EndTime) {
+			sessionResult.EndTime = r.EndTime
+		}
+	}
+	first := flowData(flows[0], kind)
+	fp, err := results.NewSessionFile(first.UUID, h.DataDir, kind)
+	if err != nil {
+		logging.Logger.WithError(err).Warn("results.NewSessionFile failed")
+	} else {
+		if err := fp.WriteResult(sessionResult); err != nil {
+			logging.Logger.WithError(err).Warn("failed to write session result")
+		}
+		warnonerror.Close(fp, string(kind)+": ignoring fp.Close error")
+	}
+	observeTestRate(ctx, first.Protocol, kind, len(flows), sessionResult.MeanThroughputMbps)
+}
+
+// flowData returns the archival data of the subtest of the given kind, i.e.
+// download or upload, in result.
+func flowData(result *data.NDT7Result, kind spec.SubtestKind) *model.ArchivalData {
+	if kind == spec.SubtestUpload {
+		return result.Upload
+	}
+	return result.Download
+}
+
+// HTTPDownload handles the download subtest over plain HTTP/2 streams.
+func (h Handler) HTTPDownload(rw http.ResponseWriter, req *http.Request) {
+	h.runHTTPMeasurement(spec.SubtestDownload, rw, req)
+}
+
+// HTTPUpload handles the upload subtest over plain HTTP/2 streams.
+func (h Handler) HTTPUpload(rw http.ResponseWriter, req *http.Request) {
+	h.runHTTPMeasurement(spec.SubtestUpload, rw, req)
+}
+
+// runHTTPMeasurement is like runMeasurement but for subtests over plain HTTP/2
+// streams. Results are saved like those of WebSocket subtests.
+func (h Handler) runHTTPMeasurement(kind spec.SubtestKind, rw http.ResponseWriter, req *http.Request) {
+	if !checkHTTPRequest(kind, 2, rw, req) {
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "request-error").Inc()
+		return
+	}
+	var params spec.Params
+	var err error
+	params.Runtime, params.SamplingInterval, err = getTimingParams(req.URL.Query())
+	if err != nil {
+		warnAndClose(rw, "runHTTPMeasurement: invalid parameters: "+err.Error())
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "params-error").Inc()
+		return
+	}
+	params = h.Limits.Negotiate(params)
+	conn := netx.FromContext(req.Context())
+	if conn == nil {
+		// TODO: test failure.
+		logging.Logger.Warn("runHTTPMeasurement: no connection found for request")
+		rw.WriteHeader(http.StatusInternalServerError)
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "conn-error").Inc()
+		return
+	}
+	// Make sure that the connection is closed after (at most) the maximum
+	// runtime of the subtest. Unlike for WebSocket, the connection must be
+	// left open when the subtest completes in time, so that the response can
+	// be completed.
+	ctx, cancel := context.WithTimeout(req.Context(), params.SubtestMaxRuntime())
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			warnonerror.Close(conn, "runHTTPMeasurement: ignoring conn.Close result")
+		}
+	}()
 	// Create measurement archival data.
 	data, err := getData(conn)
 	if err != nil {
@@ -176,12 +636,15 @@ func (h Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter, r
 		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "uuid-error").Inc()
 		return
 	}
+	data.Timing = getTiming(params)
 	// We are guaranteed to collect a result at this point (even if it's with an error)
 	ndt7metrics.ClientConnections.WithLabelValues(string(kind), "result").Inc()
 
 	// Collect most client metadata from request parameters.
 	appendClientMetadata(data, req.URL.Query())
 	data.ServerMetadata = h.ServerMetadata
+	proto := ndt7metrics.HTTPLabel(req)
+	data.Protocol = proto
 	// Create ultimate result.
 	result := setupResult(conn)
 	result.StartTime = time.Now().UTC()
@@ -193,37 +656,253 @@ func (h Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter, r
 	}()
 
 	// Run measurement.
-	var rate float64
+	measurer.EnableBBR(conn)
+	mr := measurer.NewConn(conn, data.UUID)
 	if kind == spec.SubtestDownload {
 		result.Download = data
-		err = download.Do(ctx, conn, data)
-		rate = downRate(data.ServerMeasurements)
+		f := h.startFeed(rw)
+		if f != nil {
+			defer f.Close()
+		}
+		err = download.DoHTTP(ctx, rw, proto, data, mr, f, params)
 	} else if kind == spec.SubtestUpload {
 		result.Upload = data
-		err = upload.Do(ctx, conn, data)
-		rate = upRate(data.ServerMeasurements)
+		err = upload.DoHTTP(ctx, rw, req, proto, data, mr, params)
 	}
 
-	proto := ndt7metrics.ConnLabel(conn)
+	observeRate(req.Context(), proto, kind, data, err)
+}
+
+// startFeed creates the feed of the measurements of a download subtest over
+// plain HTTP streams, and sends its ID to the client in the headers of rw. It
+// returns nil if there is no feed registry or if the feed cannot be created.
+func (h Handler) startFeed(rw http.ResponseWriter) *feed.Feed {
+	if h.Feeds == nil {
+		return nil
+	}
+	f, err := h.Feeds.Create()
+	if err != nil {
+		logging.Logger.WithError(err).Warn("startFeed: failed to create feed")
+		return nil
+	}
+	rw.Header().Set(spec.MeasurementsIDHeader, f.ID())
+	return f
+}
+
+// HTTPMeasurements streams the measurements of a download subtest over plain
+// HTTP streams as newline-delimited JSON, until the subtest ends. The subtest
+// is selected by the id parameter, which the client receives in the
+// spec.MeasurementsIDHeader header of the download response.
+func (h Handler) HTTPMeasurements(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		logging.Logger.Warn("HTTPMeasurements: unexpected method " + req.Method)
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if h.Feeds == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	ch, err := h.Feeds.Read(req.URL.Query().Get("id"))
+	if err != nil {
+		logging.Logger.WithError(err).Warn("HTTPMeasurements: no measurements found")
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	flusher, _ := rw.(http.Flusher)
+	enc := json.NewEncoder(rw)
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case m, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(m); err != nil {
+				logging.Logger.WithError(err).Warn("HTTPMeasurements: enc.Encode failed")
+				ndt7metrics.ClientSenderErrors.WithLabelValues(
+					ndt7metrics.HTTPLabel(req), string(spec.SubtestDownload), "write-json").Inc()
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// HTTPDownload handles the download subtest over plain HTTP/3 streams.
+func (h QUICHandler) HTTPDownload(rw http.ResponseWriter, req *http.Request) {
+	h.runHTTPMeasurement(spec.SubtestDownload, rw, req)
+}
+
+// HTTPUpload handles the upload subtest over plain HTTP/3 streams.
+func (h QUICHandler) HTTPUpload(rw http.ResponseWriter, req *http.Request) {
+	h.runHTTPMeasurement(spec.SubtestUpload, rw, req)
+}
+
+// runHTTPMeasurement is like Handler.runHTTPMeasurement but for subtests over
+// plain HTTP/3 streams. Results are saved like those of WebTransport subtests.
+func (h QUICHandler) runHTTPMeasurement(kind spec.SubtestKind, rw http.ResponseWriter, req *http.Request) {
+	if !checkHTTPRequest(kind, 3, rw, req) {
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "request-error").Inc()
+		return
+	}
+	params, err := getParams(req.URL.Query())
+	if err != nil {
+		warnAndClose(rw, "runHTTPMeasurement: invalid parameters: "+err.Error())
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "params-error").Inc()
+		return
+	}
+	params = h.Limits.Negotiate(params)
+	// NOTE: the StreamCreator of a request is its QUIC connection.
+	var conn quic.Connection
+	if hj, ok := rw.(http3.Hijacker); ok {
+		conn, _ = hj.StreamCreator().(quic.Connection)
+	}
+	if conn == nil {
+		// TODO: test failure.
+		logging.Logger.Warn("runHTTPMeasurement: no connection found for request")
+		rw.WriteHeader(http.StatusInternalServerError)
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "conn-error").Inc()
+		return
+	}
+	sess := quicx.FromQUIC(conn)
+	// Make sure that the connection is closed after (at most) the maximum
+	// runtime of the subtest. Unlike for WebTransport, the connection must be
+	// left open when the subtest completes in time, so that the response can
+	// be completed.
+	ctx, cancel := context.WithTimeout(req.Context(), params.SubtestMaxRuntime())
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			warnonerror.Close(sess, "runHTTPMeasurement: ignoring sess.Close result")
+		}
+	}()
+	// Create measurement archival data.
+	data, err := getQUICData(sess)
+	if err != nil {
+		// TODO: test failure.
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "uuid-error").Inc()
+		return
+	}
+	// Apply the per-subtest QUIC parameters and record those in effect.
+	var conf *quic.Config
+	if h.Server != nil {
+		conf = h.Server.H3.QuicConfig
+	}
+	quicParams, restore, err := setupQUICParams(sess, conf, params)
+	if err != nil {
+		// TODO: test failure.
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "quic-params-error").Inc()
+		return
+	}
+	defer restore()
+	data.QUICParams = quicParams
+	data.Timing = getTiming(params)
+	// We are guaranteed to collect a result at this point (even if it's with an error)
+	ndt7metrics.ClientConnections.WithLabelValues(string(kind), "result").Inc()
+
+	// Collect most client metadata from request parameters.
+	appendClientMetadata(data, req.URL.Query())
+	data.ServerMetadata = h.ServerMetadata
+	proto := ndt7metrics.HTTPLabel(req)
+	data.Protocol = proto
+	// Create ultimate result.
+	cs := conn.ConnectionState()
+	result := setupQUICResult(sess, &cs)
+	result.StartTime = time.Now().UTC()
+
+	// Guarantee results are written even if function panics.
+	defer func() {
+		result.EndTime = time.Now().UTC()
+		h.writeQUICResult(data.UUID, kind, result)
+	}()
+
+	// Run measurement.
+	mr := measurer.NewWebTransport(sess, data.UUID)
+	if kind == spec.SubtestDownload {
+		result.Download = data
+		f := h.startFeed(rw)
+		if f != nil {
+			defer f.Close()
+		}
+		err = download.DoHTTP(ctx, rw, proto, data, mr, f, params)
+	} else if kind == spec.SubtestUpload {
+		result.Upload = data
+		err = upload.DoHTTP(ctx, rw, req, proto, data, mr, params)
+	}
+
+	observeRate(req.Context(), proto, kind, data, err)
+}
+
+// checkHTTPRequest checks that req uses the given major HTTP version, and the
+// method of the subtest of the given kind, i.e. GET for downloads and POST or
+// PUT for uploads. Otherwise, it sends an error response and returns false.
+// HTTP/1.x is never accepted, since it cannot stream the request and the
+// response bodies at the same time.
+func checkHTTPRequest(kind spec.SubtestKind, protoMajor int, rw http.ResponseWriter, req *http.Request) bool {
+	if req.ProtoMajor != protoMajor {
+		logging.Logger.Warn("checkHTTPRequest: unsupported protocol " + req.Proto)
+		rw.WriteHeader(http.StatusHTTPVersionNotSupported)
+		return false
+	}
+	ok := req.Method == http.MethodGet
+	if kind == spec.SubtestUpload {
+		ok = req.Method == http.MethodPost || req.Method == http.MethodPut
+	}
+	if !ok {
+		logging.Logger.Warn("checkHTTPRequest: unexpected method " + req.Method)
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// observeRate computes the rate of the subtest, saves it in data and updates
+// the test results and test rate metrics. The ctx argument carries the access
+// token claim of the client, if any.
+func observeRate(ctx context.Context, proto string, kind spec.SubtestKind, data *model.ArchivalData, err error) {
+	observeTestRate(ctx, proto, kind, 1, saveRate(proto, kind, data, err))
+}
+
+// saveRate is like observeRate, except that it only updates the test results
+// metrics, and returns the rate.
+func saveRate(proto string, kind spec.SubtestKind, data *model.ArchivalData, err error) float64 {
+	rate, source := computeRate(kind, data.ServerMeasurements)
+	data.MeanThroughputMbps = rate
+	data.ThroughputSource = source
 	ndt7metrics.ClientTestResults.WithLabelValues(
 		proto, string(kind), metrics.GetResultLabel(err, rate)).Inc()
 	if rate > 0 {
-		isMon := fmt.Sprintf("%t", controller.IsMonitoring(controller.GetClaim(req.Context())))
-		// Update the common (ndt5+ndt7) measurement rates histogram.
-		metrics.TestRate.WithLabelValues(proto, string(kind), isMon).Observe(rate)
+		ndt7metrics.ClientTestRateSources.WithLabelValues(proto, string(kind), source).Inc()
+	}
+	return rate
+}
+
+// observeTestRate updates the common (ndt5+ndt7) measurement rates histogram
+// with the rate of a test run over the given number of flows, if positive.
+func observeTestRate(ctx context.Context, proto string, kind spec.SubtestKind, flows int, rate float64) {
+	if rate > 0 {
+		isMon := fmt.Sprintf("%t", controller.IsMonitoring(controller.GetClaim(ctx)))
+		metrics.TestRate.WithLabelValues(proto, string(kind), isMon, strconv.Itoa(flows)).Observe(rate)
 	}
 }
 
 // setupConn negotiates a websocket connection. The writer argument is the HTTP
 // response writer. The request argument is the HTTP request that we received.
-func setupConn(writer http.ResponseWriter, request *http.Request) *websocket.Conn {
+// The headers argument contains additional headers of the response.
+func setupConn(writer http.ResponseWriter, request *http.Request, headers http.Header) *websocket.Conn {
 	logging.Logger.Debug("setupConn: upgrading to WebSockets")
 	if request.Header.Get("Sec-WebSocket-Protocol") != spec.SecWebSocketProtocol {
 		warnAndClose(
 			writer, "setupConn: missing Sec-WebSocket-Protocol in request")
 		return nil
 	}
-	headers := http.Header{}
 	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
@@ -249,8 +928,33 @@ func setupH3Conn(server *webtransport.Server, rw http.ResponseWriter, request *h
 	return server.Upgrade(rw, request)
 }
 
+// webTransportDatagrams returns the DatagramConn of the WebTransport session
+// requested by req. It fails if the client does not support datagrams, or if
+// the session already has a DatagramConn. The caller must close the
+// DatagramConn once the subtest ends.
+func webTransportDatagrams(rw http.ResponseWriter, req *http.Request) (quicx.DatagramConn, error) {
+	// NOTE: the StreamCreator of a request is its QUIC connection, and the
+	// WebTransport session is identified by the stream of the request.
+	var conn quic.Connection
+	if hj, ok := rw.(http3.Hijacker); ok {
+		conn, _ = hj.StreamCreator().(quic.Connection)
+	}
+	streamer, ok := req.Body.(http3.HTTPStreamer)
+	if conn == nil || !ok {
+		return nil, errors.New("no connection found for request")
+	}
+	if !conn.ConnectionState().SupportsDatagrams {
+		return nil, errors.New("datagrams not supported by the client")
+	}
+	dc, err := quicx.WebTransportDatagrams(conn, streamer.HTTPStream().StreamID())
+	if err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
 // setupResult creates an NDT7Result from the given conn.
-func setupResult(conn *websocket.Conn) *data.NDT7Result {
+func setupResult(conn net.Conn) *data.NDT7Result {
 	// NOTE: unless we plan to run the NDT server over different protocols than TCP,
 	// then we expect RemoteAddr and LocalAddr to always return net.TCPAddr types.
 	clientAddr := netx.ToTCPAddr(conn.RemoteAddr())
@@ -272,19 +976,36 @@ func setupResult(conn *websocket.Conn) *data.NDT7Result {
 	return result
 }
 
-// setupResult creates an NDTQUICResult from the given conn.
-func setupWebTransportResult(conn *webtransport.Session) *data.NDTQUICResult {
-	// NOTE: unless we plan to run the NDT server over different protocols than TCP,
-	// then we expect RemoteAddr and LocalAddr to always return net.TCPAddr types.
-	clientAddr := netx.ToUDPAddr(conn.RemoteAddr())
+// setupWebTransportResult creates an NDTQUICResult from the given conn and the
+// response writer used to upgrade it.
+func setupWebTransportResult(conn *webtransport.Session, rw http.ResponseWriter) *data.NDTQUICResult {
+	// NOTE: http3 does not fill the TLS field of requests, but the connection
+	// state is available from the response writer.
+	var cs *quic.ConnectionState
+	if h, ok := rw.(http3.Hijacker); ok {
+		state := h.StreamCreator().ConnectionState()
+		cs = &state
+	}
+	result := setupQUICResult(quicx.FromWebTransport(conn), cs)
+	result.WebTransportDraft = rw.Header().Get(webTransportDraftHeader)
+	return result
+}
+
+// setupQUICResult creates an NDTQUICResult from the given session and the
+// state of its QUIC connection, if known.
+func setupQUICResult(sess quicx.Session, cs *quic.ConnectionState) *data.NDTQUICResult {
+	// NOTE: QUIC runs over UDP, hence we expect RemoteAddr and LocalAddr to
+	// always return net.UDPAddr types.
+	clientAddr := netx.ToUDPAddr(sess.RemoteAddr())
 	if clientAddr == nil {
 		clientAddr = &net.UDPAddr{IP: net.ParseIP("::1"), Port: 1}
 	}
-	serverAddr := netx.ToUDPAddr(conn.LocalAddr())
+	serverAddr := netx.ToUDPAddr(sess.LocalAddr())
 	if serverAddr == nil {
 		serverAddr = &net.UDPAddr{IP: net.ParseIP("::1"), Port: 1}
 	}
 	result := &data.NDTQUICResult{
+		SchemaVersion:  data.NDTQUICResultSchemaVersion,
 		GitShortCommit: prometheusx.GitShortCommit,
 		Version:        version.Version,
 		ClientIP:       clientAddr.IP.String(),
@@ -292,9 +1013,44 @@ func setupWebTransportResult(conn *webtransport.Session) *data.NDTQUICResult {
 		ServerIP:       serverAddr.IP.String(),
 		ServerPort:     serverAddr.Port,
 	}
+	if cs != nil {
+		result.ALPN = cs.TLS.NegotiatedProtocol
+		result.TLSCipherSuite = tls.CipherSuiteName(cs.TLS.CipherSuite)
+		result.TLSDidResume = cs.TLS.DidResume
+		result.Used0RTT = cs.TLS.Used0RTT
+	}
+	ci, err := quicx.ToConnInfo(sess.Context())
+	if err != nil {
+		logging.Logger.WithError(err).Warn("quicx.ToConnInfo failed")
+		return result
+	}
+	result.ConnectionUUID, err = ci.GetUUID()
+	if err != nil {
+		logging.Logger.WithError(err).Warn("conninfo.GetUUID failed")
+		return result
+	}
+	hs, err := ci.ReadHandshake()
+	if err != nil {
+		logging.Logger.WithError(err).Warn("conninfo.ReadHandshake failed")
+		return result
+	}
+	result.QUICVersion = hs.Version
+	result.HandshakeDuration = hs.Duration
 	return result
 }
 
+func (h Handler) writeQUICResult(uuid string, kind spec.SubtestKind, result *data.NDTQUICResult) {
+	fp, err := results.NewQUICFile(uuid, h.DataDir, kind)
+	if err != nil {
+		logging.Logger.WithError(err).Warn("results.NewQUICFile failed")
+		return
+	}
+	if err := fp.WriteResult(result); err != nil {
+		logging.Logger.WithError(err).Warn("failed to write result")
+	}
+	warnonerror.Close(fp, string(kind)+": ignoring fp.Close error")
+}
+
 func (h Handler) writeResult(uuid string, kind spec.SubtestKind, result *data.NDT7Result) {
 	fp, err := results.NewFile(uuid, h.DataDir, kind)
 	if err != nil {
@@ -307,8 +1063,8 @@ func (h Handler) writeResult(uuid string, kind spec.SubtestKind, result *data.ND
 	warnonerror.Close(fp, string(kind)+": ignoring fp.Close error")
 }
 
-func getData(conn *websocket.Conn) (*model.ArchivalData, error) {
-	ci := netx.ToConnInfo(conn.UnderlyingConn())
+func getData(conn net.Conn) (*model.ArchivalData, error) {
+	ci := netx.ToConnInfo(conn)
 	uuid, err := ci.GetUUID()
 	if err != nil {
 		logging.Logger.WithError(err).Warn("conninfo.GetUUID failed")
@@ -320,46 +1076,262 @@ func getData(conn *websocket.Conn) (*model.ArchivalData, error) {
 	return data, nil
 }
 
-func getWebTransportData(sess *webtransport.Session) (*model.ArchivalData, error) {
-	// FIXME: export a UUID from the webtransport session
-	// ci := netx.ToConnInfo(sess)
-	// uuid, err := ci.GetUUID()
-	// if err != nil {
-	// 	logging.Logger.WithError(err).Warn("conninfo.GetUUID failed")
-	// 	return nil, err
-	// }
-	// data := &model.ArchivalData{
-	// 	UUID: uuid,
-	// }
+func getQUICData(sess quicx.Session) (*model.ArchivalData, error) {
+	ci, err := quicx.ToConnInfo(sess.Context())
+	if err != nil {
+		logging.Logger.WithError(err).Warn("quicx.ToConnInfo failed")
+		return nil, err
+	}
+	// Several subtests may run over the same connection, so each of them
+	// gets its own UUID.
+	uuid, err := ci.NewSessionUUID()
+	if err != nil {
+		logging.Logger.WithError(err).Warn("conninfo.NewSessionUUID failed")
+		return nil, err
+	}
 	data := &model.ArchivalData{
-		UUID: "NESQUIC",
+		UUID: uuid,
 	}
 	return data, nil
 }
 
-func upRate(m []model.Measurement) float64 {
-	var mbps float64
-	// NOTE: on non-Linux platforms, TCPInfo will be nil.
-	if len(m) > 0 && m[len(m)-1].TCPInfo != nil {
-		// Convert to Mbps.
-		mbps = 8 * float64(m[len(m)-1].TCPInfo.BytesReceived) / float64(m[len(m)-1].TCPInfo.ElapsedTime)
+// setupQUICParams applies the per-subtest overrides of the QUIC parameters in
+// params to the connection underlying sess, and returns the parameters in
+// effect together with a function removing the overrides once the subtest is
+// over, since the connection may carry other subtests, concurrently or later. The conf argument is the
+// configuration of the server that accepted the connection.
+func setupQUICParams(sess quicx.Session, conf *quic.Config, params spec.Params) (*model.QUICParams, func(), error) {
+	ci, err := quicx.ToConnInfo(sess.Context())
+	if err != nil {
+		logging.Logger.WithError(err).Warn("quicx.ToConnInfo failed")
+		return nil, nil, err
+	}
+	tp, err := ci.ReadParams()
+	if err != nil {
+		logging.Logger.WithError(err).Warn("conninfo.ReadParams failed")
+		return nil, nil, err
+	}
+	qp := &model.QUICParams{QUICConnParams: tp}
+	qp.MaxStreamReceiveWindow, qp.MaxConnectionReceiveWindow = quicx.MaxReceiveWindows(conf)
+	restore := func() {}
+	if n := params.MaxConnectionReceiveWindow; n > 0 {
+		if n > qp.MaxConnectionReceiveWindow {
+			n = qp.MaxConnectionReceiveWindow
+		}
+		qp.MaxConnectionReceiveWindow, restore = ci.LimitConnectionReceiveWindow(n)
+	}
+	return qp, restore, nil
+}
+
+// computeRate returns the rate in Mbps of a subtest of the given kind, and the
+// name of the measurement it was computed from, using the last measurement.
+// When no rate can be computed, the rate is zero and the name is empty.
+func computeRate(kind spec.SubtestKind, m []model.Measurement) (float64, string) {
+	if len(m) == 0 {
+		return 0, ""
 	}
-	return mbps
+	rate, _, source := m[len(m)-1].Rate(kind)
+	return rate, source
 }
 
-func downRate(m []model.Measurement) float64 {
-	var mbps float64
-	// NOTE: on non-Linux platforms, TCPInfo will be nil.
-	if len(m) > 0 && m[len(m)-1].TCPInfo != nil {
-		// Convert to Mbps.
-		mbps = 8 * float64(m[len(m)-1].TCPInfo.BytesAcked) / float64(m[len(m)-1].TCPInfo.ElapsedTime)
+// datagramThroughput summarizes the throughput of a download sending bulk data
+// in datagrams of the given size, from the last server measurement and the last
+// client measurement containing DatagramInfo.
+func datagramThroughput(data *model.ArchivalData, size int) *model.DatagramThroughput {
+	dt := &model.DatagramThroughput{Size: int64(size)}
+	for i := len(data.ServerMeasurements) - 1; i >= 0; i-- {
+		if info := data.ServerMeasurements[i].DatagramInfo; info != nil {
+			dt.Sent = info.Sent
+			dt.SentMbps = model.Mbps(info.Sent*dt.Size, info.ElapsedTime)
+			break
+		}
 	}
-	return mbps
+	for i := len(data.ClientMeasurements) - 1; i >= 0; i-- {
+		if info := data.ClientMeasurements[i].DatagramInfo; info != nil {
+			dt.Delivered = info.Received
+			dt.DeliveredMbps = model.Mbps(info.Received*dt.Size, info.ElapsedTime)
+			break
+		}
+	}
+	return dt
 }
 
 // excludeKeyRe is a regexp for excluding request parameters from client metadata.
 var excludeKeyRe = regexp.MustCompile("^server_")
 
+// getParams parses the subtest parameters from the query string. Parameters
+// that are not provided take their default value, the number of streams is
+// capped at spec.MaxStreams, the connection receive window is raised to at
+// least spec.MinConnectionReceiveWindow, the datagram rate is capped at
+// spec.MaxDatagramRate and the datagram size is bounded by
+// spec.DatagramHeaderSize and spec.MaxDatagramSize. The bulk parameter selects
+// whether the bulk data is sent on streams or in datagrams, simultaneous
+// whether the subtests of a combined subtest run at the same time, and
+// early_exit whether the subtest ends once its throughput is stable. The
+// timing parameters are parsed by getTimingParams.
+func getParams(values url.Values) (spec.Params, error) {
+	params := spec.Params{Streams: 1}
+	if s := values.Get("streams"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return params, fmt.Errorf("invalid streams value %q", s)
+		}
+		if n > spec.MaxStreams {
+			n = spec.MaxStreams
+		}
+		params.Streams = n
+	}
+	if s := values.Get("max_conn_window"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 1 {
+			return params, fmt.Errorf("invalid max_conn_window value %q", s)
+		}
+		if n < spec.MinConnectionReceiveWindow {
+			n = spec.MinConnectionReceiveWindow
+		}
+		params.MaxConnectionReceiveWindow = n
+	}
+	var err error
+	if params.Simultaneous, err = getBool(values, "simultaneous"); err != nil {
+		return params, err
+	}
+	if params.EarlyExit, err = getBool(values, "early_exit"); err != nil {
+		return params, err
+	}
+	if s := values.Get("datagram_rate"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return params, fmt.Errorf("invalid datagram_rate value %q", s)
+		}
+		if n > spec.MaxDatagramRate {
+			n = spec.MaxDatagramRate
+		}
+		params.DatagramRate = n
+	}
+	if s := values.Get("datagram_size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return params, fmt.Errorf("invalid datagram_size value %q", s)
+		}
+		if n < spec.DatagramHeaderSize {
+			n = spec.DatagramHeaderSize
+		}
+		if n > spec.MaxDatagramSize {
+			n = spec.MaxDatagramSize
+		}
+		params.DatagramSize = n
+	}
+	switch s := values.Get("bulk"); s {
+	case "", "stream":
+	case "datagram":
+		params.BulkDatagrams = true
+	default:
+		return params, fmt.Errorf("invalid bulk value %q", s)
+	}
+	params.Runtime, params.SamplingInterval, err = getTimingParams(values)
+	return params, err
+}
+
+// sessionIDRe matches the identifiers of multi-flow sessions, which are chosen
+// by session.Registry.Create.
+var sessionIDRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// getWebSocketParams is like getParams but for WebSocket subtests, which only
+// support the early_exit, flows, session_id and max_bytes parameters and the
+// timing parameters. The flows parameter is the number of parallel connections
+// of a multi-flow session, at most spec.MaxFlows. The session_id parameter
+// identifies the session joined by the other flows, and is absent for the
+// first one. The byte budget is bounded by spec.MinByteBudget and
+// spec.MaxByteBudget.
+func getWebSocketParams(values url.Values) (spec.Params, error) {
+	var params spec.Params
+	var err error
+	params.Runtime, params.SamplingInterval, err = getTimingParams(values)
+	if err != nil {
+		return params, err
+	}
+	if params.EarlyExit, err = getBool(values, "early_exit"); err != nil {
+		return params, err
+	}
+	if s := values.Get("flows"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > spec.MaxFlows {
+			return params, fmt.Errorf("invalid flows value %q", s)
+		}
+		params.Flows = n
+		params.SessionID = values.Get("session_id")
+		if params.SessionID != "" && !sessionIDRe.MatchString(params.SessionID) {
+			return params, fmt.Errorf("invalid session_id value %q", params.SessionID)
+		}
+	}
+	if s := values.Get("max_bytes"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 1 {
+			return params, fmt.Errorf("invalid max_bytes value %q", s)
+		}
+		if n < spec.MinByteBudget {
+			n = spec.MinByteBudget
+		}
+		if n > spec.MaxByteBudget {
+			n = spec.MaxByteBudget
+		}
+		params.MaxBytes = n
+	}
+	return params, nil
+}
+
+// getBool parses the boolean parameter with the given name, which is false if
+// it is not provided.
+func getBool(values url.Values, name string) (bool, error) {
+	s := values.Get(name)
+	if s == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s value %q", name, s)
+	}
+	return b, nil
+}
+
+// getTimingParams parses the duration_ms and sampling_interval_ms parameters,
+// i.e. the runtime and the average sampling interval requested by the client,
+// in milliseconds. They are zero if they are not provided, and are bounded by
+// spec.Limits.Negotiate.
+func getTimingParams(values url.Values) (runtime, interval time.Duration, err error) {
+	if runtime, err = getMilliseconds(values, "duration_ms"); err != nil {
+		return 0, 0, err
+	}
+	if interval, err = getMilliseconds(values, "sampling_interval_ms"); err != nil {
+		return 0, 0, err
+	}
+	return runtime, interval, nil
+}
+
+// getMilliseconds parses the positive duration parameter with the given name,
+// in milliseconds, which is zero if it is not provided.
+func getMilliseconds(values url.Values, name string) (time.Duration, error) {
+	s := values.Get(name)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s value %q", name, s)
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
+
+// getTiming returns the runtime and the sampling interval negotiated for the
+// subtest with params, in the format of the archival data.
+func getTiming(params spec.Params) *model.Timing {
+	return &model.Timing{
+		Runtime:          int64(params.SubtestRuntime() / time.Microsecond),
+		MaxRuntime:       int64(params.SubtestMaxRuntime() / time.Microsecond),
+		SamplingInterval: int64(params.SubtestSamplingInterval() / time.Microsecond),
+	}
+}
+
 // appendClientMetadata adds |values| to the archival client metadata contained
 // in the request parameter values. Some select key patterns will be excluded.
 func appendClientMetadata(data *model.ArchivalData, values url.Values) {
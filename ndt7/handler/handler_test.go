@@ -0,0 +1,529 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt7/feed"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+func Test_computeRate(t *testing.T) {
+	tests := []struct {
+		name       string
+		kind       spec.SubtestKind
+		m          []model.Measurement
+		wantRate   float64
+		wantSource string
+	}{
+		{
+			name: "no-measurements",
+			kind: spec.SubtestDownload,
+		},
+		{
+			name: "download-tcpinfo",
+			kind: spec.SubtestDownload,
+			m: []model.Measurement{{
+				TCPInfo: &model.TCPInfo{
+					LinuxTCPInfo: tcp.LinuxTCPInfo{BytesAcked: 1000000, BytesReceived: 10},
+					ElapsedTime:  1000000,
+				},
+				AppInfo: &model.AppInfo{NumBytes: 10, ElapsedTime: 1000000},
+			}},
+			wantRate:   8,
+			wantSource: "TCPInfo",
+		},
+		{
+			name: "upload-quicinfo",
+			kind: spec.SubtestUpload,
+			m: []model.Measurement{{
+				QUICInfo: &model.QUICInfo{
+					QUICConnInfo: model.QUICConnInfo{BytesAcked: 10, BytesReceived: 2000000},
+					ElapsedTime:  1000000,
+				},
+				AppInfo: &model.AppInfo{NumBytes: 10, ElapsedTime: 1000000},
+			}},
+			wantRate:   16,
+			wantSource: "QUICInfo",
+		},
+		{
+			name: "appinfo-last-measurement",
+			kind: spec.SubtestUpload,
+			m: []model.Measurement{
+				{AppInfo: &model.AppInfo{NumBytes: 10, ElapsedTime: 1000000}},
+				{AppInfo: &model.AppInfo{NumBytes: 3000000, ElapsedTime: 2000000}},
+			},
+			wantRate:   12,
+			wantSource: "AppInfo",
+		},
+		{
+			name:       "zero-elapsed-time",
+			kind:       spec.SubtestDownload,
+			m:          []model.Measurement{{AppInfo: &model.AppInfo{NumBytes: 10}}},
+			wantSource: "AppInfo",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rate, source := computeRate(tt.kind, tt.m)
+			if rate != tt.wantRate || source != tt.wantSource {
+				t.Errorf("computeRate() = %v, %q, want %v, %q", rate, source, tt.wantRate, tt.wantSource)
+			}
+		})
+	}
+}
+
+func Test_datagramThroughput(t *testing.T) {
+	data := &model.ArchivalData{
+		ServerMeasurements: []model.Measurement{
+			{DatagramInfo: &model.DatagramInfo{Sent: 1000, ElapsedTime: 1000000}},
+			{DatagramInfo: &model.DatagramInfo{Sent: 3000, ElapsedTime: 2000000}},
+			{AppInfo: &model.AppInfo{NumBytes: 10, ElapsedTime: 3000000}},
+		},
+		ClientMeasurements: []model.Measurement{
+			{DatagramInfo: &model.DatagramInfo{Received: 2000, ElapsedTime: 2000000}},
+			{AppInfo: &model.AppInfo{NumBytes: 10, ElapsedTime: 3000000}},
+		},
+	}
+	got := datagramThroughput(data, 1000)
+	want := &model.DatagramThroughput{
+		Size:          1000,
+		Sent:          3000,
+		SentMbps:      12,
+		Delivered:     2000,
+		DeliveredMbps: 8,
+	}
+	if *got != *want {
+		t.Errorf("datagramThroughput() = %+v, want %+v", got, want)
+	}
+	// Without client reports, nothing is known to be delivered.
+	data.ClientMeasurements = nil
+	got = datagramThroughput(data, 1000)
+	if got.Delivered != 0 || got.DeliveredMbps != 0 || got.Sent != 3000 {
+		t.Errorf("datagramThroughput() without client measurements = %+v", got)
+	}
+}
+
+func Test_getParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    spec.Params
+		wantErr bool
+	}{
+		{
+			name:  "default",
+			query: "",
+			want:  spec.Params{Streams: 1},
+		},
+		{
+			name:  "streams",
+			query: "streams=4",
+			want:  spec.Params{Streams: 4},
+		},
+		{
+			name:  "streams-capped",
+			query: "streams=1000",
+			want:  spec.Params{Streams: spec.MaxStreams},
+		},
+		{
+			name:    "streams-zero",
+			query:   "streams=0",
+			wantErr: true,
+		},
+		{
+			name:    "streams-invalid",
+			query:   "streams=x",
+			wantErr: true,
+		},
+		{
+			name:  "max-conn-window",
+			query: "max_conn_window=1048576",
+			want:  spec.Params{Streams: 1, MaxConnectionReceiveWindow: 1 << 20},
+		},
+		{
+			name:  "max-conn-window-raised",
+			query: "max_conn_window=1",
+			want:  spec.Params{Streams: 1, MaxConnectionReceiveWindow: spec.MinConnectionReceiveWindow},
+		},
+		{
+			name:    "max-conn-window-invalid",
+			query:   "max_conn_window=-1",
+			wantErr: true,
+		},
+		{
+			name:  "datagram",
+			query: "datagram_rate=100&datagram_size=500",
+			want:  spec.Params{Streams: 1, DatagramRate: 100, DatagramSize: 500},
+		},
+		{
+			name:  "datagram-bounded",
+			query: "datagram_rate=1000000&datagram_size=1",
+			want: spec.Params{
+				Streams:      1,
+				DatagramRate: spec.MaxDatagramRate,
+				DatagramSize: spec.DatagramHeaderSize,
+			},
+		},
+		{
+			name:  "datagram-size-capped",
+			query: "datagram_size=100000",
+			want:  spec.Params{Streams: 1, DatagramSize: spec.MaxDatagramSize},
+		},
+		{
+			name:    "datagram-rate-zero",
+			query:   "datagram_rate=0",
+			wantErr: true,
+		},
+		{
+			name:    "datagram-size-invalid",
+			query:   "datagram_size=x",
+			wantErr: true,
+		},
+		{
+			name:  "bulk-datagram",
+			query: "bulk=datagram",
+			want:  spec.Params{Streams: 1, BulkDatagrams: true},
+		},
+		{
+			name:  "bulk-stream",
+			query: "bulk=stream",
+			want:  spec.Params{Streams: 1},
+		},
+		{
+			name:  "simultaneous",
+			query: "simultaneous=true",
+			want:  spec.Params{Streams: 1, Simultaneous: true},
+		},
+		{
+			name:    "simultaneous-invalid",
+			query:   "simultaneous=x",
+			wantErr: true,
+		},
+		{
+			name:  "early-exit",
+			query: "early_exit=1",
+			want:  spec.Params{Streams: 1, EarlyExit: true},
+		},
+		{
+			name:    "early-exit-invalid",
+			query:   "early_exit=maybe",
+			wantErr: true,
+		},
+		{
+			name:    "bulk-invalid",
+			query:   "bulk=x",
+			wantErr: true,
+		},
+		{
+			name:  "timing",
+			query: "duration_ms=5000&sampling_interval_ms=500",
+			want:  spec.Params{Streams: 1, Runtime: 5 * time.Second, SamplingInterval: 500 * time.Millisecond},
+		},
+		{
+			name:    "duration-invalid",
+			query:   "duration_ms=0",
+			wantErr: true,
+		},
+		{
+			name:    "sampling-interval-invalid",
+			query:   "sampling_interval_ms=1e3",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, _ := url.ParseQuery(tt.query)
+			got, err := getParams(values)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getParams() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("getParams() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getWebSocketParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    spec.Params
+		wantErr bool
+	}{
+		{
+			name:  "default",
+			query: "",
+		},
+		{
+			// Other parameters are ignored over WebSocket.
+			name:  "early-exit",
+			query: "early_exit=true&streams=x",
+			want:  spec.Params{EarlyExit: true},
+		},
+		{
+			name:    "early-exit-invalid",
+			query:   "early_exit=x",
+			wantErr: true,
+		},
+		{
+			name:  "max-bytes",
+			query: "max_bytes=10000000",
+			want:  spec.Params{MaxBytes: 10000000},
+		},
+		{
+			name:  "max-bytes-raised",
+			query: "max_bytes=1",
+			want:  spec.Params{MaxBytes: spec.MinByteBudget},
+		},
+		{
+			name:  "max-bytes-capped",
+			query: "max_bytes=100000000000",
+			want:  spec.Params{MaxBytes: spec.MaxByteBudget},
+		},
+		{
+			name:    "max-bytes-invalid",
+			query:   "max_bytes=0",
+			wantErr: true,
+		},
+		{
+			name:  "timing",
+			query: "duration_ms=2000&sampling_interval_ms=100",
+			want:  spec.Params{Runtime: 2 * time.Second, SamplingInterval: 100 * time.Millisecond},
+		},
+		{
+			name:    "duration-too-long",
+			query:   "duration_ms=100000000000",
+			wantErr: true,
+		},
+		{
+			name:  "flows-first",
+			query: "flows=4",
+			want:  spec.Params{Flows: 4},
+		},
+		{
+			name:  "flows",
+			query: "flows=4&session_id=0123456789abcdef0123456789abcdef",
+			want:  spec.Params{Flows: 4, SessionID: "0123456789abcdef0123456789abcdef"},
+		},
+		{
+			name:    "flows-too-many",
+			query:   "flows=100",
+			wantErr: true,
+		},
+		{
+			name:    "flows-invalid-session-id",
+			query:   "flows=2&session_id=../x",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, _ := url.ParseQuery(tt.query)
+			got, err := getWebSocketParams(values)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getWebSocketParams() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("getWebSocketParams() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_readQUICRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantURL  string
+		wantRest string
+		wantErr  bool
+	}{
+		{
+			name:     "download",
+			input:    "/ndt/v7/download?streams=2\n{}\n",
+			wantURL:  "/ndt/v7/download?streams=2",
+			wantRest: "{}\n",
+		},
+		{
+			name:    "crlf",
+			input:   "/ndt/v7/upload\r\n",
+			wantURL: "/ndt/v7/upload",
+		},
+		{
+			name:    "no-newline",
+			input:   "/ndt/v7/download",
+			wantErr: true,
+		},
+		{
+			name:    "too-long",
+			input:   "/" + strings.Repeat("a", spec.MaxQUICRequestSize) + "\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid-url",
+			input:   "ndt\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := strings.NewReader(tt.input)
+			got, err := readQUICRequest(r)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("readQUICRequest() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.String() != tt.wantURL {
+				t.Errorf("readQUICRequest() = %q, want %q", got, tt.wantURL)
+			}
+			// The messages following the request line must be left unread.
+			if rest, _ := io.ReadAll(r); string(rest) != tt.wantRest {
+				t.Errorf("readQUICRequest() left %q, want %q", rest, tt.wantRest)
+			}
+		})
+	}
+}
+
+func Test_checkHTTPRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		kind       spec.SubtestKind
+		protoMajor int
+		reqMajor   int
+		method     string
+		wantStatus int
+	}{
+		{
+			name:       "download",
+			kind:       spec.SubtestDownload,
+			protoMajor: 2,
+			reqMajor:   2,
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "upload-post",
+			kind:       spec.SubtestUpload,
+			protoMajor: 3,
+			reqMajor:   3,
+			method:     http.MethodPost,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "upload-put",
+			kind:       spec.SubtestUpload,
+			protoMajor: 2,
+			reqMajor:   2,
+			method:     http.MethodPut,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "download-post",
+			kind:       spec.SubtestDownload,
+			protoMajor: 2,
+			reqMajor:   2,
+			method:     http.MethodPost,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "upload-get",
+			kind:       spec.SubtestUpload,
+			protoMajor: 2,
+			reqMajor:   2,
+			method:     http.MethodGet,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "http1",
+			kind:       spec.SubtestDownload,
+			protoMajor: 2,
+			reqMajor:   1,
+			method:     http.MethodGet,
+			wantStatus: http.StatusHTTPVersionNotSupported,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, spec.HTTPDownloadURLPath, nil)
+			req.ProtoMajor = tt.reqMajor
+			rw := httptest.NewRecorder()
+			ok := checkHTTPRequest(tt.kind, tt.protoMajor, rw, req)
+			if ok != (tt.wantStatus == http.StatusOK) || rw.Code != tt.wantStatus {
+				t.Errorf("checkHTTPRequest() = %v with status %d, want status %d", ok, rw.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHandler_HTTPMeasurements(t *testing.T) {
+	h := Handler{Feeds: feed.NewRegistry()}
+	f, err := h.Feeds.Create()
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	defer f.Close()
+	closed, err := h.Feeds.Create()
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	closed.Close()
+	tests := []struct {
+		name       string
+		h          Handler
+		method     string
+		id         string
+		wantStatus int
+	}{
+		{
+			name:       "post",
+			h:          h,
+			method:     http.MethodPost,
+			id:         f.ID(),
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "unknown",
+			h:          h,
+			method:     http.MethodGet,
+			id:         "a",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "closed",
+			h:          h,
+			method:     http.MethodGet,
+			id:         closed.ID(),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "no-feeds",
+			method:     http.MethodGet,
+			id:         f.ID(),
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, spec.HTTPMeasurementsURLPath+"?id="+tt.id, nil)
+			rw := httptest.NewRecorder()
+			tt.h.HTTPMeasurements(rw, req)
+			if rw.Code != tt.wantStatus {
+				t.Errorf("HTTPMeasurements() status = %d, want %d", rw.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -10,11 +10,19 @@
 package listener
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/lucas-clemente/quic-go"
+	"github.com/m-lab/ndt-server/ndt7/spec"
 	"github.com/m-lab/ndt-server/netx"
 	"github.com/marten-seemann/webtransport-go"
 )
@@ -63,19 +71,216 @@ func serveTLS(server *http.Server, listener net.Listener, certFile, keyFile stri
 	}
 }
 
-// ListenAndServeH3Async starts an https server. The server will run until
-// Shutdown() or Close() is called, but this function will return once the
-// listening socket is established.  This means that when this function
-// returns, the server is immediately available for an https GET to be run
-// against it.
+func serveH3(server *webtransport.Server, conn net.PacketConn) {
+	err := server.Serve(conn)
+	// The server does not close sockets it did not create.
+	conn.Close()
+	if err != quic.ErrServerClosed && err != http.ErrServerClosed {
+		logFatalf("Error, server %v closed with unexpected error %v", server, err)
+	}
+}
+
+// ListenAndServeH3Async starts an HTTP/3 WebTransport server. The server will
+// run until Close() is called, but this function will return once the
+// listening UDP socket is established. This means that when this function
+// returns, the server is immediately available for WebTransport sessions.
 //
 // Returns a non-nil error if the listening socket can't be established. Logs a
-// fatal error if the server dies for a reason besides ErrServerClosed.
+// fatal error if the server dies for a reason besides ErrServerClosed. If the
+// server.H3.Addr is set to :0, then after this function returns server.H3.Addr
+// will contain the address and port which this server is listening on.
 func ListenAndServeH3Async(server *webtransport.Server) error {
-	go server.ListenAndServe()
+	// Start listening synchronously.
+	conn, err := net.ListenPacket("udp", server.H3.Addr)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(server.H3.Addr, ":0") {
+		// Allow :0 to select a random port, like ListenAndServeAsync.
+		server.H3.Addr = conn.LocalAddr().String()
+	}
+	// Serve asynchronously.
+	go serveH3(server, conn)
+	return nil
+}
+
+// QUICServer is a server of raw QUIC connections, i.e. connections that do not
+// use HTTP/3.
+type QUICServer struct {
+	// Addr is the UDP address to listen on.
+	Addr string
+	// TLSConfig is the TLS configuration, which must set NextProtos.
+	TLSConfig *tls.Config
+	// QUICConfig is the QUIC configuration. It may be nil.
+	QUICConfig *quic.Config
+	// Handler is called in its own goroutine for each accepted connection.
+	Handler func(quic.Connection)
+
+	mu       sync.Mutex
+	listener quic.Listener
+}
+
+// Close closes the server and all its active connections.
+func (s *QUICServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+func serveQUIC(server *QUICServer, listener quic.Listener, conn net.PacketConn) {
+	var err error
+	for {
+		var qconn quic.Connection
+		qconn, err = listener.Accept(context.Background())
+		if err != nil {
+			break
+		}
+		go server.Handler(qconn)
+	}
+	// The listener does not close sockets it did not create.
+	conn.Close()
+	if err != quic.ErrServerClosed {
+		logFatalf("Error, server %v closed with unexpected error %v", server, err)
+	}
+}
+
+// ListenAndServeQUICAsync starts a raw QUIC server. The server will run until
+// Close() is called, but this function will return once the listening UDP
+// socket is established. This means that when this function returns, the
+// server is immediately available for QUIC connections.
+//
+// Returns a non-nil error if the listening socket can't be established. Logs a
+// fatal error if the server dies for a reason besides ErrServerClosed. If the
+// server.Addr is set to :0, then after this function returns server.Addr will
+// contain the address and port which this server is listening on.
+func ListenAndServeQUICAsync(server *QUICServer) error {
+	// Start listening synchronously.
+	conn, err := net.ListenPacket("udp", server.Addr)
+	if err != nil {
+		return err
+	}
+	listener, err := quic.Listen(conn, server.TLSConfig, server.QUICConfig)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if strings.HasSuffix(server.Addr, ":0") {
+		// Allow :0 to select a random port, like ListenAndServeAsync.
+		server.Addr = conn.LocalAddr().String()
+	}
+	server.mu.Lock()
+	server.listener = listener
+	server.mu.Unlock()
+	// Serve asynchronously.
+	go serveQUIC(server, listener, conn)
 	return nil
 }
 
+// Drainer is an http.Handler middleware that keeps track of in-flight
+// requests, so that servers lacking a graceful Shutdown, like the
+// webtransport.Server and the QUICServer, can let them complete before being
+// closed. Since ndtQUIC requests last for the whole subtest, this drains the
+// sessions too.
+type Drainer struct {
+	mu       sync.Mutex
+	inflight int
+	draining bool
+	// idle is closed when draining and no requests are in flight.
+	idle chan struct{}
+}
+
+// Then wraps next, rejecting new requests with 503 Service Unavailable once
+// Shutdown has been called.
+func (d *Drainer) Then(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !d.enter() {
+			rw.Header().Set("Connection", "Close")
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer d.exit()
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// ThenQUIC is like Then but for the handlers of raw QUIC connections. New
+// connections are closed with spec.QUICErrorUnavailable once Shutdown has been
+// called.
+func (d *Drainer) ThenQUIC(next func(quic.Connection)) func(quic.Connection) {
+	return func(conn quic.Connection) {
+		if !d.enter() {
+			conn.CloseWithError(spec.QUICErrorUnavailable, "server is shutting down")
+			return
+		}
+		defer d.exit()
+		next(conn)
+	}
+}
+
+func (d *Drainer) enter() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.inflight++
+	return true
+}
+
+func (d *Drainer) exit() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inflight--
+	if d.draining && d.inflight == 0 {
+		close(d.idle)
+	}
+}
+
+// Shutdown stops accepting new requests, waits until all in-flight requests
+// complete or ctx expires, and then closes server. Shutdown must be called at
+// most once. Returns the error returned by server.Close().
+func (d *Drainer) Shutdown(ctx context.Context, server io.Closer) error {
+	d.mu.Lock()
+	d.draining = true
+	d.idle = make(chan struct{})
+	if d.inflight == 0 {
+		close(d.idle)
+	}
+	d.mu.Unlock()
+	select {
+	case <-d.idle:
+	case <-ctx.Done():
+		log.Printf("Drainer: closing server with in-flight requests: %v", ctx.Err())
+	}
+	return server.Close()
+}
+
+// AltSvcMaxAge is how long clients may remember the HTTP/3 server advertised by
+// AltSvc.
+const AltSvcMaxAge = 24 * time.Hour
+
+// AltSvc is an http.Handler middleware advertising the HTTP/3 server listening
+// on the UDP port of h3Addr to the clients of a TLS server, using the Alt-Svc
+// header (RFC 7838), in the responses to requests for the given paths only.
+// The HTTP/3 server must serve these paths like the TLS server, with the same
+// access control, since clients may send their next requests to it. Returns an
+// error if h3Addr has no port.
+func AltSvc(h3Addr string, paths map[string]bool, next http.Handler) (http.Handler, error) {
+	_, port, err := net.SplitHostPort(h3Addr)
+	if err != nil {
+		return nil, err
+	}
+	value := fmt.Sprintf(`h3=":%s"; ma=%d`, port, int64(AltSvcMaxAge/time.Second))
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if paths[req.URL.Path] {
+			rw.Header().Set("Alt-Svc", value)
+		}
+		next.ServeHTTP(rw, req)
+	}), nil
+}
 
 // ListenAndServeTLSAsync starts an https server. The server will run until
 // Shutdown() or Close() is called, but this function will return once the
@@ -0,0 +1,206 @@
+package listener
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/marten-seemann/webtransport-go"
+)
+
+func TestListenAndServeH3Async(t *testing.T) {
+	fatal := make(chan string, 1)
+	logFatalf = func(format string, args ...interface{}) {
+		fatal <- format
+	}
+	defer func() { logFatalf = nil }()
+
+	// Without a TLS config, the server fails right after the socket is bound.
+	srv := &webtransport.Server{H3: http3.Server{Addr: "127.0.0.1:0"}}
+	if err := ListenAndServeH3Async(srv); err != nil {
+		t.Fatalf("ListenAndServeH3Async() unexpected error = %v", err)
+	}
+	if strings.HasSuffix(srv.H3.Addr, ":0") {
+		t.Errorf("ListenAndServeH3Async() did not resolve the port: %q", srv.H3.Addr)
+	}
+	select {
+	case <-fatal:
+	case <-time.After(5 * time.Second):
+		t.Errorf("ListenAndServeH3Async() did not log a fatal error")
+	}
+
+	// Binding an address that is already in use must fail synchronously.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	srv = &webtransport.Server{H3: http3.Server{Addr: conn.LocalAddr().String()}}
+	if err := ListenAndServeH3Async(srv); err == nil {
+		t.Errorf("ListenAndServeH3Async() with address in use: expected error")
+	}
+}
+
+func TestListenAndServeQUICAsync(t *testing.T) {
+	fatal := make(chan string, 1)
+	logFatalf = func(format string, args ...interface{}) {
+		fatal <- format
+	}
+	defer func() { logFatalf = nil }()
+
+	// Closing the server must not log a fatal error.
+	srv := &QUICServer{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: &tls.Config{NextProtos: []string{"test"}},
+		Handler:   func(quic.Connection) {},
+	}
+	if err := ListenAndServeQUICAsync(srv); err != nil {
+		t.Fatalf("ListenAndServeQUICAsync() unexpected error = %v", err)
+	}
+	if strings.HasSuffix(srv.Addr, ":0") {
+		t.Errorf("ListenAndServeQUICAsync() did not resolve the port: %q", srv.Addr)
+	}
+	if err := srv.Close(); err != nil {
+		t.Errorf("QUICServer.Close() unexpected error = %v", err)
+	}
+	select {
+	case <-fatal:
+		t.Errorf("ListenAndServeQUICAsync() logged a fatal error after Close")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Without a TLS config, the server fails synchronously.
+	srv = &QUICServer{Addr: "127.0.0.1:0"}
+	if err := ListenAndServeQUICAsync(srv); err == nil {
+		t.Errorf("ListenAndServeQUICAsync() without TLS config: expected error")
+	}
+}
+
+type fakeCloser struct {
+	closed bool
+}
+
+func (c *fakeCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestDrainer(t *testing.T) {
+	d := &Drainer{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := d.Then(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	// Start a request and wait for it to be in flight.
+	inflight := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(inflight, httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	<-started
+
+	c := &fakeCloser{}
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- d.Shutdown(context.Background(), c)
+	}()
+
+	// New requests are rejected while draining.
+	noop := d.Then(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	for {
+		rw := httptest.NewRecorder()
+		noop.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rw.Code == http.StatusServiceUnavailable {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-shutdown:
+		t.Fatalf("Shutdown() returned with requests in flight")
+	default:
+	}
+
+	// The server is closed once the in-flight request completes.
+	close(release)
+	<-done
+	if err := <-shutdown; err != nil || !c.closed {
+		t.Errorf("Shutdown() = %v, closed = %v; want nil, true", err, c.closed)
+	}
+}
+
+func TestDrainer_Timeout(t *testing.T) {
+	d := &Drainer{}
+	if !d.enter() {
+		t.Fatalf("enter() = false, want true")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c := &fakeCloser{}
+	if err := d.Shutdown(ctx, c); err != nil || !c.closed {
+		t.Errorf("Shutdown() = %v, closed = %v; want nil, true", err, c.closed)
+	}
+}
+
+func TestAltSvc(t *testing.T) {
+	tests := []struct {
+		name    string
+		h3Addr  string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "any-address",
+			h3Addr: ":4443",
+			path:   "/shared",
+			want:   `h3=":4443"; ma=86400`,
+		},
+		{
+			name:   "ipv6-address",
+			h3Addr: "[::1]:443",
+			path:   "/shared",
+			want:   `h3=":443"; ma=86400`,
+		},
+		{
+			name:   "other-path",
+			h3Addr: ":4443",
+			path:   "/other",
+		},
+		{
+			name:    "no-port",
+			h3Addr:  "localhost",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			h, err := AltSvc(tt.h3Addr, map[string]bool{"/shared": true}, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				called = true
+			}))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AltSvc() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if got := rw.Header().Get("Alt-Svc"); got != tt.want || !called {
+				t.Errorf("AltSvc() header = %q, called = %v; want %q, true", got, called, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package measurer
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt7/model"
+)
+
+// DatagramCounter computes the statistics of the datagrams sent and received
+// during the datagram subtest. Each measurement contains a snapshot of the
+// statistics, and starts a new measurement interval.
+type DatagramCounter struct {
+	// sent must be accessed atomically.
+	sent  int64
+	start time.Time
+
+	mu        sync.Mutex
+	received  int64
+	reordered int64
+	// next is the highest received sequence number plus one.
+	next uint64
+	// minTransit and lastTransit are the minimum and the last difference
+	// between the receive time and the timestamp of the datagrams, which is
+	// the one-way delay plus the unknown offset between the clocks of the
+	// endpoints.
+	minTransit  time.Duration
+	lastTransit time.Duration
+	// jitter is the RFC 3550 interarrival jitter, in nanoseconds.
+	jitter float64
+	// Statistics of the current interval.
+	count        int64
+	sumVariation time.Duration
+	maxVariation time.Duration
+}
+
+// NewDatagramCounter returns a new counter for the datagrams of the subtest.
+// The timestamps of the sent datagrams must be relative to the returned
+// counter's Start. Each measurement contains the statistics of the counter.
+func (m *WebTransportMeasurer) NewDatagramCounter() *DatagramCounter {
+	c := &DatagramCounter{start: time.Now()}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.datagrams = c
+	return c
+}
+
+// Start returns the time from which the timestamps of the sent datagrams are
+// measured.
+func (c *DatagramCounter) Start() time.Time {
+	return c.start
+}
+
+// AddSent counts a sent datagram.
+func (c *DatagramCounter) AddSent() {
+	atomic.AddInt64(&c.sent, 1)
+}
+
+// AddReceived counts a datagram with the given header, received at t.
+func (c *DatagramCounter) AddReceived(h model.DatagramHeader, t time.Time) {
+	transit := t.Sub(c.start) - time.Duration(h.Timestamp)*time.Microsecond
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.received == 0 || transit < c.minTransit {
+		c.minTransit = transit
+	}
+	if c.received > 0 {
+		d := math.Abs(float64(transit - c.lastTransit))
+		c.jitter += (d - c.jitter) / 16
+	}
+	c.lastTransit = transit
+	c.received++
+	if h.Seq < c.next {
+		c.reordered++
+	} else {
+		c.next = h.Seq + 1
+	}
+	variation := transit - c.minTransit
+	c.count++
+	c.sumVariation += variation
+	if variation > c.maxVariation {
+		c.maxVariation = variation
+	}
+}
+
+// info returns a snapshot of the statistics and starts a new interval.
+func (c *DatagramCounter) info(elapsed time.Duration) *model.DatagramInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := &model.DatagramInfo{
+		Sent:              atomic.LoadInt64(&c.sent),
+		Received:          c.received,
+		Lost:              int64(c.next) - c.received,
+		Reordered:         c.reordered,
+		MaxDelayVariation: int64(c.maxVariation / time.Microsecond),
+		Jitter:            int64(c.jitter) / int64(time.Microsecond),
+		ElapsedTime:       int64(elapsed / time.Microsecond),
+	}
+	if info.Lost < 0 {
+		// Only possible with duplicate or bogus sequence numbers.
+		info.Lost = 0
+	}
+	if c.count > 0 {
+		info.MeanDelayVariation = int64(c.sumVariation/time.Duration(c.count)) / int64(time.Microsecond)
+	}
+	c.count, c.sumVariation, c.maxVariation = 0, 0, 0
+	return info
+}
@@ -0,0 +1,53 @@
+package measurer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt7/model"
+)
+
+func TestDatagramCounter(t *testing.T) {
+	m := NewWebTransport(nil, "uuid")
+	c := m.NewDatagramCounter()
+	// receive counts a datagram sent by the peer at sent, and received
+	// after the given one-way delay, in milliseconds. The clock of the peer
+	// is 1s ahead.
+	receive := func(seq uint64, sent, delay int64) {
+		h := model.DatagramHeader{Seq: seq, Timestamp: (1000 + sent) * 1000}
+		c.AddReceived(h, c.Start().Add(time.Duration(sent+delay)*time.Millisecond))
+	}
+	c.AddSent()
+	c.AddSent()
+	receive(0, 0, 10)
+	receive(1, 20, 10)
+	receive(3, 60, 26) // Datagram 2 is delayed.
+	receive(2, 40, 50)
+	got := m.datagramInfo(time.Second)
+	want := &model.DatagramInfo{
+		Sent:      2,
+		Received:  4,
+		Reordered: 1,
+		// The delay variations are 0, 0, 16 and 40 ms.
+		MeanDelayVariation: 14000,
+		MaxDelayVariation:  40000,
+		// The jitter is updated with D = 0, 16 and 24 ms.
+		Jitter:      2437,
+		ElapsedTime: 1000000,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("datagramInfo() = %+v, want %+v", got, want)
+	}
+
+	// The delay statistics only cover the current interval.
+	receive(6, 120, 30)
+	got = m.datagramInfo(2 * time.Second)
+	if got.Received != 5 || got.Lost != 2 || got.MeanDelayVariation != 20000 || got.MaxDelayVariation != 20000 {
+		t.Errorf("datagramInfo() = %+v, want 5 received, 2 lost, 20 ms delay variation", got)
+	}
+	got = m.datagramInfo(3 * time.Second)
+	if got.MeanDelayVariation != 0 || got.MaxDelayVariation != 0 || got.Jitter == 0 {
+		t.Errorf("datagramInfo() without datagrams = %+v", got)
+	}
+}
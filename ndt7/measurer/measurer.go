@@ -4,6 +4,8 @@ package measurer
 
 import (
 	"context"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -27,23 +29,52 @@ var (
 	)
 )
 
+// Sampler is the interface implemented by Measurer and WebTransportMeasurer,
+// which allows subtests to run over both TCP and QUIC connections.
+type Sampler interface {
+	AddBytes(n int64)
+	Start(ctx context.Context, timeout, interval time.Duration) <-chan model.Measurement
+	Stop(src <-chan model.Measurement)
+}
+
 // Measurer performs measurements
 type Measurer struct {
-	conn   *websocket.Conn
-	uuid   string
-	ticker *memoryless.Ticker
+	// numBytes is the number of application-level bytes sent or received
+	// during the subtest. It must be accessed atomically. It is the first
+	// field to guarantee its 64-bit alignment.
+	numBytes int64
+	conn     net.Conn
+	uuid     string
+	// cancel stops the measurement loop. It is set by Start.
+	cancel context.CancelFunc
 }
 
 // New creates a new measurer instance
 func New(conn *websocket.Conn, UUID string) *Measurer {
+	return NewConn(conn.UnderlyingConn(), UUID)
+}
+
+// NewConn is like New but for the TCP connection underlying a subtest that
+// does not use WebSocket, e.g. an HTTP/2 request.
+func NewConn(conn net.Conn, UUID string) *Measurer {
 	return &Measurer{
 		conn: conn,
 		uuid: UUID,
 	}
 }
 
-func (m *Measurer) getSocketAndPossiblyEnableBBR() (netx.ConnInfo, error) {
-	ci := netx.ToConnInfo(m.conn.UnderlyingConn())
+// AddBytes adds n to the number of application-level bytes sent or received
+// during the subtest. It is safe to call AddBytes concurrently with the
+// measurement loop.
+func (m *Measurer) AddBytes(n int64) {
+	atomic.AddInt64(&m.numBytes, n)
+}
+
+// EnableBBR enables BBR on the TCP connection underlying conn, if possible,
+// and counts the attempt in BBREnabled. Callers enable BBR once per
+// connection, before starting the measurers sampling it.
+func EnableBBR(conn net.Conn) {
+	ci := netx.ToConnInfo(conn)
 	err := ci.EnableBBR()
 	success := "true"
 	errstr := ""
@@ -55,7 +86,6 @@ func (m *Measurer) getSocketAndPossiblyEnableBBR() (netx.ConnInfo, error) {
 		// FALLTHROUGH
 	}
 	BBREnabled.WithLabelValues(success, errstr).Inc()
-	return ci, nil
 }
 
 func measure(measurement *model.Measurement, ci netx.ConnInfo, elapsed time.Duration) {
@@ -75,17 +105,21 @@ func measure(measurement *model.Measurement, ci netx.ConnInfo, elapsed time.Dura
 	}
 }
 
-func (m *Measurer) loop(ctx context.Context, timeout time.Duration, dst chan<- model.Measurement) {
+// appInfo returns a snapshot of the application-level byte counter.
+func appInfo(numBytes *int64, elapsed time.Duration) *model.AppInfo {
+	return &model.AppInfo{
+		NumBytes:    atomic.LoadInt64(numBytes),
+		ElapsedTime: int64(elapsed / time.Microsecond),
+	}
+}
+
+func (m *Measurer) loop(ctx context.Context, timeout, interval time.Duration, dst chan<- model.Measurement) {
 	logging.Logger.Debug("measurer: start")
 	defer logging.Logger.Debug("measurer: stop")
 	defer close(dst)
 	measurerctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	ci, err := m.getSocketAndPossiblyEnableBBR()
-	if err != nil {
-		logging.Logger.WithError(err).Warn("getSocketAndPossiblyEnableBBR failed")
-		return
-	}
+	ci := netx.ToConnInfo(m.conn)
 	start := time.Now()
 	connectionInfo := &model.ConnectionInfo{
 		Client: m.conn.RemoteAddr().String(),
@@ -94,19 +128,21 @@ func (m *Measurer) loop(ctx context.Context, timeout time.Duration, dst chan<- m
 	}
 	// Implementation note: the ticker will close its output channel
 	// after the controlling context is expired.
+	min, max := spec.PoissonSamplingBounds(interval)
 	ticker, err := memoryless.NewTicker(measurerctx, memoryless.Config{
-		Min:      spec.MinPoissonSamplingInterval,
-		Expected: spec.AveragePoissonSamplingInterval,
-		Max:      spec.MaxPoissonSamplingInterval,
+		Min:      min,
+		Expected: interval,
+		Max:      max,
 	})
 	if err != nil {
 		logging.Logger.WithError(err).Warn("memoryless.NewTicker failed")
 		return
 	}
-	m.ticker = ticker
 	for now := range ticker.C {
 		var measurement model.Measurement
-		measure(&measurement, ci, now.Sub(start))
+		elapsed := now.Sub(start)
+		measure(&measurement, ci, elapsed)
+		measurement.AppInfo = appInfo(&m.numBytes, elapsed)
 		measurement.ConnectionInfo = connectionInfo
 		dst <- measurement // Liveness: this is blocking
 	}
@@ -115,13 +151,17 @@ func (m *Measurer) loop(ctx context.Context, timeout time.Duration, dst chan<- m
 // Start runs the measurement loop in a background goroutine and emits
 // the measurements on the returned channel.
 //
+// Measurements are taken at random intervals of the given average, following
+// a Poisson process bounded by spec.PoissonSamplingBounds.
+//
 // Liveness guarantee: the measurer will always terminate after
 // the given timeout, provided that the consumer continues reading from the
 // returned channel. Measurer may be stopped early by canceling ctx, or by
 // calling Stop.
-func (m *Measurer) Start(ctx context.Context, timeout time.Duration) <-chan model.Measurement {
+func (m *Measurer) Start(ctx context.Context, timeout, interval time.Duration) <-chan model.Measurement {
 	dst := make(chan model.Measurement)
-	go m.loop(ctx, timeout, dst)
+	ctx, m.cancel = context.WithCancel(ctx)
+	go m.loop(ctx, timeout, interval, dst)
 	return dst
 }
 
@@ -129,8 +169,8 @@ func (m *Measurer) Start(ctx context.Context, timeout time.Duration) <-chan mode
 // guarantees that the measurement goroutine completes by draining the
 // measurement channel. Users that call Start should also call Stop.
 func (m *Measurer) Stop(src <-chan model.Measurement) {
-	if m.ticker != nil {
-		m.ticker.Stop()
+	if m.cancel != nil {
+		m.cancel()
 	}
 	for range src {
 		// make sure we drain the channel, so the measurement loop can exit.
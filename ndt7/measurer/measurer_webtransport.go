@@ -4,96 +4,139 @@ package measurer
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/marten-seemann/webtransport-go"
-
 	"github.com/m-lab/go/memoryless"
 	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/ndt7/model"
 	"github.com/m-lab/ndt-server/ndt7/spec"
-	"github.com/m-lab/ndt-server/netx"
-	"github.com/m-lab/tcp-info/inetdiag"
-	"github.com/m-lab/tcp-info/tcp"
+	"github.com/m-lab/ndt-server/quicx"
 )
 
-// Currently used as the underlying libs (i.e. webtransport-go) don't
-// export the required facilities such as getting the connection's UUID or
-// setting the congestion control
-type WebTransportMockConnInfo struct {
-
+// Measurer performs measurements
+type WebTransportMeasurer struct {
+	// numBytes is the number of application-level bytes sent or received
+	// during the subtest. It must be accessed atomically.
+	numBytes int64
+	sess     quicx.Session
+	uuid     string
+	// cancel stops the measurement loop. It is set by Start.
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	streams   []*StreamCounter
+	datagrams *DatagramCounter
 }
 
+// StreamCounter counts the application-level bytes sent or received on one of
+// the bulk streams of the subtest.
+type StreamCounter struct {
+	// numBytes must be accessed atomically.
+	numBytes int64
+	index    int64
+	m        *WebTransportMeasurer
+}
 
-func (*WebTransportMockConnInfo) GetUUID() (string, error) {
-	return "mockUUID", nil
+// AddBytes adds n to the number of bytes of the stream and of the subtest.
+func (c *StreamCounter) AddBytes(n int64) {
+	atomic.AddInt64(&c.numBytes, n)
+	c.m.AddBytes(n)
 }
 
-func (*WebTransportMockConnInfo) EnableBBR() error {
-	return nil
+// New creates a new measurer instance
+func NewWebTransport(sess quicx.Session, UUID string) *WebTransportMeasurer {
+	return &WebTransportMeasurer{
+		sess: sess,
+		uuid: UUID,
+	}
 }
 
-func (*WebTransportMockConnInfo) ReadInfo() (inetdiag.BBRInfo, tcp.LinuxTCPInfo, error) {
-	return inetdiag.BBRInfo{}, tcp.LinuxTCPInfo{}, nil
+// AddBytes adds n to the number of application-level bytes sent or received
+// during the subtest.
+func (m *WebTransportMeasurer) AddBytes(n int64) {
+	atomic.AddInt64(&m.numBytes, n)
 }
 
-// Measurer performs measurements
-type WebTransportMeasurer struct {
-	sess   *webtransport.Session
-	uuid   string
-	BytesReceived uint64
-	ticker *memoryless.Ticker
+// NewStreamCounter returns a new counter for the next bulk stream. Each
+// measurement contains the number of bytes counted for every stream.
+func (m *WebTransportMeasurer) NewStreamCounter() *StreamCounter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := &StreamCounter{index: int64(len(m.streams)), m: m}
+	m.streams = append(m.streams, c)
+	return c
 }
 
-// New creates a new measurer instance
-func NewWebTransport(sess *webtransport.Session, UUID string) *WebTransportMeasurer {
-	return &WebTransportMeasurer{
-		sess: sess,
-		uuid: UUID,
+// streamInfo returns a snapshot of the stream counters.
+func (m *WebTransportMeasurer) streamInfo(elapsed time.Duration) []model.StreamInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var info []model.StreamInfo
+	for _, c := range m.streams {
+		info = append(info, model.StreamInfo{
+			Index:       c.index,
+			NumBytes:    atomic.LoadInt64(&c.numBytes),
+			ElapsedTime: int64(elapsed / time.Microsecond),
+		})
 	}
+	return info
 }
 
-func (m *WebTransportMeasurer) getSocketAndPossiblyEnableBBR() (netx.ConnInfo, error) {
-	// ci := netx.ToConnInfo(m.conn.UnderlyingConn())
-
-	// TODO: try to eable BBR
-	// err := ci.EnableBBR()
-	// success := "true"
-	// errstr := ""
-	// if err != nil {
-		success := "false"
-		errstr := "cannot specify the CC yet"
-		// uuid := "NDTQUIC" // to log error with uuid.
-		// logging.Logger.WithError(err).Warn("Cannot enable BBR: " + uuid)
-		// FALLTHROUGH
-	// }
-
-	BBREnabled.WithLabelValues(success, errstr).Inc()
-	return &WebTransportMockConnInfo{}, nil
+// datagramInfo returns a snapshot of the datagram counter, if any.
+func (m *WebTransportMeasurer) datagramInfo(elapsed time.Duration) *model.DatagramInfo {
+	m.mu.Lock()
+	c := m.datagrams
+	m.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+	return c.info(elapsed)
 }
 
-func measureWebTransport(measurement *model.Measurement, ci netx.ConnInfo, elapsed time.Duration) {
-	// Implementation note: we always want to sample BBR before TCPInfo so we
-	// will know from TCPInfo if the connection has been closed.
-	// TODO: BBRInfo and QUICInfo
+func measureWebTransport(measurement *model.Measurement, ci quicx.ConnInfo, base model.QUICConnInfo, elapsed time.Duration) {
 	t := int64(elapsed / time.Microsecond)
-	// bbrinfo, tcpInfo, err := ci.ReadInfo()
-	measurement.QUICInfo = &model.QUICInfo{
-		ElapsedTime:  t,
-		// QUICStreamBytesReceived: ,
+	info, err := ci.ReadInfo()
+	if err == nil {
+		measurement.QUICInfo = &model.QUICInfo{
+			QUICConnInfo: countersSince(info, base),
+			ElapsedTime:  t,
+		}
 	}
 }
 
-func (m *WebTransportMeasurer) loop(ctx context.Context, timeout time.Duration, dst chan<- model.Measurement) {
-	
+// countersSince returns info with its packet and byte counters counted since
+// base was read, since the connection may have carried other subtests before.
+func countersSince(info, base model.QUICConnInfo) model.QUICConnInfo {
+	info.PacketsSent -= base.PacketsSent
+	info.PacketsReceived -= base.PacketsReceived
+	info.PacketsLost -= base.PacketsLost
+	info.BytesSent -= base.BytesSent
+	info.BytesReceived -= base.BytesReceived
+	info.BytesAcked -= base.BytesAcked
+	info.BytesLost -= base.BytesLost
+	return info
+}
+
+func (m *WebTransportMeasurer) loop(ctx context.Context, timeout, interval time.Duration, dst chan<- model.Measurement) {
 	logging.Logger.Debug("measurer: start")
 	defer logging.Logger.Debug("measurer: stop")
 	defer close(dst)
 	measurerctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	ci, err := m.getSocketAndPossiblyEnableBBR()
+	// NOTE: quic-go does not allow choosing the congestion control, so unlike
+	// Measurer we do not attempt to enable BBR here.
+	ci, err := quicx.ToConnInfo(m.sess.Context())
 	if err != nil {
-		logging.Logger.WithError(err).Warn("getSocketAndPossiblyEnableBBR failed")
+		logging.Logger.WithError(err).Warn("quicx.ToConnInfo failed")
+		return
+	}
+	// The QUICInfo counters are reported relative to the start of the
+	// measurements, like the ElapsedTime they are divided by.
+	base, err := ci.ReadInfo()
+	if err != nil {
+		logging.Logger.WithError(err).Warn("conninfo.ReadInfo failed")
 		return
 	}
 	start := time.Now()
@@ -104,19 +147,23 @@ func (m *WebTransportMeasurer) loop(ctx context.Context, timeout time.Duration,
 	}
 	// Implementation note: the ticker will close its output channel
 	// after the controlling context is expired.
+	min, max := spec.PoissonSamplingBounds(interval)
 	ticker, err := memoryless.NewTicker(measurerctx, memoryless.Config{
-		Min:      spec.MinPoissonSamplingInterval,
-		Expected: spec.AveragePoissonSamplingInterval,
-		Max:      spec.MaxPoissonSamplingInterval,
+		Min:      min,
+		Expected: interval,
+		Max:      max,
 	})
 	if err != nil {
 		logging.Logger.WithError(err).Warn("memoryless.NewTicker failed")
 		return
 	}
-	m.ticker = ticker
 	for now := range ticker.C {
 		var measurement model.Measurement
-		measure(&measurement, ci, now.Sub(start))
+		elapsed := now.Sub(start)
+		measureWebTransport(&measurement, ci, base, elapsed)
+		measurement.AppInfo = appInfo(&m.numBytes, elapsed)
+		measurement.StreamInfo = m.streamInfo(elapsed)
+		measurement.DatagramInfo = m.datagramInfo(elapsed)
 		measurement.ConnectionInfo = connectionInfo
 		dst <- measurement // Liveness: this is blocking
 	}
@@ -125,13 +172,17 @@ func (m *WebTransportMeasurer) loop(ctx context.Context, timeout time.Duration,
 // Start runs the measurement loop in a background goroutine and emits
 // the measurements on the returned channel.
 //
+// Measurements are taken at random intervals of the given average, following
+// a Poisson process bounded by spec.PoissonSamplingBounds.
+//
 // Liveness guarantee: the measurer will always terminate after
 // the given timeout, provided that the consumer continues reading from the
 // returned channel. Measurer may be stopped early by canceling ctx, or by
 // calling Stop.
-func (m *WebTransportMeasurer) Start(ctx context.Context, timeout time.Duration) <-chan model.Measurement {
+func (m *WebTransportMeasurer) Start(ctx context.Context, timeout, interval time.Duration) <-chan model.Measurement {
 	dst := make(chan model.Measurement)
-	go m.loop(ctx, timeout, dst)
+	ctx, m.cancel = context.WithCancel(ctx)
+	go m.loop(ctx, timeout, interval, dst)
 	return dst
 }
 
@@ -139,12 +190,10 @@ func (m *WebTransportMeasurer) Start(ctx context.Context, timeout time.Duration)
 // guarantees that the measurement goroutine completes by draining the
 // measurement channel. Users that call Start should also call Stop.
 func (m *WebTransportMeasurer) Stop(src <-chan model.Measurement) {
-	if m.ticker != nil {
-		m.ticker.Stop()
+	if m.cancel != nil {
+		m.cancel()
 	}
 	for range src {
 		// make sure we drain the channel, so the measurement loop can exit.
 	}
 }
-
-
@@ -0,0 +1,43 @@
+package measurer
+
+import (
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt7/model"
+)
+
+func TestCountersSince(t *testing.T) {
+	base := model.QUICConnInfo{
+		SmoothedRTT:     10000,
+		PacketsSent:     100,
+		PacketsReceived: 50,
+		PacketsLost:     1,
+		BytesSent:       100000,
+		BytesReceived:   5000,
+		BytesAcked:      90000,
+		BytesLost:       1000,
+	}
+	info := model.QUICConnInfo{
+		SmoothedRTT:     20000,
+		PacketsSent:     300,
+		PacketsReceived: 150,
+		PacketsLost:     3,
+		BytesSent:       300000,
+		BytesReceived:   15000,
+		BytesAcked:      280000,
+		BytesLost:       3000,
+	}
+	want := model.QUICConnInfo{
+		SmoothedRTT:     20000,
+		PacketsSent:     200,
+		PacketsReceived: 100,
+		PacketsLost:     2,
+		BytesSent:       200000,
+		BytesReceived:   10000,
+		BytesAcked:      190000,
+		BytesLost:       2000,
+	}
+	if got := countersSince(info, base); got != want {
+		t.Errorf("countersSince() = %+v, want %+v", got, want)
+	}
+}
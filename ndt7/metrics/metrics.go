@@ -1,9 +1,11 @@
 package metrics
 
 import (
+	"net/http"
 	"strings"
 
 	"github.com/gorilla/websocket"
+	"github.com/m-lab/ndt-server/quicx"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -24,6 +26,13 @@ var (
 		},
 		[]string{"protocol", "direction", "result"},
 	)
+	ClientTestRateSources = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt7_client_test_rate_sources_total",
+			Help: "Number of test rates by the measurement they were computed from.",
+		},
+		[]string{"protocol", "direction", "source"},
+	)
 	ClientSenderErrors = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ndt7_client_sender_errors_total",
@@ -40,6 +49,23 @@ var (
 	)
 )
 
+// SessionLabel returns the label for the protocol of an ndtQUIC session.
+func SessionLabel(sess quicx.Session) string {
+	return "ndt+" + sess.Protocol()
+}
+
+// HTTPLabel returns the label for the protocol of an ndt7 subtest over plain
+// HTTP streams, i.e. HTTP/2 or HTTP/3.
+func HTTPLabel(req *http.Request) string {
+	switch req.ProtoMajor {
+	case 2:
+		return "ndt7+h2"
+	case 3:
+		return "ndt7+h3"
+	}
+	return "ndt7+http"
+}
+
 // ConnLabel infers an appropriate label for the websocket protocol.
 func ConnLabel(conn *websocket.Conn) string {
 	// NOTE: this isn't perfect, but it is simple and a) works for production deployments,
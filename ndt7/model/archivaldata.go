@@ -15,8 +15,47 @@ type ArchivalData struct {
 	EndTime            time.Time
 	ServerMeasurements []Measurement
 	ClientMeasurements []Measurement
-	ClientMetadata     []metadata.NameValue `json:",omitempty"`
-	ServerMetadata     []metadata.NameValue `json:",omitempty"`
+	// Protocol is the protocol of the subtest, named like in the protocol
+	// label of the ndt7 metrics, e.g. ndt7+wss or ndt7+h2.
+	Protocol string `json:",omitempty"`
+	// MeanThroughputMbps is the throughput computed by the server from the
+	// last server measurement. ThroughputSource is the name of the
+	// measurement it was computed from, i.e. TCPInfo, QUICInfo or AppInfo.
+	MeanThroughputMbps float64 `json:",omitempty"`
+	ThroughputSource   string  `json:",omitempty"`
+	// AppRTTSamples contains the application-level RTT samples measured by
+	// the server using ping messages.
+	AppRTTSamples []RTTSample `json:",omitempty"`
+	// QUICParams contains the QUIC parameters in effect during ndtQUIC
+	// subtests.
+	QUICParams *QUICParams `json:",omitempty"`
+	// DatagramThroughput summarizes the throughput of ndtQUIC downloads
+	// sending bulk data in datagrams.
+	DatagramThroughput *DatagramThroughput `json:",omitempty"`
+	// EndReason is the reason why the subtest ended without error, i.e.
+	// "runtime", "stable" or "max-bytes".
+	EndReason string `json:",omitempty"`
+	// EarlyExit contains the criterion used to end the subtest once its
+	// throughput is stable, if the client requested it.
+	EarlyExit *EarlyExit `json:",omitempty"`
+	// ByteBudget contains the byte budget of the subtest and the bytes used,
+	// if the client requested a budget.
+	ByteBudget *ByteBudget `json:",omitempty"`
+	// Timing contains the runtime and the sampling interval negotiated with
+	// the client.
+	Timing         *Timing              `json:",omitempty"`
+	ClientMetadata []metadata.NameValue `json:",omitempty"`
+	ServerMetadata []metadata.NameValue `json:",omitempty"`
+}
+
+// RTTSample is an application-level RTT sample, i.e. the time elapsed between
+// sending a ping message and receiving the corresponding pong message. This
+// structure is an extension to the ndt7 specification.
+type RTTSample struct {
+	// RTT is measured in microseconds.
+	RTT int64
+	// Time is when the pong message was received.
+	Time time.Time
 }
 
 // The Measurement struct contains measurement results. This structure is
@@ -28,6 +67,12 @@ type Measurement struct {
 	BBRInfo        *BBRInfo        `json:",omitempty"`
 	TCPInfo        *TCPInfo        `json:",omitempty"`
 	QUICInfo       *QUICInfo       `json:",omitempty"`
+	StreamInfo     []StreamInfo    `json:",omitempty"`
+	DatagramInfo   *DatagramInfo   `json:",omitempty"`
+	// Test is the subtest of the measurement, i.e. "download" or "upload",
+	// when the subtest would otherwise be ambiguous, e.g. during
+	// bidirectional subtests.
+	Test string `json:",omitempty"`
 }
 
 // AppInfo contains an application level measurement. This structure is
@@ -37,6 +82,95 @@ type AppInfo struct {
 	ElapsedTime int64
 }
 
+// StreamInfo contains an application level measurement for one of the bulk
+// streams of ndtQUIC subtests. Streams are numbered from zero, in the order in
+// which they have been opened. This structure is an extension to the ndt7
+// specification.
+type StreamInfo struct {
+	Index       int64
+	NumBytes    int64
+	ElapsedTime int64
+}
+
+// DatagramInfo contains the statistics of the datagrams received during the
+// datagram subtest, as computed by the receiver. Counters are cumulative since
+// the start of the subtest, while the delay statistics only cover the datagrams
+// received since the previous measurement. Delays are measured in
+// microseconds. This structure is an extension to the ndt7 specification.
+type DatagramInfo struct {
+	// Sent is the number of datagrams sent by the measuring endpoint.
+	Sent int64
+	// Received is the number of datagrams received.
+	Received int64
+	// Lost is the number of datagrams not received yet, among those with a
+	// sequence number lower than the highest received one.
+	Lost int64
+	// Reordered is the number of datagrams received after a datagram with a
+	// higher sequence number.
+	Reordered int64
+	// MeanDelayVariation and MaxDelayVariation are the mean and maximum
+	// one-way delay variation of the datagrams received during the interval,
+	// i.e. their one-way delay minus the minimum one-way delay observed
+	// since the start of the subtest. Both are zero when no datagrams were
+	// received during the interval.
+	MeanDelayVariation int64
+	MaxDelayVariation  int64
+	// Jitter is the interarrival jitter, computed as specified in RFC 3550.
+	Jitter      int64
+	ElapsedTime int64
+}
+
+// DatagramThroughput summarizes the throughput of an ndtQUIC download sending
+// bulk data in datagrams, which are not retransmitted when lost. The sent
+// figures come from the last server measurement, and the delivered ones from
+// the last client measurement reporting received datagrams. This structure is
+// an extension to the ndt7 specification.
+type DatagramThroughput struct {
+	// Size is the size of the datagrams, in bytes.
+	Size int64
+	// Sent is the number of datagrams sent by the server, and SentMbps the
+	// corresponding rate.
+	Sent     int64
+	SentMbps float64
+	// Delivered is the number of datagrams received by the client, and
+	// DeliveredMbps the corresponding rate. Both are zero if the client did
+	// not report them.
+	Delivered     int64
+	DeliveredMbps float64
+}
+
+// EarlyExit is the criterion used to end a subtest early: its throughput is
+// stable once the rates between consecutive measurements over the last Window
+// all differ by less than Tolerance from the mean rate over the Window,
+// provided that the subtest has run for at least MinRuntime. This structure is
+// an extension to the ndt7 specification.
+type EarlyExit struct {
+	// MinRuntime and Window are measured in microseconds.
+	MinRuntime int64
+	Window     int64
+	Tolerance  float64
+}
+
+// ByteBudget is the byte budget requested by the client for a subtest, and the
+// bytes actually used, i.e. the largest count of the application-level bytes
+// and of the bytes acknowledged (downloads) or received (uploads) according
+// to TCPInfo. This structure is an extension to the ndt7 specification.
+type ByteBudget struct {
+	MaxBytes  int64
+	UsedBytes int64
+}
+
+// Timing contains the runtime and the average sampling interval of a subtest,
+// negotiated between the defaults and bounds of the server and the values
+// requested by the client, and the maximum runtime after which the server
+// closes the connection. All durations are in microseconds. This structure is
+// an extension to the ndt7 specification.
+type Timing struct {
+	Runtime          int64
+	MaxRuntime       int64
+	SamplingInterval int64
+}
+
 // ConnectionInfo contains connection info. This structure is described
 // in the ndt7 specification.
 type ConnectionInfo struct {
@@ -60,10 +194,63 @@ type TCPInfo struct {
 	ElapsedTime int64
 }
 
-// The TCPInfo struct contains information measured using TCP_INFO. This
-// structure is described in the ndt7 specification.
+// The QUICInfo struct contains information about the QUIC connection, as
+// measured by the QUIC implementation. This structure is an extension to the
+// ndt7 specification for ndtQUIC subtests, and plays the role of TCPInfo.
 type QUICInfo struct {
-	// TODO
-	QUICStreamBytesReceived int64
+	QUICConnInfo
 	ElapsedTime int64
 }
+
+// QUICConnInfo contains the state of a QUIC connection, as tracked by the
+// loss recovery and congestion control of the QUIC implementation. Times are
+// measured in microseconds, like the corresponding tcp.LinuxTCPInfo fields.
+// Byte and packet counters include all QUIC packets sent or received on the
+// connection, hence they account for the QUIC and TLS overhead. BytesAcked and
+// BytesLost only account for packets sent after the handshake.
+type QUICConnInfo struct {
+	SmoothedRTT      int64
+	MinRTT           int64
+	LatestRTT        int64
+	RTTVar           int64
+	CongestionWindow int64
+	BytesInFlight    int64
+	PacketsSent      int64
+	PacketsReceived  int64
+	PacketsLost      int64
+	BytesSent        int64
+	BytesReceived    int64
+	BytesAcked       int64
+	BytesLost        int64
+}
+
+// QUICParams contains the QUIC parameters in effect during an ndtQUIC subtest:
+// the transport parameters exchanged during the handshake, and the sizes up to
+// which the server may grow its receive windows, in bytes. This structure is
+// an extension to the ndt7 specification.
+type QUICParams struct {
+	QUICConnParams
+	MaxStreamReceiveWindow     int64
+	MaxConnectionReceiveWindow int64
+}
+
+// QUICConnParams contains the transport parameters sent by the server and by
+// the client during the handshake of a QUIC connection.
+type QUICConnParams struct {
+	Server QUICTransportParams
+	Client QUICTransportParams
+}
+
+// QUICTransportParams contains the QUIC transport parameters sent by an
+// endpoint during the handshake. MaxIdleTimeout is measured in microseconds,
+// while the flow control limits are measured in bytes.
+type QUICTransportParams struct {
+	MaxIdleTimeout                 int64
+	InitialMaxData                 int64
+	InitialMaxStreamDataBidiLocal  int64
+	InitialMaxStreamDataBidiRemote int64
+	InitialMaxStreamDataUni        int64
+	MaxBidiStreamNum               int64
+	MaxUniStreamNum                int64
+	MaxDatagramFrameSize           int64
+}
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/m-lab/ndt-server/ndt7/spec"
+)
+
+// DatagramHeader is the header of the datagrams of the datagram subtest. On the
+// wire, the header is made of the sequence number and the timestamp, encoded
+// as 64 bit big-endian integers, and is followed by padding.
+type DatagramHeader struct {
+	// Seq is the sequence number of the datagram. The first datagram sent
+	// by each endpoint has sequence number zero.
+	Seq uint64
+	// Timestamp is when the datagram was sent, in microseconds since the
+	// sender started sending datagrams.
+	Timestamp int64
+}
+
+// errDatagramTooShort indicates that a datagram is shorter than its header.
+var errDatagramTooShort = errors.New("datagram too short")
+
+// Marshal writes the header at the beginning of b, which must be at least
+// spec.DatagramHeaderSize bytes long.
+func (h DatagramHeader) Marshal(b []byte) {
+	binary.BigEndian.PutUint64(b[0:8], h.Seq)
+	binary.BigEndian.PutUint64(b[8:16], uint64(h.Timestamp))
+}
+
+// ParseDatagramHeader parses the header at the beginning of the datagram b.
+func ParseDatagramHeader(b []byte) (DatagramHeader, error) {
+	if len(b) < spec.DatagramHeaderSize {
+		return DatagramHeader{}, errDatagramTooShort
+	}
+	return DatagramHeader{
+		Seq:       binary.BigEndian.Uint64(b[0:8]),
+		Timestamp: int64(binary.BigEndian.Uint64(b[8:16])),
+	}, nil
+}
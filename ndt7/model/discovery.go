@@ -0,0 +1,12 @@
+package model
+
+// Discovery is the response to service-discovery requests. It is modeled on
+// the responses of the locate.measurementlab.net service.
+type Discovery struct {
+	// FQDN is the name of the server, as used by the client.
+	FQDN string `json:"fqdn"`
+	// URLs maps the tests offered by the server to their URLs. The keys are
+	// like the URLs without the host, e.g. "wss:///ndt/v7/download", where the
+	// scheme identifies the transport.
+	URLs map[string]string `json:"urls"`
+}
@@ -0,0 +1,55 @@
+package model
+
+import "github.com/m-lab/ndt-server/ndt7/spec"
+
+// Names of the measurements a rate may be computed from.
+const (
+	RateSourceTCPInfo  = "TCPInfo"
+	RateSourceQUICInfo = "QUICInfo"
+	RateSourceAppInfo  = "AppInfo"
+)
+
+// Rate returns the mean rate in Mbps of a subtest of the given kind since its
+// beginning, as measured by m, together with the time elapsed since the
+// beginning of the subtest, in microseconds, and the name of the measurement
+// the rate is computed from, like Transferred.
+func (m Measurement) Rate(kind spec.SubtestKind) (rate float64, elapsed int64, source string) {
+	n, elapsed, source := m.Transferred(kind)
+	return Mbps(n, elapsed), elapsed, source
+}
+
+// Transferred returns the number of bytes transferred by a subtest of the
+// given kind since its beginning, as measured by m, together with the time
+// elapsed since the beginning of the subtest, in microseconds, and the name of
+// the measurement the bytes are taken from. It prefers TCPInfo (WebSocket),
+// then QUICInfo and AppInfo (WebTransport), so that rates are comparable across
+// protocols. When m contains none of them, the name is empty.
+func (m Measurement) Transferred(kind spec.SubtestKind) (n, elapsed int64, source string) {
+	// NOTE: on non-Linux platforms, TCPInfo will be nil.
+	switch {
+	case m.TCPInfo != nil:
+		n, elapsed, source = m.TCPInfo.BytesAcked, m.TCPInfo.ElapsedTime, RateSourceTCPInfo
+		if kind == spec.SubtestUpload {
+			n = m.TCPInfo.BytesReceived
+		}
+	case m.QUICInfo != nil:
+		n, elapsed, source = m.QUICInfo.BytesAcked, m.QUICInfo.ElapsedTime, RateSourceQUICInfo
+		if kind == spec.SubtestUpload {
+			n = m.QUICInfo.BytesReceived
+		}
+	case m.AppInfo != nil:
+		n, elapsed, source = m.AppInfo.NumBytes, m.AppInfo.ElapsedTime, RateSourceAppInfo
+	default:
+		return 0, 0, ""
+	}
+	return n, elapsed, source
+}
+
+// Mbps returns the rate in Mbps of the given number of bytes transferred in
+// the given time, in microseconds. It returns zero if elapsed is not positive.
+func Mbps(bytes, elapsed int64) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return 8 * float64(bytes) / float64(elapsed)
+}
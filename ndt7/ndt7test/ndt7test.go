@@ -1,41 +1,159 @@
 package ndt7test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
 	"github.com/m-lab/go/testingx"
+	"github.com/m-lab/ndt-server/ndt7/feed"
 	"github.com/m-lab/ndt-server/ndt7/handler"
+	"github.com/m-lab/ndt-server/ndt7/listener"
+	"github.com/m-lab/ndt-server/ndt7/session"
 	"github.com/m-lab/ndt-server/ndt7/spec"
 	"github.com/m-lab/ndt-server/netx"
+	"github.com/m-lab/ndt-server/quicx"
+	"github.com/marten-seemann/webtransport-go"
 )
 
 // NewNDT7Server creates a local httptest server capable of running an ndt7
 // measurement in unittests.
 func NewNDT7Server(t *testing.T) (*handler.Handler, *httptest.Server) {
+	return newNDT7Server(t, false)
+}
+
+// NewNDT7TLSServer is like NewNDT7Server but the server uses TLS and HTTP/2,
+// which allows running ndt7 measurements over plain HTTP streams. Clients
+// must use the server's Client() to trust its certificate.
+func NewNDT7TLSServer(t *testing.T) (*handler.Handler, *httptest.Server) {
+	return newNDT7Server(t, true)
+}
+
+func newNDT7Server(t *testing.T, withTLS bool) (*handler.Handler, *httptest.Server) {
 	dir, err := ioutil.TempDir("", "ndt7test-*")
 	testingx.Must(t, err, "failed to create temp dir")
 
 	// TODO: add support for token verifiers.
-	// TODO: add support for TLS server.
-	ndt7Handler := &handler.Handler{DataDir: dir}
+	ndt7Handler := &handler.Handler{DataDir: dir, Sessions: session.NewRegistry(), Feeds: feed.NewRegistry()}
 	ndt7Mux := http.NewServeMux()
 	ndt7Mux.Handle(spec.DownloadURLPath, http.HandlerFunc(ndt7Handler.Download))
 	ndt7Mux.Handle(spec.UploadURLPath, http.HandlerFunc(ndt7Handler.Upload))
+	ndt7Mux.Handle(spec.BidirectionalURLPath, http.HandlerFunc(ndt7Handler.Bidirectional))
+	ndt7Mux.Handle(spec.HTTPDownloadURLPath, http.HandlerFunc(ndt7Handler.HTTPDownload))
+	ndt7Mux.Handle(spec.HTTPUploadURLPath, http.HandlerFunc(ndt7Handler.HTTPUpload))
+	ndt7Mux.Handle(spec.HTTPMeasurementsURLPath, http.HandlerFunc(ndt7Handler.HTTPMeasurements))
 
 	// Create unstarted so we can setup a custom netx.Listener.
 	ts := httptest.NewUnstartedServer(ndt7Mux)
-	listener, err := net.Listen("tcp", ":0")
+	ts.Config.ConnContext = netx.ConnContext
+	// NOTE: the certificate of TLS servers is only valid for loopback IPs.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	testingx.Must(t, err, "failed to allocate a listening tcp socket")
 	addr := (listener.(*net.TCPListener)).Addr().(*net.TCPAddr)
-	// Populate insecure port value with dynamic port.
-	ndt7Handler.InsecurePort = fmt.Sprintf(":%d", addr.Port)
 	ts.Listener = netx.NewListener(listener.(*net.TCPListener))
 	// Now that the test server has our custom listener, start it.
-	ts.Start()
+	if withTLS {
+		// Populate secure port value with dynamic port.
+		ndt7Handler.SecurePort = fmt.Sprintf(":%d", addr.Port)
+		ts.EnableHTTP2 = true
+		ts.StartTLS()
+	} else {
+		// Populate insecure port value with dynamic port.
+		ndt7Handler.InsecurePort = fmt.Sprintf(":%d", addr.Port)
+		ts.Start()
+	}
 	return ndt7Handler, ts
 }
+
+// NewNDTQUICServer creates a local WebTransport server capable of running an
+// ndtQUIC measurement in unittests. The server uses a self-signed certificate
+// and listens on the returned UDP socket. Callers must close both the server
+// and the socket.
+func NewNDTQUICServer(t *testing.T) (*handler.QUICHandler, *webtransport.Server, net.PacketConn) {
+	dir, err := ioutil.TempDir("", "ndt7test-*")
+	testingx.Must(t, err, "failed to create temp dir")
+
+	mux := http.NewServeMux()
+	srv := &webtransport.Server{
+		H3: http3.Server{
+			Handler:   mux,
+			TLSConfig: newTLSConfig(t),
+			QuicConfig: &quic.Config{
+				AllowConnectionWindowIncrease: quicx.AllowConnectionWindowIncrease,
+				Tracer:                        quicx.NewTracer(),
+			},
+		},
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	h := &handler.QUICHandler{Handler: handler.Handler{DataDir: dir, Feeds: feed.NewRegistry()}, Server: srv}
+	mux.Handle(spec.DownloadURLPath, http.HandlerFunc(h.Download))
+	mux.Handle(spec.UploadURLPath, http.HandlerFunc(h.Upload))
+	mux.Handle(spec.HTTPDownloadURLPath, http.HandlerFunc(h.HTTPDownload))
+	mux.Handle(spec.HTTPUploadURLPath, http.HandlerFunc(h.HTTPUpload))
+	mux.Handle(spec.HTTPMeasurementsURLPath, http.HandlerFunc(h.HTTPMeasurements))
+	mux.Handle(spec.DatagramURLPath, http.HandlerFunc(h.Datagram))
+	mux.Handle(spec.CombinedURLPath, http.HandlerFunc(h.Combined))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	testingx.Must(t, err, "failed to allocate a listening udp socket")
+	h.SecurePort = fmt.Sprintf(":%d", conn.LocalAddr().(*net.UDPAddr).Port)
+	go srv.Serve(conn)
+	return h, srv, conn
+}
+
+// NewRawQUICServer creates a local raw QUIC server capable of running an
+// ndtQUIC measurement without HTTP/3 in unittests. The server uses a
+// self-signed certificate, negotiates the spec.QUICALPN protocol and listens on
+// server.Addr. Callers must close the server.
+func NewRawQUICServer(t *testing.T) (*handler.QUICHandler, *listener.QUICServer) {
+	dir, err := ioutil.TempDir("", "ndt7test-*")
+	testingx.Must(t, err, "failed to create temp dir")
+
+	tlsConf := newTLSConfig(t)
+	tlsConf.NextProtos = []string{spec.QUICALPN}
+	srv := &listener.QUICServer{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: tlsConf,
+		QUICConfig: &quic.Config{
+			AllowConnectionWindowIncrease: quicx.AllowConnectionWindowIncrease,
+			Tracer:                        quicx.NewTracer(),
+		},
+	}
+	h := &handler.QUICHandler{Handler: handler.Handler{DataDir: dir}, QUICConfig: srv.QUICConfig}
+	srv.Handler = h.ServeQUIC
+	err = listener.ListenAndServeQUICAsync(srv)
+	testingx.Must(t, err, "failed to start the raw QUIC server")
+	_, port, _ := net.SplitHostPort(srv.Addr)
+	h.SecurePort = ":" + port
+	return h, srv
+}
+
+// newTLSConfig creates a TLS config with a self-signed certificate for the
+// local host.
+func newTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testingx.Must(t, err, "failed to generate key")
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	testingx.Must(t, err, "failed to create certificate")
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
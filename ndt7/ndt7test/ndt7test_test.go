@@ -1,48 +1,373 @@
 package ndt7test
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
 	"github.com/m-lab/go/testingx"
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/ndt7/handler"
+	"github.com/m-lab/ndt-server/ndt7/measurer"
+	"github.com/m-lab/ndt-server/ndt7/model"
 	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/quicx"
+	"github.com/marten-seemann/webtransport-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/goleak"
 )
 
-func TestNewNDT7Server(t *testing.T) {
-	// Create the ndt7test server.
-	h, srv := NewNDT7Server(t)
-	defer os.RemoveAll(h.DataDir)
+// testRuntime is the runtime that the tests request with the duration_ms
+// parameter, to keep them short. The server completes their subtests within
+// testMaxRuntime.
+const (
+	testRuntime    = 2 * time.Second
+	testMaxRuntime = testRuntime + spec.RuntimeGrace
+)
+
+// Patterns of the results saved by the servers, relative to their DataDir.
+const (
+	ndt7Results    = "/ndt7/*/*/*/*"
+	ndtQUICResults = "/ndtquic/*/*/*/ndtquic-*.json.gz"
+)
+
+// withRuntime returns path, which may contain a query string, with the
+// duration_ms parameter requesting testRuntime.
+func withRuntime(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%sduration_ms=%d", path, sep, testRuntime/time.Millisecond)
+}
 
-	// Prepare to run a simplified download with ndt7test server.
+// waitForResults waits until at least n of the results saved in dataDir match
+// pattern, since the server may save them after the client is done, and
+// returns them. It fails the test if they are not saved before ctx is done.
+func waitForResults(ctx context.Context, t *testing.T, dataDir, pattern string, n int) []string {
+	for {
+		m, err := filepath.Glob(dataDir + pattern)
+		testingx.Must(t, err, "failed to glob datadir: %s", dataDir)
+		if len(m) >= n {
+			return m
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("got files %v, want %d results", m, n)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// dialNDT7 dials the ndt7 WebSocket subtest at path, which may contain a query
+// string, on srv.
+func dialNDT7(ctx context.Context, dialer *websocket.Dialer, srv *httptest.Server, path string) (*websocket.Conn, *http.Response, error) {
 	URL, _ := url.Parse(srv.URL)
 	URL.Scheme = "ws"
-	URL.Path = spec.DownloadURLPath
 	headers := http.Header{}
 	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
 	headers.Add("User-Agent", "fake-user-agent")
-	ctx := context.Background()
-	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
-	conn, _, err := dialer.DialContext(ctx, URL.String(), headers)
+	return dialer.DialContext(ctx, URL.String()+path, headers)
+}
+
+func TestNewNDT7Server(t *testing.T) {
+	// Create the ndt7test server.
+	h, srv := NewNDT7Server(t)
+	defer os.RemoveAll(h.DataDir)
+
+	// Run a simplified download with ndt7test server.
+	ctx, cancel := context.WithTimeout(context.Background(), testMaxRuntime+2*time.Second)
+	defer cancel()
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialNDT7(ctx, dialer, srv, withRuntime(spec.DownloadURLPath))
 	testingx.Must(t, err, "failed to dial websocket ndt7 test")
 	err = simpleDownload(ctx, t, conn)
 	if err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
 		testingx.Must(t, err, "failed to download")
 	}
 
-	// Allow the server time to save the file, the client may stop before the server does.
-	time.Sleep(1 * time.Second)
 	// Verify a file was saved.
-	m, err := filepath.Glob(h.DataDir + "/ndt7/*/*/*/*")
-	testingx.Must(t, err, "failed to glob datadir: %s", h.DataDir)
-	if len(m) == 0 {
-		t.Errorf("no files found")
+	waitForResults(ctx, t, h.DataDir, ndt7Results, 1)
+}
+
+func TestNewNDT7Server_EarlyExit(t *testing.T) {
+	// Create the ndt7test server.
+	h, srv := NewNDT7Server(t)
+	defer os.RemoveAll(h.DataDir)
+
+	// Run a simplified download requesting an early exit, over a connection
+	// read at a constant rate, so that its throughput is stable. It runs
+	// for the default runtime, unless it exits early.
+	ctx, cancel := context.WithTimeout(context.Background(), spec.MaxRuntime+2*time.Second)
+	defer cancel()
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: 10 * time.Second,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			// Keep the data buffered by the client small compared to
+			// the data read every second.
+			if err := conn.(*net.TCPConn).SetReadBuffer(64 << 10); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return &throttledConn{Conn: conn, rate: 2.5e6}, nil
+		},
+	}
+	conn, _, err := dialNDT7(ctx, dialer, srv, spec.DownloadURLPath+"?early_exit=true")
+	testingx.Must(t, err, "failed to dial websocket ndt7 test")
+	err = simpleDownload(ctx, t, conn)
+	if err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		testingx.Must(t, err, "failed to download")
+	}
+
+	m := waitForResults(ctx, t, h.DataDir, ndt7Results, 1)
+	result := readNDT7Result(t, m[0])
+	d := result.Download
+	if d == nil || d.EarlyExit == nil || d.EndReason != spec.EndReasonStable {
+		t.Fatalf("got download %+v, want an early exit criterion and a stable end reason", d)
+	}
+	// The throughput is stable once the window after the minimum runtime
+	// is covered, well before the runtime elapses.
+	if elapsed := d.EndTime.Sub(d.StartTime); elapsed > spec.DefaultRuntime-3*time.Second {
+		t.Errorf("download ended after %v, want it to end well before %v", elapsed, spec.DefaultRuntime)
+	}
+}
+
+// throttledConn is a net.Conn read at a constant rate, in bytes per second.
+type throttledConn struct {
+	net.Conn
+	rate  float64
+	start time.Time
+	total int64
+}
+
+// Read reads at most 16 KiB at a time, and then waits until the data read so
+// far matches the rate.
+func (c *throttledConn) Read(b []byte) (int, error) {
+	if len(b) > 16<<10 {
+		b = b[:16<<10]
+	}
+	if c.start.IsZero() {
+		c.start = time.Now()
+	}
+	n, err := c.Conn.Read(b)
+	c.total += int64(n)
+	time.Sleep(time.Until(c.start.Add(time.Duration(float64(c.total) / c.rate * float64(time.Second)))))
+	return n, err
+}
+
+func TestNewNDT7Server_MaxBytes(t *testing.T) {
+	// Create the ndt7test server.
+	h, srv := NewNDT7Server(t)
+	defer os.RemoveAll(h.DataDir)
+
+	// Run a simplified download with the smallest byte budget.
+	ctx, cancel := context.WithTimeout(context.Background(), testMaxRuntime+2*time.Second)
+	defer cancel()
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	path := withRuntime(fmt.Sprintf("%s?max_bytes=%d", spec.DownloadURLPath, spec.MinByteBudget))
+	conn, _, err := dialNDT7(ctx, dialer, srv, path)
+	testingx.Must(t, err, "failed to dial websocket ndt7 test")
+	err = simpleDownload(ctx, t, conn)
+	if err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		testingx.Must(t, err, "failed to download")
+	}
+
+	m := waitForResults(ctx, t, h.DataDir, ndt7Results, 1)
+	result := readNDT7Result(t, m[0])
+	d := result.Download
+	if d == nil || d.EndReason != spec.EndReasonMaxBytes || d.ByteBudget == nil ||
+		d.ByteBudget.MaxBytes != spec.MinByteBudget || d.ByteBudget.UsedBytes < spec.MinByteBudget {
+		t.Errorf("got download %+v, want it to end after exhausting its budget", d)
+	}
+}
+
+func TestNewNDT7Server_Timing(t *testing.T) {
+	// Create the ndt7test server.
+	h, srv := NewNDT7Server(t)
+	defer os.RemoveAll(h.DataDir)
+
+	// Run a simplified download requesting a shorter runtime and a longer
+	// sampling interval than the default ones.
+	ctx, cancel := context.WithTimeout(context.Background(), testMaxRuntime+2*time.Second)
+	defer cancel()
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialNDT7(ctx, dialer, srv, spec.DownloadURLPath+"?duration_ms=2000&sampling_interval_ms=500")
+	testingx.Must(t, err, "failed to dial websocket ndt7 test")
+	start := time.Now()
+	err = simpleDownload(ctx, t, conn)
+	if err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		testingx.Must(t, err, "failed to download")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("download took %v, want about 2s", elapsed)
+	}
+
+	m := waitForResults(ctx, t, h.DataDir, ndt7Results, 1)
+	result := readNDT7Result(t, m[0])
+	want := model.Timing{Runtime: 2000000, MaxRuntime: 7000000, SamplingInterval: 500000}
+	d := result.Download
+	if d == nil || d.Timing == nil || *d.Timing != want {
+		t.Fatalf("got download %+v, want timing %+v", d, want)
+	}
+	// At most two measurements per second on average, plus some margin.
+	if n := len(d.ServerMeasurements); n == 0 || n > 10 {
+		t.Errorf("got %d server measurements, want about 4", n)
+	}
+}
+
+func TestNewNDT7Server_MultiFlow(t *testing.T) {
+	// Create the ndt7test server.
+	h, srv := NewNDT7Server(t)
+	defer os.RemoveAll(h.DataDir)
+
+	// Run simplified downloads over the flows of a session. The first flow
+	// creates the session, and the other ones join it with its ID.
+	const flows = 3
+	ctx, cancel := context.WithTimeout(context.Background(), testMaxRuntime+2*time.Second)
+	defer cancel()
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conns := make([]*websocket.Conn, flows)
+	conn, resp, err := dialNDT7(ctx, dialer, srv, withRuntime(fmt.Sprintf("%s?flows=%d", spec.DownloadURLPath, flows)))
+	testingx.Must(t, err, "failed to dial websocket ndt7 test")
+	conns[0] = conn
+	id := resp.Header.Get(spec.SessionIDHeader)
+	if id == "" {
+		t.Fatalf("got no session ID in the response to the first flow")
+	}
+	// Guessing the session ID does not allow joining the session.
+	path := withRuntime(fmt.Sprintf("%s?flows=%d&session_id=%032d", spec.DownloadURLPath, flows, 0))
+	if _, _, err := dialNDT7(ctx, dialer, srv, path); err == nil {
+		t.Errorf("joined a session with a guessed ID")
+	}
+	path = withRuntime(fmt.Sprintf("%s?flows=%d&session_id=%s", spec.DownloadURLPath, flows, id))
+	for i := 1; i < flows; i++ {
+		conns[i], _, err = dialNDT7(ctx, dialer, srv, path)
+		testingx.Must(t, err, "failed to dial websocket ndt7 test")
+	}
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			err := simpleDownload(ctx, t, conn)
+			if err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Errorf("failed to download: %v", err)
+			}
+		}(conn)
+	}
+	wg.Wait()
+
+	// Only the result of the session is saved.
+	m := waitForResults(ctx, t, h.DataDir, ndt7Results, 1)
+	if len(m) != 1 || !strings.Contains(m[0], "ndt7-download-session-") {
+		t.Fatalf("got files %v, want one session result", m)
+	}
+	f, err := os.Open(m[0])
+	testingx.Must(t, err, "failed to open result")
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	testingx.Must(t, err, "failed to read result")
+	result := &data.NDT7SessionResult{}
+	testingx.Must(t, json.NewDecoder(r).Decode(result), "failed to decode result")
+	if result.SessionID != id || result.RequestedFlows != flows || len(result.Flows) != flows {
+		t.Fatalf("got session %q with %d/%d flows, want %q with %d flows",
+			result.SessionID, len(result.Flows), result.RequestedFlows, id, flows)
+	}
+	var sum float64
+	for _, flow := range result.Flows {
+		if flow.Download == nil || flow.Download.MeanThroughputMbps <= 0 {
+			t.Fatalf("got flow %+v, want a download with a rate", flow)
+		}
+		sum += flow.Download.MeanThroughputMbps
+	}
+	if result.MeanThroughputMbps != sum {
+		t.Errorf("got session rate %v, want the sum of the flow rates %v", result.MeanThroughputMbps, sum)
+	}
+}
+
+func TestNewNDT7Server_Bidirectional(t *testing.T) {
+	// Create the ndt7test server.
+	h, srv := NewNDT7Server(t)
+	defer os.RemoveAll(h.DataDir)
+
+	// Run a simplified bidirectional subtest.
+	ctx, cancel := context.WithTimeout(context.Background(), testMaxRuntime+2*time.Second)
+	defer cancel()
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	bbr := testutil.ToFloat64(measurer.BBREnabled)
+	conn, _, err := dialNDT7(ctx, dialer, srv, withRuntime(spec.BidirectionalURLPath))
+	testingx.Must(t, err, "failed to dial websocket ndt7 test")
+	err = simpleBidirectional(ctx, t, conn)
+	if err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		testingx.Must(t, err, "failed to run bidirectional subtest")
+	}
+	// BBR is enabled once for the connection, although both directions
+	// are measured.
+	if n := testutil.ToFloat64(measurer.BBREnabled) - bbr; n != 1 {
+		t.Errorf("got %v attempts to enable BBR, want 1", n)
 	}
+
+	m := waitForResults(ctx, t, h.DataDir, ndt7Results, 1)
+	result := readNDT7Result(t, m[0])
+	for _, kind := range []spec.SubtestKind{spec.SubtestDownload, spec.SubtestUpload} {
+		d := result.Download
+		if kind == spec.SubtestUpload {
+			d = result.Upload
+		}
+		if d == nil || d.EndReason != spec.EndReasonRuntime || d.MeanThroughputMbps <= 0 {
+			t.Fatalf("got %s %+v, want it to run until its runtime elapsed", kind, d)
+		}
+		if len(d.ServerMeasurements) == 0 || len(d.ClientMeasurements) != 1 {
+			t.Fatalf("got %s with %d server and %d client measurements, want some and 1",
+				kind, len(d.ServerMeasurements), len(d.ClientMeasurements))
+		}
+		for _, m := range append(d.ServerMeasurements, d.ClientMeasurements...) {
+			if m.Test != string(kind) {
+				t.Errorf("got %s measurement of test %q", kind, m.Test)
+			}
+		}
+		last := d.ServerMeasurements[len(d.ServerMeasurements)-1]
+		if last.AppInfo == nil || last.AppInfo.NumBytes <= 0 {
+			t.Errorf("got %s AppInfo %+v, want some bytes", kind, last.AppInfo)
+		}
+	}
+	if result.Download.UUID != result.Upload.UUID {
+		t.Errorf("got UUIDs %q and %q, want the same", result.Download.UUID, result.Upload.UUID)
+	}
+}
+
+// readNDT7Result reads the ndt7 result saved in the given file.
+func readNDT7Result(t *testing.T, path string) *data.NDT7Result {
+	f, err := os.Open(path)
+	testingx.Must(t, err, "failed to open result")
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	testingx.Must(t, err, "failed to read result")
+	result := &data.NDT7Result{}
+	testingx.Must(t, json.NewDecoder(r).Decode(result), "failed to decode result")
+	return result
 }
 
 func simpleDownload(ctx context.Context, t *testing.T, conn *websocket.Conn) error {
@@ -64,3 +389,936 @@ func simpleDownload(ctx context.Context, t *testing.T, conn *websocket.Conn) err
 	}
 	return nil
 }
+
+// simpleBidirectional is like simpleDownload, but it also uploads binary
+// messages, and sends a measurement for each direction.
+func simpleBidirectional(ctx context.Context, t *testing.T, conn *websocket.Conn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for _, kind := range []spec.SubtestKind{spec.SubtestDownload, spec.SubtestUpload} {
+			m := model.Measurement{
+				AppInfo: &model.AppInfo{ElapsedTime: 1},
+				Test:    string(kind),
+			}
+			if conn.WriteJSON(m) != nil {
+				return
+			}
+		}
+		buf := make([]byte, 1<<13)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if conn.WriteMessage(websocket.BinaryMessage, buf) != nil {
+				return
+			}
+		}
+	}()
+	return simpleDownload(ctx, t, conn)
+}
+
+// quicTest is an ndtQUIC test server together with a minimal client.
+type quicTest struct {
+	h      *handler.QUICHandler
+	srv    *webtransport.Server
+	conn   net.PacketConn
+	rt     *http3.RoundTripper
+	dialer *webtransport.Dialer
+	// dialed is set once the dialer is used, since it can only be closed
+	// afterwards.
+	dialed bool
+
+	// mu protects the QUIC connections dialed by the client, so that
+	// clients may send and receive datagrams over the last one.
+	mu    sync.Mutex
+	qconn quic.EarlyConnection
+	dials int
+}
+
+// newQUICTest creates an ndtQUIC test server and its client. The caller must
+// call Close.
+func newQUICTest(t *testing.T) *quicTest {
+	q := &quicTest{}
+	q.h, q.srv, q.conn = NewNDTQUICServer(t)
+	q.rt = &http3.RoundTripper{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			qconn, err := quic.DialAddrEarlyContext(ctx, addr, tlsCfg, cfg)
+			if err == nil {
+				q.mu.Lock()
+				q.qconn = qconn
+				q.dials++
+				q.mu.Unlock()
+			}
+			return qconn, err
+		},
+	}
+	q.dialer = &webtransport.Dialer{RoundTripper: q.rt}
+	return q
+}
+
+// URL returns the URL of path, which may contain a query string, on the
+// server.
+func (q *quicTest) URL(path string) string {
+	return "https://" + q.conn.LocalAddr().String() + path
+}
+
+// dial establishes a WebTransport session with path, which may contain a query
+// string. The session is closed once ctx is done.
+func (q *quicTest) dial(ctx context.Context, t *testing.T, path string) (*http.Response, *webtransport.Session) {
+	q.dialed = true
+	rsp, sess, err := q.dialer.Dial(ctx, q.URL(path), nil)
+	testingx.Must(t, err, "failed to dial webtransport ndt7 test")
+	go func() {
+		<-ctx.Done()
+		sess.Close()
+	}()
+	return rsp, sess
+}
+
+// datagrams returns the DatagramConn of the session established by rsp, over
+// the last QUIC connection dialed by the client.
+func (q *quicTest) datagrams(t *testing.T, rsp *http.Response) quicx.DatagramConn {
+	// WARNING: this is not a reference client. The session is established
+	// by the request sent on the stream of the response.
+	streamer, ok := rsp.Body.(http3.HTTPStreamer)
+	if !ok {
+		t.Fatalf("no stream found for response")
+	}
+	q.mu.Lock()
+	qconn := q.qconn
+	q.mu.Unlock()
+	dc, err := quicx.WebTransportDatagrams(qconn, streamer.HTTPStream().StreamID())
+	testingx.Must(t, err, "failed to receive the datagrams of the session")
+	return dc
+}
+
+// Close closes the client and the server, and removes the saved results.
+func (q *quicTest) Close() {
+	if q.dialed {
+		q.dialer.Close()
+	}
+	q.rt.Close()
+	q.srv.Close()
+	q.conn.Close()
+	os.RemoveAll(q.h.DataDir)
+}
+
+func TestNewNDTQUICServer(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		client  func(ctx context.Context, t *testing.T, sess *webtransport.Session) error
+		timeout time.Duration
+		check   func(t *testing.T, result *data.NDTQUICResult)
+	}{
+		{
+			name:    "download",
+			path:    spec.DownloadURLPath,
+			client:  simpleWebTransportDownload,
+			timeout: testRuntime + 2*time.Second,
+		},
+		{
+			name:    "upload",
+			path:    spec.UploadURLPath,
+			client:  simpleWebTransportUpload,
+			timeout: testRuntime + 2*time.Second,
+		},
+		{
+			// The client neither reads nor writes. The server must still
+			// complete the subtest within its maximum runtime.
+			name: "stalled-client",
+			path: spec.DownloadURLPath,
+			client: func(ctx context.Context, t *testing.T, sess *webtransport.Session) error {
+				<-sess.Context().Done()
+				return nil
+			},
+			timeout: testMaxRuntime + 2*time.Second,
+		},
+		{
+			name:    "combined",
+			path:    spec.CombinedURLPath,
+			client:  sequentialWebTransportCombined,
+			timeout: 2*testRuntime + 2*time.Second,
+			check:   checkCombinedResult,
+		},
+		{
+			name:    "combined-simultaneous",
+			path:    spec.CombinedURLPath + "?simultaneous=true",
+			client:  simultaneousWebTransportCombined,
+			timeout: testRuntime + 2*time.Second,
+			check:   checkCombinedResult,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			// Create the ndt7test server.
+			q := newQUICTest(t)
+			defer q.Close()
+
+			// Run the subtest with a minimal client.
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			_, sess := q.dial(ctx, t, withRuntime(tt.path))
+			err := tt.client(ctx, t, sess)
+			testingx.Must(t, err, "failed to run %s", tt.name)
+
+			// Verify that the server completes the subtest and saves the
+			// result in time.
+			m := waitForResults(ctx, t, q.h.DataDir, ndtQUICResults, 1)
+			if tt.check != nil {
+				tt.check(t, readQUICResult(t, m[0]))
+			}
+		})
+	}
+}
+
+func TestNDTQUICServer_SessionsOnOneConnection(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// Create the ndt7test server.
+	q := newQUICTest(t)
+	defer q.Close()
+
+	// Run two short downloads with the same dialer, which reuses the QUIC
+	// connection of the first session for the second one.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*testRuntime+4*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		_, sess := q.dial(ctx, t, withRuntime(spec.DownloadURLPath))
+		err := simpleWebTransportDownload(ctx, t, sess)
+		sess.Close()
+		testingx.Must(t, err, "failed to download")
+	}
+
+	// Verify that the server saves a result with its own UUID per session.
+	m := waitForResults(ctx, t, q.h.DataDir, "/ndtquic/*/*/*/ndtquic-download-*.json.gz", 2)
+	r1, r2 := readQUICResult(t, m[0]), readQUICResult(t, m[1])
+	if r1.Download == nil || r2.Download == nil {
+		t.Fatalf("got downloads %v and %v, want both", r1.Download, r2.Download)
+	}
+	if r1.Download.UUID == "" || r1.Download.UUID == r2.Download.UUID {
+		t.Errorf("got UUIDs %q and %q, want distinct ones", r1.Download.UUID, r2.Download.UUID)
+	}
+	if r1.ConnectionUUID == "" || r1.ConnectionUUID != r2.ConnectionUUID {
+		t.Errorf("got connection UUIDs %q and %q, want the same", r1.ConnectionUUID, r2.ConnectionUUID)
+	}
+}
+
+func TestNDTQUICServer_SessionTimeoutOnSharedConnection(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// Create the ndt7test server.
+	q := newQUICTest(t)
+	defer q.Close()
+
+	// The client stalls a first datagram session, which the server closes
+	// at its deadline, while a second session over the same QUIC connection
+	// runs beyond this deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), testMaxRuntime+testRuntime+4*time.Second)
+	defer cancel()
+	_, stalled := q.dial(ctx, t, withRuntime(spec.DatagramURLPath))
+	path := fmt.Sprintf("%s?duration_ms=%d", spec.DownloadURLPath, (testMaxRuntime+testRuntime)/time.Millisecond)
+	_, sess := q.dial(ctx, t, path)
+	err := simpleWebTransportDownload(ctx, t, sess)
+	testingx.Must(t, err, "failed to download")
+	select {
+	case <-stalled.Context().Done():
+	default:
+		t.Errorf("the stalled session is still open")
+	}
+	q.mu.Lock()
+	dials := q.dials
+	q.mu.Unlock()
+	if dials != 1 {
+		t.Errorf("got %d QUIC connections, want 1", dials)
+	}
+
+	// Verify that the server saves the results of both sessions.
+	waitForResults(ctx, t, q.h.DataDir, ndtQUICResults, 2)
+}
+
+// readWebTransportControl reads the messages sent by the server on the
+// control stream and replies to ping messages, until the server closes it.
+func readWebTransportControl(ctx context.Context, sess *webtransport.Session) error {
+	ctrl, err := sess.AcceptStream(ctx)
+	if err != nil {
+		return err
+	}
+	return readControlStream(ctrl, ctrl)
+}
+
+// readControlStream is like readWebTransportControl but for an accepted
+// control stream, whose messages are read from r.
+func readControlStream(ctrl webtransport.Stream, r io.Reader) error {
+	defer ctrl.Close()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, spec.MaxMessageSize+1)
+	for scanner.Scan() {
+		if msg := scanner.Text(); strings.HasPrefix(msg, `{"Ping":`) {
+			pong := strings.Replace(msg, "Ping", "Pong", 1) + "\n"
+			if _, err := ctrl.Write([]byte(pong)); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func simpleWebTransportDownload(ctx context.Context, t *testing.T, sess *webtransport.Session) error {
+	// WARNING: this is not a reference client.
+	done := make(chan error, 1)
+	go func() {
+		str, err := sess.AcceptUniStream(ctx)
+		if err == nil {
+			_, err = io.Copy(io.Discard, str)
+		}
+		done <- err
+	}()
+	err := readWebTransportControl(ctx, sess)
+	if err2 := <-done; err == nil {
+		err = err2
+	}
+	return err
+}
+
+func simpleWebTransportUpload(ctx context.Context, t *testing.T, sess *webtransport.Session) error {
+	// WARNING: this is not a reference client.
+	done := make(chan error, 1)
+	go func() {
+		done <- readWebTransportControl(ctx, sess)
+	}()
+	return writeWebTransportUpload(ctx, sess, done)
+}
+
+// writeWebTransportUpload sends bulk data on a new stream until done returns
+// the result of reading the control stream.
+func writeWebTransportUpload(ctx context.Context, sess *webtransport.Session, done <-chan error) error {
+	str, err := sess.OpenUniStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<13)
+	for {
+		select {
+		case err := <-done:
+			str.Close()
+			return err
+		default:
+		}
+		if _, err := str.Write(buf); err != nil {
+			return <-done
+		}
+	}
+}
+
+func sequentialWebTransportCombined(ctx context.Context, t *testing.T, sess *webtransport.Session) error {
+	// WARNING: this is not a reference client. The upload starts when the
+	// server opens its control stream.
+	if err := simpleWebTransportDownload(ctx, t, sess); err != nil {
+		return err
+	}
+	ctrl, err := sess.AcceptStream(ctx)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- readControlStream(ctrl, ctrl)
+	}()
+	return writeWebTransportUpload(ctx, sess, done)
+}
+
+func simultaneousWebTransportCombined(ctx context.Context, t *testing.T, sess *webtransport.Session) error {
+	// WARNING: this is not a reference client. The first message of each
+	// control stream names its subtest.
+	downDone := make(chan error, 1)
+	upDone := make(chan error, 1)
+	for i := 0; i < 2; i++ {
+		ctrl, err := sess.AcceptStream(ctx)
+		if err != nil {
+			return err
+		}
+		r := bufio.NewReader(ctrl)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		read := func(done chan<- error) {
+			go func() {
+				done <- readControlStream(ctrl, r)
+			}()
+		}
+		switch line {
+		case `{"Subtest":"download"}` + "\n":
+			read(downDone)
+		case `{"Subtest":"upload"}` + "\n":
+			read(upDone)
+		default:
+			return errors.New("unexpected first message " + line)
+		}
+	}
+	go func() {
+		str, err := sess.AcceptUniStream(ctx)
+		if err == nil {
+			io.Copy(io.Discard, str)
+		}
+	}()
+	err := writeWebTransportUpload(ctx, sess, upDone)
+	if err2 := <-downDone; err == nil {
+		err = err2
+	}
+	return err
+}
+
+// readQUICResult reads the ndtQUIC result saved in the given file.
+func readQUICResult(t *testing.T, path string) *data.NDTQUICResult {
+	f, err := os.Open(path)
+	testingx.Must(t, err, "failed to open result")
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	testingx.Must(t, err, "failed to read result")
+	result := &data.NDTQUICResult{}
+	testingx.Must(t, json.NewDecoder(r).Decode(result), "failed to decode result")
+	return result
+}
+
+// checkCombinedResult verifies that the result of a combined subtest contains
+// both subtests, with the same UUID.
+func checkCombinedResult(t *testing.T, result *data.NDTQUICResult) {
+	if result.Download == nil || result.Upload == nil {
+		t.Fatalf("got download %v and upload %v, want both", result.Download, result.Upload)
+	}
+	if result.Download.UUID == "" || result.Download.UUID != result.Upload.UUID {
+		t.Errorf("got UUIDs %q and %q, want the same", result.Download.UUID, result.Upload.UUID)
+	}
+	if len(result.Download.ServerMeasurements) == 0 || len(result.Upload.ServerMeasurements) == 0 {
+		t.Errorf("got no server measurements")
+	}
+	if result.Download.MeanThroughputMbps == 0 || result.Upload.MeanThroughputMbps == 0 {
+		t.Errorf("got download rate %v and upload rate %v, want both", result.Download.MeanThroughputMbps, result.Upload.MeanThroughputMbps)
+	}
+}
+
+func TestNewRawQUICServer(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  string
+		client   func(ctx context.Context, t *testing.T, conn quic.Connection, ctrl quic.Stream) error
+		wantCode quic.ApplicationErrorCode
+	}{
+		{
+			name:    "download",
+			request: spec.DownloadURLPath + "?streams=2",
+			client:  simpleQUICDownload,
+		},
+		{
+			name:    "upload",
+			request: spec.UploadURLPath,
+			client:  simpleQUICUpload,
+		},
+		{
+			name:     "bad-request",
+			request:  "/ndt/v7/unknown",
+			wantCode: spec.QUICErrorBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			// Create the ndt7test server.
+			h, srv := NewRawQUICServer(t)
+			defer os.RemoveAll(h.DataDir)
+			defer srv.Close()
+
+			// Send the request with a minimal client.
+			ctx, cancel := context.WithTimeout(context.Background(), testRuntime+2*time.Second)
+			defer cancel()
+			tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{spec.QUICALPN}}
+			conn, err := quic.DialAddrContext(ctx, srv.Addr, tlsConf, nil)
+			testingx.Must(t, err, "failed to dial raw QUIC ndt7 test")
+			defer conn.CloseWithError(0, "")
+			ctrl, err := conn.OpenStreamSync(ctx)
+			testingx.Must(t, err, "failed to open the control stream")
+			_, err = ctrl.Write([]byte(withRuntime(tt.request) + "\n"))
+			testingx.Must(t, err, "failed to send the request")
+
+			if tt.client == nil {
+				// The server must close the connection with the expected code.
+				<-conn.Context().Done()
+				_, err := conn.AcceptStream(ctx)
+				var appErr *quic.ApplicationError
+				if !errors.As(err, &appErr) || appErr.ErrorCode != tt.wantCode {
+					t.Fatalf("got error %v, want application error %d", err, tt.wantCode)
+				}
+				return
+			}
+			err = tt.client(ctx, t, conn, ctrl)
+			testingx.Must(t, err, "failed to run %s", tt.name)
+
+			// Verify that the server completes the subtest and saves the
+			// result in time.
+			waitForResults(ctx, t, h.DataDir, ndtQUICResults, 1)
+		})
+	}
+}
+
+// readQUICControl is like readWebTransportControl but for raw QUIC
+// connections, where the client opens the control stream.
+func readQUICControl(ctrl quic.Stream) error {
+	defer ctrl.Close()
+	scanner := bufio.NewScanner(ctrl)
+	scanner.Buffer(nil, spec.MaxMessageSize+1)
+	for scanner.Scan() {
+		if msg := scanner.Text(); strings.HasPrefix(msg, `{"Ping":`) {
+			pong := strings.Replace(msg, "Ping", "Pong", 1) + "\n"
+			if _, err := ctrl.Write([]byte(pong)); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func simpleQUICDownload(ctx context.Context, t *testing.T, conn quic.Connection, ctrl quic.Stream) error {
+	// WARNING: this is not a reference client.
+	done := make(chan error, 1)
+	go func() {
+		str, err := conn.AcceptUniStream(ctx)
+		if err == nil {
+			_, err = io.Copy(io.Discard, str)
+		}
+		done <- err
+	}()
+	err := readQUICControl(ctrl)
+	if err2 := <-done; err == nil {
+		err = err2
+	}
+	return err
+}
+
+func simpleQUICUpload(ctx context.Context, t *testing.T, conn quic.Connection, ctrl quic.Stream) error {
+	// WARNING: this is not a reference client.
+	str, err := conn.OpenUniStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- readQUICControl(ctrl)
+	}()
+	buf := make([]byte, 1<<13)
+	for {
+		select {
+		case err := <-done:
+			str.Close()
+			return err
+		default:
+		}
+		if _, err := str.Write(buf); err != nil {
+			return <-done
+		}
+	}
+}
+
+func TestHTTPSubtests(t *testing.T) {
+	tests := []struct {
+		name             string
+		http3            bool
+		path             string
+		wantTrailer      bool
+		wantMeasurements bool
+		glob             string
+	}{
+		{
+			name:             "h2-download",
+			path:             spec.HTTPDownloadURLPath,
+			wantTrailer:      true,
+			wantMeasurements: true,
+			glob:             ndt7Results,
+		},
+		{
+			name: "h2-upload",
+			path: spec.HTTPUploadURLPath,
+			glob: ndt7Results,
+		},
+		{
+			name:             "h3-download",
+			http3:            true,
+			path:             spec.HTTPDownloadURLPath,
+			wantMeasurements: true,
+			glob:             ndtQUICResults,
+		},
+		{
+			name:  "h3-upload",
+			http3: true,
+			path:  spec.HTTPUploadURLPath,
+			glob:  ndtQUICResults,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			// Create the ndt7test server.
+			var (
+				dataDir string
+				URL     string
+				client  *http.Client
+			)
+			if tt.http3 {
+				q := newQUICTest(t)
+				defer q.Close()
+				dataDir, URL, client = q.h.DataDir, q.URL(""), &http.Client{Transport: q.rt}
+			} else {
+				h, srv := NewNDT7TLSServer(t)
+				defer os.RemoveAll(h.DataDir)
+				defer srv.Close()
+				dataDir, URL, client = h.DataDir, srv.URL, srv.Client()
+				defer client.CloseIdleConnections()
+			}
+
+			// Run the subtest with a minimal client.
+			ctx, cancel := context.WithTimeout(context.Background(), testRuntime+2*time.Second)
+			defer cancel()
+			method, body := http.MethodGet, io.Reader(nil)
+			if tt.path == spec.HTTPUploadURLPath {
+				// Send bulk data until the response is over.
+				pr, pw := io.Pipe()
+				defer pr.Close()
+				go func() {
+					buf := make([]byte, 1<<13)
+					for {
+						if _, err := pw.Write(buf); err != nil {
+							return
+						}
+					}
+				}()
+				method, body = http.MethodPost, pr
+			}
+			req, err := http.NewRequestWithContext(ctx, method, URL+withRuntime(tt.path), body)
+			testingx.Must(t, err, "failed to create request")
+			resp, err := client.Do(req)
+			testingx.Must(t, err, "failed to send request")
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			wantMajor := 2
+			if tt.http3 {
+				wantMajor = 3
+			}
+			if resp.ProtoMajor != wantMajor {
+				t.Errorf("got HTTP/%d, want HTTP/%d", resp.ProtoMajor, wantMajor)
+			}
+			// Read the measurements of downloads in parallel.
+			measurements := make(chan int, 1)
+			if tt.wantMeasurements {
+				id := resp.Header.Get(spec.MeasurementsIDHeader)
+				go func() {
+					n, err := readHTTPMeasurements(ctx, client, URL, id)
+					if err != nil {
+						t.Errorf("failed to read measurements: %v", err)
+					}
+					measurements <- n
+				}()
+			}
+			n, err := io.Copy(io.Discard, resp.Body)
+			testingx.Must(t, err, "failed to read response body")
+			if n == 0 {
+				t.Errorf("got an empty response body")
+			}
+			if got := resp.Trailer.Get(spec.MeasurementTrailer); tt.wantTrailer && got == "" {
+				t.Errorf("missing %s trailer", spec.MeasurementTrailer)
+			}
+			if tt.wantMeasurements {
+				if n := <-measurements; n == 0 {
+					t.Errorf("received no measurements")
+				}
+			}
+
+			// Verify that the server saves the result in time.
+			waitForResults(ctx, t, dataDir, tt.glob, 1)
+		})
+	}
+}
+
+// readHTTPMeasurements reads the measurements of the download subtest with the
+// given measurements ID from the server at URL, until the subtest ends, and
+// returns their number.
+func readHTTPMeasurements(ctx context.Context, client *http.Client, URL, id string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, URL+spec.HTTPMeasurementsURLPath+"?id="+id, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	n := 0
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var m model.Measurement
+		if err := dec.Decode(&m); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+func TestNDTQUICServer_Datagram(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// Create the ndt7test server.
+	q := newQUICTest(t)
+	defer q.Close()
+
+	// Exchange datagrams until the server ends the subtest.
+	ctx, cancel := context.WithTimeout(context.Background(), testRuntime+2*time.Second)
+	defer cancel()
+	rsp, sess := q.dial(ctx, t, withRuntime(spec.DatagramURLPath+"?datagram_rate=100"))
+	last, n := exchangeWebTransportDatagrams(ctx, t, sess, q.datagrams(t, rsp))
+	sess.Close()
+	if last == nil || last.Sent == 0 || last.Received == 0 {
+		t.Errorf("got DatagramInfo %+v, want sent and received datagrams", last)
+	}
+	if n == 0 {
+		t.Errorf("received no datagrams from the server")
+	}
+
+	// Verify that the server saves the result in time.
+	waitForResults(ctx, t, q.h.DataDir, "/ndtquic/*/*/*/ndtquic-datagram-*.json.gz", 1)
+}
+
+func TestNDTQUICServer_DatagramSessionsOnOneConnection(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// Create the ndt7test server.
+	q := newQUICTest(t)
+	defer q.Close()
+
+	// Run two datagram subtests back to back. The datagrams of the second
+	// session must not be received by the reader of the first one.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*testRuntime+4*time.Second)
+	defer cancel()
+	var infos []*model.DatagramInfo
+	for i := 0; i < 2; i++ {
+		rsp, sess := q.dial(ctx, t, withRuntime(spec.DatagramURLPath+"?datagram_rate=100"))
+		last, _ := exchangeWebTransportDatagrams(ctx, t, sess, q.datagrams(t, rsp))
+		sess.Close()
+		infos = append(infos, last)
+	}
+	q.mu.Lock()
+	dials := q.dials
+	q.mu.Unlock()
+	if dials != 1 {
+		t.Fatalf("got %d connections, want the sessions to share one", dials)
+	}
+	for i, last := range infos {
+		if last == nil || last.Received == 0 || last.Lost != 0 {
+			t.Errorf("session %d: got DatagramInfo %+v, want received and no lost datagrams", i, last)
+		}
+	}
+}
+
+// exchangeWebTransportDatagrams sends sequenced datagrams on dc, and receives
+// those of the server, until the server closes the control stream of sess. It
+// closes dc, and returns the last DatagramInfo of the server together with
+// the number of datagrams received from the server.
+func exchangeWebTransportDatagrams(ctx context.Context, t *testing.T, sess *webtransport.Session, dc quicx.DatagramConn) (*model.DatagramInfo, int) {
+	received := make(chan int, 1)
+	go func() {
+		n := 0
+		defer func() { received <- n }()
+		for {
+			b, err := dc.ReceiveDatagram()
+			if err != nil {
+				return
+			}
+			if _, err := model.ParseDatagramHeader(b); err == nil {
+				n++
+			}
+		}
+	}()
+	sendctx, stop := context.WithCancel(ctx)
+	defer stop()
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		buf := make([]byte, spec.DefaultDatagramSize)
+		start := time.Now()
+		for seq := uint64(0); sendctx.Err() == nil; seq++ {
+			h := model.DatagramHeader{Seq: seq, Timestamp: int64(time.Since(start) / time.Microsecond)}
+			h.Marshal(buf)
+			if dc.SendDatagram(sendctx, buf) != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	// Read the measurements until the server closes the control stream.
+	ctrl, err := sess.AcceptStream(ctx)
+	testingx.Must(t, err, "failed to accept the control stream")
+	var last *model.DatagramInfo
+	scanner := bufio.NewScanner(ctrl)
+	scanner.Buffer(nil, spec.MaxMessageSize+1)
+	for scanner.Scan() {
+		var m model.Measurement
+		if json.Unmarshal(scanner.Bytes(), &m) == nil && m.DatagramInfo != nil {
+			last = m.DatagramInfo
+		}
+	}
+	testingx.Must(t, scanner.Err(), "failed to read the control stream")
+	stop()
+	<-sent
+	ctrl.Close()
+	dc.Close()
+	return last, <-received
+}
+
+func TestNDTQUICServer_BulkDatagramDownload(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// Create the ndt7test server.
+	q := newQUICTest(t)
+	defer q.Close()
+
+	// Receive the datagrams of the download.
+	ctx, cancel := context.WithTimeout(context.Background(), testRuntime+2*time.Second)
+	defer cancel()
+	rsp, sess := q.dial(ctx, t, withRuntime(spec.DownloadURLPath+"?bulk=datagram"))
+	dc := q.datagrams(t, rsp)
+	defer dc.Close()
+	var received int64
+	var mu sync.Mutex
+	go func() {
+		for {
+			b, err := dc.ReceiveDatagram()
+			if err != nil {
+				return
+			}
+			if _, err := model.ParseDatagramHeader(b); err == nil {
+				mu.Lock()
+				received++
+				mu.Unlock()
+			}
+		}
+	}()
+
+	// Report the received datagrams until the server closes the control
+	// stream, while reading its measurements.
+	ctrl, err := sess.AcceptStream(ctx)
+	testingx.Must(t, err, "failed to accept the control stream")
+	reportctx, stop := context.WithCancel(ctx)
+	defer stop()
+	start := time.Now()
+	go func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-reportctx.Done():
+				return
+			case <-ticker.C:
+			}
+			mu.Lock()
+			m := model.Measurement{DatagramInfo: &model.DatagramInfo{
+				Received:    received,
+				ElapsedTime: int64(time.Since(start) / time.Microsecond),
+			}}
+			mu.Unlock()
+			if json.NewEncoder(ctrl).Encode(m) != nil {
+				return
+			}
+		}
+	}()
+	scanner := bufio.NewScanner(ctrl)
+	scanner.Buffer(nil, spec.MaxMessageSize+1)
+	for scanner.Scan() {
+	}
+	testingx.Must(t, scanner.Err(), "failed to read the control stream")
+	stop()
+	ctrl.Close()
+
+	// Verify that the server saves the result in time, and that it reports
+	// the delivered datagrams.
+	files := waitForResults(ctx, t, q.h.DataDir, "/ndtquic/*/*/*/ndtquic-download-*.json.gz", 1)
+	sess.Close()
+	result := readQUICResult(t, files[0])
+	if result.Download == nil || result.Download.DatagramThroughput == nil {
+		t.Fatalf("got result %+v, want DatagramThroughput", result.Download)
+	}
+	dt := result.Download.DatagramThroughput
+	if dt.Size != spec.MaxDatagramSize || dt.Sent == 0 || dt.Delivered == 0 || dt.DeliveredMbps == 0 {
+		t.Errorf("got DatagramThroughput %+v, want sent and delivered datagrams", dt)
+	}
+	if dt.Delivered > dt.Sent {
+		t.Errorf("got DatagramThroughput %+v, want at most the sent datagrams delivered", dt)
+	}
+}
+
+// deafPacketConn is a net.PacketConn that discards the packets it receives
+// once deaf is closed, like a peer that stops reading.
+type deafPacketConn struct {
+	net.PacketConn
+	deaf chan struct{}
+}
+
+func (c *deafPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		select {
+		case <-c.deaf:
+			if err == nil {
+				continue
+			}
+		default:
+		}
+		return n, addr, err
+	}
+}
+
+func TestNDTQUICServer_BulkDatagramDownloadDeafClient(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// Create the ndt7test server.
+	q := newQUICTest(t)
+	defer q.Close()
+
+	// The client stops reading packets once the download starts, hence
+	// acknowledging them, so that the server cannot send more datagrams.
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	testingx.Must(t, err, "failed to allocate a udp socket")
+	defer pconn.Close()
+	deaf := &deafPacketConn{PacketConn: pconn, deaf: make(chan struct{})}
+	q.rt.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return quic.DialEarlyContext(ctx, deaf, raddr, addr, tlsCfg, cfg)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testMaxRuntime+2*time.Second)
+	defer cancel()
+	_, sess := q.dial(ctx, t, withRuntime(spec.DownloadURLPath+"?bulk=datagram"))
+	_, err = sess.AcceptStream(ctx)
+	testingx.Must(t, err, "failed to accept the control stream")
+	close(deaf.deaf)
+
+	// Verify that the server still completes the subtest and saves the
+	// result in time.
+	waitForResults(ctx, t, q.h.DataDir, ndtQUICResults, 1)
+}
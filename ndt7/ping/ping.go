@@ -1,4 +1,5 @@
-// Package ping implements WebSocket PING messages.
+// Package ping implements WebSocket PING messages, and their equivalent on
+// the control stream of WebTransport sessions.
 package ping
 
 import (
@@ -6,7 +7,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/marten-seemann/webtransport-go"
+	"github.com/m-lab/ndt-server/quicx"
 )
 
 // SendTicks sends the current ticks as a ping message.
@@ -21,20 +22,29 @@ func SendTicks(conn *websocket.Conn, deadline time.Time) error {
 	return err
 }
 
-// SendTicks sends the current ticks as a ping message.
-func SendTicksWebTransport(conn *webtransport.Session, deadline time.Time) error {
+// Message is a ping or pong message sent on the control stream of WebTransport
+// sessions, which have no equivalent of WebSocket control messages. The server
+// sends {"Ping": <ticks>} and the client replies with {"Pong": <ticks>}.
+type Message struct {
+	Ping json.RawMessage `json:",omitempty"`
+	Pong json.RawMessage `json:",omitempty"`
+}
+
+// SendTicksWebTransport sends the current ticks as a ping message on the
+// control stream ctrl. The write deadline of ctrl applies.
+func SendTicksWebTransport(ctrl quicx.SendStream) error {
 	// TODO(bassosimone): when we'll have a unique base time.Time reference for
 	// the whole test, we should use that, since UnixNano() is not monotonic.
-	// ticks := int64(time.Now().UnixNano())
-	// data, err := json.Marshal(ticks)
-	// if err == nil {
-		// TODO: send pings
-		// err = sess.WriteControl(websocket.PingMessage, data, deadline)
-	// }
-	// return err
-	return nil
+	ticks := int64(time.Now().UnixNano())
+	data, err := json.Marshal(ticks)
+	if err == nil {
+		err = json.NewEncoder(ctrl).Encode(Message{Ping: data})
+	}
+	return err
 }
 
+// ParseTicks parses the ticks contained in a pong message and returns the
+// time elapsed since they were sent, in nanoseconds.
 func ParseTicks(s string) (d int64, err error) {
 	// TODO(bassosimone): when we'll have a unique base time.Time reference for
 	// the whole test, we should use that, since UnixNano() is not monotonic.
@@ -3,20 +3,25 @@
 package receiver
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt7/budget"
 	"github.com/m-lab/ndt-server/ndt7/measurer"
 	ndt7metrics "github.com/m-lab/ndt-server/ndt7/metrics"
 	"github.com/m-lab/ndt-server/ndt7/model"
 	"github.com/m-lab/ndt-server/ndt7/ping"
 	"github.com/m-lab/ndt-server/ndt7/spec"
-	"github.com/marten-seemann/webtransport-go"
+	"github.com/m-lab/ndt-server/quicx"
 )
 
 type receiverKind int
@@ -24,19 +29,57 @@ type receiverKind int
 const (
 	downloadReceiver = receiverKind(iota)
 	uploadReceiver
+	datagramReceiver
+	concurrentDownloadReceiver
+	bidirectionalReceiver
 )
 
+// saveRTT saves the given application-level RTT, measured in nanoseconds.
+func saveRTT(data *model.ArchivalData, rtt int64) {
+	logging.Logger.Debugf("receiver: ApplicationLevel RTT: %d ms", rtt/int64(time.Millisecond))
+	data.AppRTTSamples = append(data.AppRTTSamples, model.RTTSample{
+		RTT:  rtt / int64(time.Microsecond),
+		Time: time.Now().UTC(),
+	})
+}
+
+// errNoDeadline is returned by receiverDeadline for contexts without deadline.
+var errNoDeadline = errors.New("receiver: context without deadline")
+
+// receiverDeadline returns the time after which a receiver gives up, i.e. the
+// deadline of ctx, which the handler sets according to the maximum runtime
+// negotiated for the subtest. It fails if ctx has no deadline, since the
+// receiver would not be time bounded.
+func receiverDeadline(ctx context.Context) (time.Time, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return time.Time{}, errNoDeadline
+	}
+	return deadline, nil
+}
+
+// start runs the receiver of WebSocket subtests. For bidirectional subtests,
+// data is the archival data of the download and up that of the upload, where
+// the client measurements are saved according to their Test field, while
+// application-level RTT samples are saved in both. Otherwise, up is nil.
 func start(
 	ctx context.Context, conn *websocket.Conn, kind receiverKind,
-	data *model.ArchivalData,
+	data, up *model.ArchivalData, mr *measurer.Measurer, b *budget.Budget,
 ) {
 	logging.Logger.Debug("receiver: start")
 	proto := ndt7metrics.ConnLabel(conn)
 	defer logging.Logger.Debug("receiver: stop")
 	conn.SetReadLimit(spec.MaxMessageSize)
-	receiverctx, cancel := context.WithTimeout(ctx, spec.MaxRuntime)
+	deadline, err := receiverDeadline(ctx)
+	if err != nil {
+		logging.Logger.WithError(err).Warn("receiver: receiverDeadline failed")
+		ndt7metrics.ClientReceiverErrors.WithLabelValues(
+			proto, fmt.Sprint(kind), "no-deadline").Inc()
+		return
+	}
+	receiverctx, cancel := context.WithDeadline(ctx, deadline)
 	defer cancel()
-	err := conn.SetReadDeadline(time.Now().Add(spec.MaxRuntime)) // Liveness!
+	err = conn.SetReadDeadline(deadline) // Liveness!
 	if err != nil {
 		logging.Logger.WithError(err).Warn("receiver: conn.SetReadDeadline failed")
 		ndt7metrics.ClientReceiverErrors.WithLabelValues(
@@ -46,8 +89,10 @@ func start(
 	conn.SetPongHandler(func(s string) error {
 		rtt, err := ping.ParseTicks(s)
 		if err == nil {
-			rtt /= int64(time.Millisecond)
-			logging.Logger.Debugf("receiver: ApplicationLevel RTT: %d ms", rtt)
+			saveRTT(data, rtt)
+			if up != nil {
+				saveRTT(up, rtt)
+			}
 		} else {
 			ndt7metrics.ClientReceiverErrors.WithLabelValues(
 				proto, fmt.Sprint(kind), "ping-parse-ticks").Inc()
@@ -71,7 +116,19 @@ func start(
 					proto, fmt.Sprint(kind), "wrong-message-type").Inc()
 				return // Unexpected message type
 			default:
-				// NOTE: this is the bulk upload path. In this case, the mdata is not used.
+				// NOTE: this is the bulk upload path. In this case, the mdata is
+				// not used, but we read it to count the received bytes.
+				n, err := io.Copy(ioutil.Discard, r)
+				mr.AddBytes(n)
+				// Once the budget is exhausted, the sender starts
+				// closing and we keep reading until the client
+				// completes the closing handshake.
+				b.Add(n)
+				if err != nil {
+					ndt7metrics.ClientReceiverErrors.WithLabelValues(
+						proto, fmt.Sprint(kind), "read-message").Inc()
+					return
+				}
 				continue // No further processing required
 			}
 		}
@@ -90,95 +147,163 @@ func start(
 				proto, fmt.Sprint(kind), "unmarshal-client-message").Inc()
 			return
 		}
-		data.ClientMeasurements = append(data.ClientMeasurements, measurement)
+		dst := data
+		if up != nil && measurement.Test == string(spec.SubtestUpload) {
+			dst = up
+		}
+		dst.ClientMeasurements = append(dst.ClientMeasurements, measurement)
 	}
 	ndt7metrics.ClientReceiverErrors.WithLabelValues(
 		proto, fmt.Sprint(kind), "receiver-context-expired").Inc()
 }
 
+// startWebTransport is like start but for ndtQUIC sessions, i.e. WebTransport
+// sessions or raw QUIC connections. Client
+// measurements are read from the ctrl stream, while bulk upload data is read
+// from the unidirectional streams opened by the client.
 func startWebTransport(
-	ctx context.Context, sess *webtransport.Session, kind receiverKind,
-	data *model.ArchivalData, mr *measurer.WebTransportMeasurer,
+	ctx context.Context, sess quicx.Session, ctrl quicx.Stream,
+	kind receiverKind, data *model.ArchivalData, mr *measurer.WebTransportMeasurer,
+	streams int,
 ) {
 	logging.Logger.Debug("receiver: start")
-	proto := "ndt+webtransport"
+	proto := ndt7metrics.SessionLabel(sess)
 	defer logging.Logger.Debug("receiver: stop")
-	// sess.SetReadLimit(spec.MaxMessageSize)
-	receiverctx, cancel := context.WithTimeout(ctx, spec.MaxRuntime)
+	deadline, err := receiverDeadline(ctx)
+	if err != nil {
+		logging.Logger.WithError(err).Warn("receiver: receiverDeadline failed")
+		ndt7metrics.ClientReceiverErrors.WithLabelValues(
+			proto, fmt.Sprint(kind), "no-deadline").Inc()
+		return
+	}
+	receiverctx, cancel := context.WithDeadline(ctx, deadline)
 	defer cancel()
-	// TODO: liveness
-	// err := sess.SetReadDeadline(time.Now().Add(spec.MaxRuntime)) // Liveness!
-	// if err != nil {
-	// 	logging.Logger.WithError(err).Warn("receiver: conn.SetReadDeadline failed")
-	// 	ndt7metrics.ClientReceiverErrors.WithLabelValues(
-	// 		proto, fmt.Sprint(kind), "set-read-deadline").Inc()
-	// 	return
-	// }
-	
-	// TODO: ping-ping for app-level rtt
-	// sess.SetPongHandler(func(s string) error {
-	// 	rtt, err := ping.ParseTicks(s)
-	// 	if err == nil {
-	// 		rtt /= int64(time.Millisecond)
-	// 		logging.Logger.Debugf("receiver: ApplicationLevel RTT: %d ms", rtt)
-	// 	} else {
-	// 		ndt7metrics.ClientReceiverErrors.WithLabelValues(
-	// 			proto, fmt.Sprint(kind), "ping-parse-ticks").Inc()
-	// 	}
-	// 	return err
-	// })
+	err = ctrl.SetReadDeadline(deadline) // Liveness!
+	if err != nil {
+		logging.Logger.WithError(err).Warn("receiver: ctrl.SetReadDeadline failed")
+		ndt7metrics.ClientReceiverErrors.WithLabelValues(
+			proto, fmt.Sprint(kind), "set-read-deadline").Inc()
+		return
+	}
+	if kind != concurrentDownloadReceiver {
+		// Otherwise, the streams are accepted by the concurrent upload.
+		go acceptUniStreams(receiverctx, sess, kind, mr, streams)
+	}
+	go func() {
+		// Unblock reads from ctrl as soon as receiverctx is done.
+		<-receiverctx.Done()
+		ctrl.SetReadDeadline(time.Now())
+	}()
+	scanner := newControlScanner(ctrl)
 	for receiverctx.Err() == nil { // Liveness!
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+		if !scanner.Scan() {
+			err := scanner.Err()
+			switch {
+			case err == nil:
+				ndt7metrics.ClientReceiverErrors.WithLabelValues(
+					proto, fmt.Sprint(kind), "ctrl-closed").Inc()
+			case errors.Is(err, bufio.ErrTooLong):
+				logging.Logger.Warn("receiver: client message too big")
+				ndt7metrics.ClientReceiverErrors.WithLabelValues(
+					proto, fmt.Sprint(kind), "message-too-big").Inc()
+			default:
+				ndt7metrics.ClientReceiverErrors.WithLabelValues(
+					proto, fmt.Sprint(kind), "read-message").Inc()
+			}
+			return
+		}
+		if label, err := saveControlMessage(scanner.Bytes(), data); err != nil {
+			logging.Logger.WithError(err).Warn("receiver: saveControlMessage failed")
+			ndt7metrics.ClientReceiverErrors.WithLabelValues(
+				proto, fmt.Sprint(kind), label).Inc()
+			return
+		}
+	}
+	ndt7metrics.ClientReceiverErrors.WithLabelValues(
+		proto, fmt.Sprint(kind), "receiver-context-expired").Inc()
+}
+
+// newControlScanner returns a scanner splitting the newline-delimited messages
+// sent by the client on the control stream. Like WebSocket messages, messages
+// cannot be longer than spec.MaxMessageSize.
+func newControlScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	// The extra byte accounts for the newline delimiter.
+	scanner.Buffer(make([]byte, 0, 1<<13), spec.MaxMessageSize+1)
+	return scanner
+}
+
+// saveControlMessage saves the content of a message sent by the client on the
+// control stream, i.e. either a pong message or a measurement, into data. Empty
+// messages are ignored. On failure, it also returns the metrics error label.
+func saveControlMessage(msg []byte, data *model.ArchivalData) (string, error) {
+	if len(bytes.TrimSpace(msg)) == 0 {
+		return "", nil
+	}
+	var pong ping.Message
+	err := json.Unmarshal(msg, &pong)
+	if err == nil && len(pong.Pong) > 0 {
+		rtt, err := ping.ParseTicks(string(pong.Pong))
+		if err != nil {
+			return "ping-parse-ticks", err
+		}
+		saveRTT(data, rtt)
+		return "", nil
+	}
+	var measurement model.Measurement
+	err = json.Unmarshal(msg, &measurement)
+	if err != nil {
+		return "unmarshal-client-message", err
+	}
+	data.ClientMeasurements = append(data.ClientMeasurements, measurement)
+	return "", nil
+}
 
+// acceptUniStreams accepts the unidirectional streams opened by the client
+// until ctx expires. During uploads, each of the first streams streams is
+// drained in a background goroutine and the received bytes are counted by mr,
+// while the other streams are rejected. During other subtests, the client must
+// not send bulk data, so the session is closed.
+func acceptUniStreams(ctx context.Context, sess quicx.Session, kind receiverKind, mr *measurer.WebTransportMeasurer, streams int) {
+	for accepted := 0; ; accepted++ {
 		str, err := sess.AcceptUniStream(ctx)
-		if err != nil {	
-			ndt7metrics.ClientReceiverErrors.WithLabelValues(
-				proto, fmt.Sprint(kind), "read-message-type").Inc()
+		if err != nil {
 			return
 		}
-		str.SetReadDeadline(time.Now().Add(spec.MaxRuntime));
-
-		// if mtype != websocket.TextMessage {
-		// 	switch kind {
-		// 	case downloadReceiver:
-		// 		logging.Logger.Warn("receiver: got non-Text message")
-		// 		ndt7metrics.ClientReceiverErrors.WithLabelValues(
-		// 			proto, fmt.Sprint(kind), "wrong-message-type").Inc()
-		// 		return // Unexpected message type
-		// 	default:
-		// 		// NOTE: this is the bulk upload path. In this case, the mdata is not used.
-		// 		continue // No further processing required
-		// 	}
-		// }
-		// This is a TextMessage, so we must read it.
-		// mdata, err := ioutil.ReadAll(r)
-		// mdata, err := io.ReadAll(str)
-		var buf [100000]byte
-		var n int
-		err = nil
-		for err == nil {
-			n, err = str.Read(buf[:])
-			mr.BytesReceived += uint64(n)
+		if kind != uploadReceiver {
+			logging.Logger.Warn("receiver: got unexpected stream")
+			sess.Close()
+			return
 		}
+		if accepted >= streams {
+			logging.Logger.Warn("receiver: too many streams")
+			str.CancelRead()
+			continue
+		}
+		// The ctx argument is the receiver context, which has a deadline.
+		deadline, _ := ctx.Deadline()
+		go drainUniStream(str, mr.NewStreamCounter(), deadline)
+	}
+}
 
+// drainUniStream reads and discards the content of str, counting the bytes.
+//
+// Liveness guarantee: the goroutine will always terminate after the given
+// deadline.
+func drainUniStream(str quicx.ReceiveStream, c *measurer.StreamCounter, deadline time.Time) {
+	if err := str.SetReadDeadline(deadline); err != nil {
+		logging.Logger.WithError(err).Warn("receiver: str.SetReadDeadline failed")
+		str.CancelRead()
+		return
+	}
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := str.Read(buf)
+		c.AddBytes(int64(n))
 		if err != nil {
-			ndt7metrics.ClientReceiverErrors.WithLabelValues(
-				proto, fmt.Sprint(kind), "read-message").Inc()
 			return
 		}
-		// var measurement model.Measurement
-		// err = json.Unmarshal(mdata, &measurement)
-		// if err != nil {
-		// 	logging.Logger.WithError(err).Warn("receiver: json.Unmarshal failed")
-		// 	ndt7metrics.ClientReceiverErrors.WithLabelValues(
-		// 		proto, fmt.Sprint(kind), "unmarshal-client-message").Inc()
-		// 	return
-		// }
-		// data.ClientMeasurements = append(data.ClientMeasurements, measurement)
 	}
-	ndt7metrics.ClientReceiverErrors.WithLabelValues(
-		proto, fmt.Sprint(kind), "receiver-context-expired").Inc()
 }
 
 // StartDownloadReceiverAsync starts the receiver in a background goroutine and
@@ -188,12 +313,12 @@ func startWebTransport(
 // This receiver will not tolerate receiving binary messages. It will terminate
 // early if such a message is received.
 //
-// Liveness guarantee: the goroutine will always terminate after a MaxRuntime
-// timeout.
-func StartDownloadReceiverAsync(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData) context.Context {
+// Liveness guarantee: the goroutine will always terminate after the deadline
+// of ctx, which is required.
+func StartDownloadReceiverAsync(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData, mr *measurer.Measurer) context.Context {
 	ctx2, cancel2 := context.WithCancel(ctx)
 	go func() {
-		start(ctx2, conn, downloadReceiver, data)
+		start(ctx2, conn, downloadReceiver, data, nil, mr, nil)
 		cancel2()
 	}()
 	return ctx2
@@ -201,43 +326,138 @@ func StartDownloadReceiverAsync(ctx context.Context, conn *websocket.Conn, data
 
 // StartUploadReceiverAsync is like StartDownloadReceiverAsync except that it
 // tolerates incoming binary messages, sent by "upload" measurement clients to
-// create network load, and therefore must be allowed.
-func StartUploadReceiverAsync(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData) context.Context {
+// create network load, and therefore must be allowed. The bytes of the binary
+// messages are counted by mr and by the budget b, if any.
+func StartUploadReceiverAsync(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData, mr *measurer.Measurer, b *budget.Budget) context.Context {
 	ctx2, cancel2 := context.WithCancel(ctx)
 	go func() {
-		start(ctx2, conn, uploadReceiver, data)
+		start(ctx2, conn, uploadReceiver, data, nil, mr, b)
 		cancel2()
 	}()
 	return ctx2
 }
 
+// StartBidirectionalReceiverAsync is like StartUploadReceiverAsync but for
+// bidirectional subtests, where the client sends the measurements of both the
+// download and the upload, distinguished by their Test field. They are saved
+// in down and up respectively. The bytes of the binary messages are counted by
+// mr, i.e. the measurer of the upload.
+func StartBidirectionalReceiverAsync(ctx context.Context, conn *websocket.Conn, down, up *model.ArchivalData, mr *measurer.Measurer) context.Context {
+	ctx2, cancel2 := context.WithCancel(ctx)
+	go func() {
+		start(ctx2, conn, bidirectionalReceiver, down, up, mr, nil)
+		cancel2()
+	}()
+	return ctx2
+}
 
-// StartDownloadReceiverAsync starts the receiver in a background goroutine and
-// saves messages received from the client in the given archival data. The
-// returned context may be used to detect when the receiver has completed.
+// StartWebTransportDownloadReceiverAsync is like StartDownloadReceiverAsync
+// but for WebTransport sessions. Messages are read from the ctrl stream. The
+// session is closed if the client opens a unidirectional stream.
 //
-// This receiver will not tolerate receiving binary messages. It will terminate
-// early if such a message is received.
-//
-// Liveness guarantee: the goroutine will always terminate after a MaxRuntime
-// timeout.
-func StartWebTransportDownloadReceiverAsync(ctx context.Context, sess *webtransport.Session, data *model.ArchivalData, mr *measurer.WebTransportMeasurer) context.Context {
+// Liveness guarantee: the goroutine will always terminate after the deadline
+// of ctx, which is required.
+func StartWebTransportDownloadReceiverAsync(ctx context.Context, sess quicx.Session, ctrl quicx.Stream, data *model.ArchivalData, mr *measurer.WebTransportMeasurer) context.Context {
 	ctx2, cancel2 := context.WithCancel(ctx)
 	go func() {
-		startWebTransport(ctx2, sess, downloadReceiver, data, mr)
+		startWebTransport(ctx2, sess, ctrl, downloadReceiver, data, mr, 0)
 		cancel2()
 	}()
 	return ctx2
 }
 
-// StartUploadReceiverAsync is like StartDownloadReceiverAsync except that it
-// tolerates incoming binary messages, sent by "upload" measurement clients to
-// create network load, and therefore must be allowed.
-func StartWebTransportUploadReceiverAsync(ctx context.Context, sess *webtransport.Session, data *model.ArchivalData, mr *measurer.WebTransportMeasurer) context.Context {
+// StartWebTransportConcurrentDownloadReceiverAsync is like
+// StartWebTransportDownloadReceiverAsync but for downloads running at the same
+// time as an upload in the same session, whose receiver accepts the
+// unidirectional streams opened by the client.
+func StartWebTransportConcurrentDownloadReceiverAsync(ctx context.Context, sess quicx.Session, ctrl quicx.Stream, data *model.ArchivalData, mr *measurer.WebTransportMeasurer) context.Context {
+	ctx2, cancel2 := context.WithCancel(ctx)
+	go func() {
+		startWebTransport(ctx2, sess, ctrl, concurrentDownloadReceiver, data, mr, 0)
+		cancel2()
+	}()
+	return ctx2
+}
+
+// StartWebTransportUploadReceiverAsync is like
+// StartWebTransportDownloadReceiverAsync except that it reads the bulk data
+// sent by the client on up to streams unidirectional streams and counts the
+// bytes using mr.
+func StartWebTransportUploadReceiverAsync(ctx context.Context, sess quicx.Session, ctrl quicx.Stream, data *model.ArchivalData, mr *measurer.WebTransportMeasurer, streams int) context.Context {
 	ctx2, cancel2 := context.WithCancel(ctx)
 	go func() {
-		startWebTransport(ctx2, sess, uploadReceiver, data, mr)
+		startWebTransport(ctx2, sess, ctrl, uploadReceiver, data, mr, streams)
 		cancel2()
 	}()
 	return ctx2
-}
\ No newline at end of file
+}
+
+// StartWebTransportDatagramReceiverAsync is like
+// StartWebTransportDownloadReceiverAsync except that it also receives the
+// datagrams sent by the client on dc, and counts them using c.
+//
+// Liveness guarantee: the goroutine reading messages from ctrl will always
+// terminate after the deadline of ctx, which is required. The goroutine receiving datagrams
+// stops counting them when the returned context is done, and terminates once
+// the caller closes dc.
+func StartWebTransportDatagramReceiverAsync(ctx context.Context, sess quicx.Session, ctrl quicx.Stream, dc quicx.DatagramConn, data *model.ArchivalData, mr *measurer.WebTransportMeasurer, c *measurer.DatagramCounter) context.Context {
+	ctx2, cancel2 := context.WithCancel(ctx)
+	go receiveDatagrams(ctx2, ndt7metrics.SessionLabel(sess), dc, c)
+	go func() {
+		startWebTransport(ctx2, sess, ctrl, datagramReceiver, data, mr, 0)
+		cancel2()
+	}()
+	return ctx2
+}
+
+// receiveDatagrams receives the datagrams sent by the client on dc and counts
+// them using c, until ctx is done or dc is closed. Datagrams shorter than their
+// header are discarded. It must be the only reader of dc, which is the only
+// DatagramConn of the session (see quicx.WebTransportDatagrams).
+func receiveDatagrams(ctx context.Context, proto string, dc quicx.DatagramConn, c *measurer.DatagramCounter) {
+	for {
+		b, err := dc.ReceiveDatagram()
+		now := time.Now()
+		if err != nil || ctx.Err() != nil {
+			return
+		}
+		h, err := model.ParseDatagramHeader(b)
+		if err != nil {
+			ndt7metrics.ClientReceiverErrors.WithLabelValues(
+				proto, fmt.Sprint(datagramReceiver), "parse-datagram").Inc()
+			continue
+		}
+		c.AddReceived(h, now)
+	}
+}
+
+// StartHTTPUploadReceiverAsync is like StartUploadReceiverAsync but for
+// subtests over plain HTTP streams, where the client sends binary data (bulk
+// upload) in the request body, which is read until EOF and counted by mr.
+// There are no client messages. The proto argument is the protocol label used
+// in metrics.
+//
+// Liveness guarantee: the goroutine will always terminate after the deadline
+// of ctx, provided that the caller closes body after it.
+func StartHTTPUploadReceiverAsync(ctx context.Context, body io.Reader, proto string, mr measurer.Sampler) context.Context {
+	ctx2, cancel2 := context.WithCancel(ctx)
+	go func() {
+		defer cancel2()
+		logging.Logger.Debug("receiver: start")
+		defer logging.Logger.Debug("receiver: stop")
+		buf := make([]byte, 1<<16)
+		for ctx2.Err() == nil { // Liveness!
+			n, err := body.Read(buf)
+			mr.AddBytes(int64(n))
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				ndt7metrics.ClientReceiverErrors.WithLabelValues(
+					proto, fmt.Sprint(uploadReceiver), "read-body").Inc()
+				return
+			}
+		}
+	}()
+	return ctx2
+}
@@ -0,0 +1,78 @@
+package receiver
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+)
+
+func Test_newControlScanner(t *testing.T) {
+	maxMsg := strings.Repeat("x", spec.MaxMessageSize)
+	scanner := newControlScanner(strings.NewReader("{}\n" + maxMsg + "\n" + maxMsg + "x\n"))
+	if !scanner.Scan() || scanner.Text() != "{}" {
+		t.Fatalf("Scan() did not return the first message")
+	}
+	if !scanner.Scan() || len(scanner.Bytes()) != spec.MaxMessageSize {
+		t.Fatalf("Scan() did not return the message of maximum size")
+	}
+	if scanner.Scan() {
+		t.Fatalf("Scan() returned a message bigger than the maximum size")
+	}
+	if !errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		t.Errorf("Err() = %v, want %v", scanner.Err(), bufio.ErrTooLong)
+	}
+}
+
+func Test_saveControlMessage(t *testing.T) {
+	tests := []struct {
+		name             string
+		msg              string
+		wantLabel        string
+		wantMeasurements int
+		wantRTTSamples   int
+	}{
+		{
+			name:             "measurement",
+			msg:              `{"AppInfo":{"NumBytes":1,"ElapsedTime":2}}`,
+			wantMeasurements: 1,
+		},
+		{
+			name:           "pong",
+			msg:            `{"Pong":1}`,
+			wantRTTSamples: 1,
+		},
+		{
+			name: "empty",
+			msg:  " ",
+		},
+		{
+			name:      "bad-pong",
+			msg:       `{"Pong":"x"}`,
+			wantLabel: "ping-parse-ticks",
+		},
+		{
+			name:      "bad-json",
+			msg:       `{`,
+			wantLabel: "unmarshal-client-message",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := &model.ArchivalData{}
+			label, err := saveControlMessage([]byte(tt.msg), data)
+			if label != tt.wantLabel || (err != nil) != (tt.wantLabel != "") {
+				t.Errorf("saveControlMessage() = %q, %v, want %q", label, err, tt.wantLabel)
+			}
+			if len(data.ClientMeasurements) != tt.wantMeasurements {
+				t.Errorf("ClientMeasurements = %d, want %d", len(data.ClientMeasurements), tt.wantMeasurements)
+			}
+			if len(data.AppRTTSamples) != tt.wantRTTSamples {
+				t.Errorf("AppRTTSamples = %d, want %d", len(data.AppRTTSamples), tt.wantRTTSamples)
+			}
+		})
+	}
+}
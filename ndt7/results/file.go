@@ -23,16 +23,16 @@ type File struct {
 	UUID string
 }
 
-// newFile opens a measurements file in the current working
-// directory on success and returns an error on failure.
-func newFile(datadir, what, uuid string) (*File, error) {
+// newFile opens a measurements file for the proto protocol in the current
+// working directory on success and returns an error on failure.
+func newFile(datadir, proto, what, uuid, ext string) (*File, error) {
 	timestamp := time.Now().UTC()
-	dir := path.Join(datadir, "ndt7", timestamp.Format("2006/01/02"))
+	dir := path.Join(datadir, proto, timestamp.Format("2006/01/02"))
 	err := os.MkdirAll(dir, 0755)
 	if err != nil {
 		return nil, err
 	}
-	name := dir + "/ndt7-" + what + "-" + timestamp.Format("20060102T150405.000000000Z") + "." + uuid + ".json.gz"
+	name := dir + "/" + proto + "-" + what + "-" + timestamp.Format("20060102T150405.000000000Z") + "." + uuid + ext
 	// My assumption here is that we have nanosecond precision and hence it's
 	// unlikely to have conflicts. If I'm wrong, O_EXCL will let us know.
 	fp, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
@@ -56,7 +56,7 @@ func newFile(datadir, what, uuid string) (*File, error) {
 // data into and the what argument should indicate whether this is a
 // spec.SubtestDownload or a spec.SubtestUpload ndt7 measurement.
 func NewFile(uuid string, datadir string, what spec.SubtestKind) (*File, error) {
-	fp, err := newFile(datadir, string(what), uuid)
+	fp, err := newFile(datadir, "ndt7", string(what), uuid, ".json.gz")
 	if err != nil {
 		logging.Logger.WithError(err).Warn("newFile failed")
 		return nil, err
@@ -64,6 +64,73 @@ func NewFile(uuid string, datadir string, what spec.SubtestKind) (*File, error)
 	return fp, nil
 }
 
+// NewSessionFile is like NewFile, except that the file is named after a
+// multi-flow session of subtests of the given kind, where uuid is the UUID of
+// its first flow.
+func NewSessionFile(uuid string, datadir string, what spec.SubtestKind) (*File, error) {
+	fp, err := newFile(datadir, "ndt7", string(what)+"-session", uuid, ".json.gz")
+	if err != nil {
+		logging.Logger.WithError(err).Warn("newFile failed")
+		return nil, err
+	}
+	return fp, nil
+}
+
+// NewQUICFile is like NewFile, except that the file is named after the ndtQUIC
+// protocol, so that ndtQUIC results can be told apart from ndt7 ones.
+func NewQUICFile(uuid string, datadir string, what spec.SubtestKind) (*File, error) {
+	fp, err := newFile(datadir, "ndtquic", string(what), uuid, ".json.gz")
+	if err != nil {
+		logging.Logger.WithError(err).Warn("newFile failed")
+		return nil, err
+	}
+	return fp, nil
+}
+
+// QLogFile is a file where we save the qlog trace of a QUIC connection. The
+// file is written next to the results of the subtests run over the connection
+// and is named after the same UUID.
+type QLogFile struct {
+	*File
+
+	// maxBytes is the size limit of the uncompressed trace, if positive.
+	maxBytes int64
+	// written is the number of bytes of uncompressed trace written so far.
+	written int64
+
+	// Truncated is true if events have been discarded because of the size
+	// limit.
+	Truncated bool
+}
+
+// NewQLogFile creates a file for saving the qlog trace of the QUIC connection
+// with the given uuid in datadir. At most maxBytes of uncompressed trace are
+// written to the file; a non-positive maxBytes means no limit.
+func NewQLogFile(uuid string, datadir string, maxBytes int64) (*QLogFile, error) {
+	fp, err := newFile(datadir, "ndtquic", "qlog", uuid, ".qlog.gz")
+	if err != nil {
+		logging.Logger.WithError(err).Warn("newFile failed")
+		return nil, err
+	}
+	return &QLogFile{File: fp, maxBytes: maxBytes}, nil
+}
+
+// Write writes p to the trace. quic-go writes every qlog event with a single
+// call, followed by a newline. Once an event does not fit into the size limit
+// anymore, it and all the following events are silently discarded, so that the
+// trace always ends with a complete event.
+func (fp *QLogFile) Write(p []byte) (int, error) {
+	if fp.Truncated {
+		return len(p), nil
+	}
+	if fp.maxBytes > 0 && fp.written+int64(len(p)) > fp.maxBytes {
+		fp.Truncated = true
+		return len(p), nil
+	}
+	fp.written += int64(len(p))
+	return fp.Writer.Write(p)
+}
+
 // Close closes the measurement file.
 func (fp *File) Close() error {
 	err := fp.Writer.Close()
@@ -0,0 +1,51 @@
+package results
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewQLogFile(t *testing.T) {
+	dir := t.TempDir()
+	fp, err := NewQLogFile("test-uuid", dir, 10)
+	if err != nil {
+		t.Fatalf("NewQLogFile() unexpected error = %v", err)
+	}
+	for _, ev := range []string{"{}\n", "{\"a\":1}\n", "{}\n"} {
+		if n, err := fp.Write([]byte(ev)); n != len(ev) || err != nil {
+			t.Fatalf("Write() = %d, %v; want %d, nil", n, err, len(ev))
+		}
+	}
+	if !fp.Truncated {
+		t.Errorf("Truncated = false, want true")
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatalf("Close() unexpected error = %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "ndtquic", "*", "*", "*", "ndtquic-qlog-*.test-uuid.qlog.gz"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("qlog files = %v, %v; want one file", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second event does not fit, hence it and all the following ones
+	// are discarded.
+	if want := "{}\n"; string(got) != want {
+		t.Errorf("qlog content = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,213 @@
+// Package session correlates the flows of multi-flow ndt7 sessions, i.e. the
+// download or upload subtests that a client runs in parallel over several
+// connections, so that they start and stop together.
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+)
+
+var (
+	// ErrMismatch means that a flow does not agree with the other flows of
+	// its session on the subtest kind or on the number of flows.
+	ErrMismatch = errors.New("session: kind or number of flows mismatch")
+	// ErrFull means that all the flows of the session already joined.
+	ErrFull = errors.New("session: too many flows")
+	// ErrStarted means that the session started without the flow.
+	ErrStarted = errors.New("session: already started")
+	// ErrUnknown means that no session in progress has the requested ID.
+	ErrUnknown = errors.New("session: unknown session")
+)
+
+// Registry correlates the flows of the sessions in progress by session ID.
+// Its methods are safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// NewRegistry returns a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{sessions: make(map[string]*session)}
+}
+
+// session is a multi-flow session. All its fields, except ready, are
+// protected by the mutex of the registry.
+type session struct {
+	id    string
+	kind  spec.SubtestKind
+	flows int
+
+	// joined, arrived and ended are the number of flows that joined, that
+	// called Start and that ended.
+	joined  int
+	arrived int
+	ended   int
+	// ready is closed when the session starts, i.e. once all its flows
+	// called Start or after spec.FlowJoinTimeout.
+	ready   chan struct{}
+	started bool
+	// cancels stop the flows that are running. They are called, and stopped
+	// is set, once the first of them ends.
+	cancels []context.CancelFunc
+	stopped bool
+	// results are the results of the flows, in the order they joined, or
+	// nil for the flows that did not run.
+	results []*data.NDT7Result
+}
+
+// start starts s, if it is not started yet.
+func (s *session) start() {
+	if !s.started {
+		s.started = true
+		close(s.ready)
+	}
+}
+
+// Flow is a flow of a session, returned by Registry.Join.
+type Flow struct {
+	r      *Registry
+	s      *session
+	index  int
+	cancel context.CancelFunc
+}
+
+// Create creates a session running subtests of the given kind over the given
+// number of flows, and returns its first flow. The session ID is chosen at
+// random, so that only the client that created the session, which receives
+// it, may add flows to it. The caller must call End once the flow is over.
+func (r *Registry) Create(kind spec.SubtestKind, flows int) (*Flow, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	s := &session{
+		id:      hex.EncodeToString(b),
+		kind:    kind,
+		flows:   flows,
+		ready:   make(chan struct{}),
+		results: make([]*data.NDT7Result, flows),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.id] = s
+	s.joined++
+	return &Flow{r: r, s: s}, nil
+}
+
+// Join adds a flow to the session with the given ID, which runs subtests of
+// the given kind over the given number of flows. It fails if there is no such
+// session, if the session has another kind or number of flows, if all its flows
+// already joined or if it already started. The caller must call End once the
+// flow is over.
+func (r *Registry) Join(id string, kind spec.SubtestKind, flows int) (*Flow, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	switch {
+	case !ok:
+		return nil, ErrUnknown
+	case s.kind != kind || s.flows != flows:
+		return nil, ErrMismatch
+	case s.started:
+		return nil, ErrStarted
+	case s.joined == s.flows:
+		return nil, ErrFull
+	}
+	s.joined++
+	return &Flow{r: r, s: s, index: s.joined - 1}, nil
+}
+
+// SessionID returns the ID of the session of f.
+func (f *Flow) SessionID() string {
+	return f.s.id
+}
+
+// Start waits until the session starts, i.e. until all its flows called
+// Start or for at most spec.FlowJoinTimeout, so that the flows start together.
+// It fails if the session started without f, or if ctx is done first.
+func (f *Flow) Start(ctx context.Context) error {
+	s := f.s
+	f.r.mu.Lock()
+	if s.started {
+		f.r.mu.Unlock()
+		return ErrStarted
+	}
+	s.arrived++
+	if s.arrived == s.flows {
+		s.start()
+	}
+	f.r.mu.Unlock()
+
+	timer := time.NewTimer(spec.FlowJoinTimeout)
+	defer timer.Stop()
+	select {
+	case <-s.ready:
+		return nil
+	case <-timer.C:
+		f.r.mu.Lock()
+		s.start()
+		f.r.mu.Unlock()
+		return nil
+	case <-ctx.Done():
+		// The flow no longer counts towards the start of the session.
+		f.r.mu.Lock()
+		if !s.started {
+			s.arrived--
+		}
+		f.r.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Context returns a context derived from ctx that is canceled once any flow of
+// the session that called Context ends, so that the flows stop together. If a
+// flow already ended, the returned context is already canceled.
+func (f *Flow) Context(ctx context.Context) context.Context {
+	s := f.s
+	f.r.mu.Lock()
+	defer f.r.mu.Unlock()
+	ctx, f.cancel = context.WithCancel(ctx)
+	if s.stopped {
+		f.cancel()
+	}
+	s.cancels = append(s.cancels, f.cancel)
+	return ctx
+}
+
+// End ends f, whose result is the given one, or nil if f did not run. If f was
+// running, the other flows of the session are stopped. If f is the last flow
+// of the session to end, End returns the results of the flows that ran, in the
+// order they joined, and forgets the session. Otherwise, it returns nil.
+func (f *Flow) End(result *data.NDT7Result) []*data.NDT7Result {
+	s := f.s
+	f.r.mu.Lock()
+	defer f.r.mu.Unlock()
+	if f.cancel != nil && !s.stopped {
+		s.stopped = true
+		for _, cancel := range s.cancels {
+			cancel()
+		}
+	}
+	s.results[f.index] = result
+	s.ended++
+	if s.ended < s.joined {
+		return nil
+	}
+	delete(f.r.sessions, s.id)
+	var results []*data.NDT7Result
+	for _, r := range s.results {
+		if r != nil {
+			results = append(results, r)
+		}
+	}
+	return results
+}
@@ -0,0 +1,140 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+)
+
+func TestRegistry_Join(t *testing.T) {
+	r := NewRegistry()
+	if _, err := r.Join("a", spec.SubtestDownload, 2); err != ErrUnknown {
+		t.Errorf("Join() of an unknown session error = %v, want %v", err, ErrUnknown)
+	}
+	f, err := r.Create(spec.SubtestDownload, 2)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	id := f.SessionID()
+	if other, _ := r.Create(spec.SubtestDownload, 2); other.SessionID() == id {
+		t.Errorf("Create() returned the session ID %q twice", id)
+	}
+	if _, err := r.Join(id, spec.SubtestUpload, 2); err != ErrMismatch {
+		t.Errorf("Join() with another kind error = %v, want %v", err, ErrMismatch)
+	}
+	if _, err := r.Join(id, spec.SubtestDownload, 3); err != ErrMismatch {
+		t.Errorf("Join() with another number of flows error = %v, want %v", err, ErrMismatch)
+	}
+	g, err := r.Join(id, spec.SubtestDownload, 2)
+	if err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+	if _, err := r.Join(id, spec.SubtestDownload, 2); err != ErrFull {
+		t.Errorf("Join() of a third flow error = %v, want %v", err, ErrFull)
+	}
+	// Flows that did not run have no result, and the session is forgotten
+	// once all its flows end.
+	if got := f.End(nil); got != nil {
+		t.Errorf("End() of the first flow = %v, want nil", got)
+	}
+	if got := g.End(nil); got != nil {
+		t.Errorf("End() of the last flow = %v, want nil", got)
+	}
+	if _, err := r.Join(id, spec.SubtestDownload, 2); err != ErrUnknown {
+		t.Errorf("Join() of an ended session error = %v, want %v", err, ErrUnknown)
+	}
+}
+
+func TestFlow_Start(t *testing.T) {
+	r := NewRegistry()
+	first, err := r.Create(spec.SubtestUpload, 3)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	flows := []*Flow{first}
+	for i := 1; i < 3; i++ {
+		f, err := r.Join(first.SessionID(), spec.SubtestUpload, 3)
+		if err != nil {
+			t.Fatalf("Join() error = %v", err)
+		}
+		flows = append(flows, f)
+	}
+	// All the flows start together.
+	ctx := context.Background()
+	ctxs := make([]context.Context, len(flows))
+	var wg sync.WaitGroup
+	for i, f := range flows {
+		wg.Add(1)
+		go func(i int, f *Flow) {
+			defer wg.Done()
+			if err := f.Start(ctx); err != nil {
+				t.Errorf("Start() error = %v", err)
+			}
+			ctxs[i] = f.Context(ctx)
+		}(i, f)
+	}
+	wg.Wait()
+	if _, err := r.Join(first.SessionID(), spec.SubtestUpload, 3); err != ErrStarted {
+		t.Errorf("Join() after the start error = %v, want %v", err, ErrStarted)
+	}
+	// The flows stop together.
+	results := []*data.NDT7Result{{ClientPort: 1}, {ClientPort: 2}, {ClientPort: 3}}
+	if got := flows[1].End(results[1]); got != nil {
+		t.Errorf("End() = %v, want nil", got)
+	}
+	for i, ctx := range ctxs {
+		if ctx.Err() == nil {
+			t.Errorf("flow %d was not stopped", i)
+		}
+	}
+	flows[2].End(results[2])
+	got := flows[0].End(results[0])
+	if len(got) != 3 {
+		t.Fatalf("End() of the last flow = %v, want 3 results", got)
+	}
+	for i := range got {
+		if got[i] != results[i] {
+			t.Errorf("End() result %d = %+v, want %+v", i, got[i], results[i])
+		}
+	}
+}
+
+func TestFlow_Start_timeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for spec.FlowJoinTimeout")
+	}
+	r := NewRegistry()
+	f, _ := r.Create(spec.SubtestDownload, 2)
+	g, _ := r.Join(f.SessionID(), spec.SubtestDownload, 2)
+	// The session starts without the flows that are too late.
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := g.Start(context.Background()); err != ErrStarted {
+		t.Errorf("Start() of a late flow error = %v, want %v", err, ErrStarted)
+	}
+	g.End(nil)
+	result := &data.NDT7Result{}
+	if got := f.End(result); len(got) != 1 || got[0] != result {
+		t.Errorf("End() = %v, want the result of the first flow", got)
+	}
+}
+
+func TestFlow_Start_canceled(t *testing.T) {
+	r := NewRegistry()
+	f, _ := r.Create(spec.SubtestDownload, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := f.Start(ctx); err != context.Canceled {
+		t.Errorf("Start() error = %v, want %v", err, context.Canceled)
+	}
+	// The canceled flow no longer counts towards the start of the session.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f.s.arrived != 0 || f.s.started {
+		t.Errorf("got %d arrived flows and started = %v, want none and false", f.s.arrived, f.s.started)
+	}
+}
@@ -1,7 +1,10 @@
 // Package spec contains constants defined in the ndt7 specification.
 package spec
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 // DownloadURLPath selects the download subtest.
 const DownloadURLPath = "/ndt/v7/download"
@@ -9,9 +12,72 @@ const DownloadURLPath = "/ndt/v7/download"
 // UploadURLPath selects the upload subtest.
 const UploadURLPath = "/ndt/v7/upload"
 
+// HTTPDownloadURLPath selects the download subtest over plain HTTP/2 or HTTP/3
+// streams, i.e. without WebSocket or WebTransport.
+const HTTPDownloadURLPath = "/ndt/v7/http/download"
+
+// HTTPUploadURLPath selects the upload subtest over plain HTTP/2 or HTTP/3
+// streams, i.e. without WebSocket or WebTransport.
+const HTTPUploadURLPath = "/ndt/v7/http/upload"
+
+// HTTPMeasurementsURLPath streams the measurements of a download subtest over
+// plain HTTP streams, whose ID is in the MeasurementsIDHeader of the download
+// response.
+const HTTPMeasurementsURLPath = "/ndt/v7/http/measurements"
+
+// DatagramURLPath selects the datagram subtest, which is only available over
+// WebTransport.
+const DatagramURLPath = "/ndt/v7/datagram"
+
+// CombinedURLPath selects the combined subtest, which runs the download and
+// upload subtests in the same WebTransport session.
+const CombinedURLPath = "/ndt/v7/combined"
+
+// BidirectionalURLPath selects the bidirectional subtest, which runs the
+// download and upload subtests at the same time on the same WebSocket
+// connection.
+const BidirectionalURLPath = "/ndt/v7/bidirectional"
+
+// DiscoveryURLPath returns the URLs of the tests offered by the server.
+const DiscoveryURLPath = "/ndt/v7/discovery"
+
+// MeasurementTrailer is the HTTP trailer carrying the last server measurement
+// of download subtests over plain HTTP streams.
+const MeasurementTrailer = "Ndt7-Measurement"
+
+// MeasurementsIDHeader is the header of the response to download subtests over
+// plain HTTP streams, which contains the ID of their measurements, to be read
+// from HTTPMeasurementsURLPath.
+const MeasurementsIDHeader = "Ndt7-Measurements-Id"
+
 // SecWebSocketProtocol is the WebSocket subprotocol used by ndt7.
 const SecWebSocketProtocol = "net.measurementlab.ndt.v7"
 
+// SessionIDHeader is the header of the WebSocket handshake response to the
+// first flow of a multi-flow session, which contains the ID of the session.
+const SessionIDHeader = "Ndt7-Session-Id"
+
+// QUICALPN is the ALPN protocol identifier of ndt7 over raw QUIC connections,
+// i.e. without HTTP/3 and WebTransport.
+const QUICALPN = "ndt7-quic"
+
+// MaxQUICRequestSize is the maximum size of the request line sent by clients
+// over raw QUIC connections, including the trailing newline.
+const MaxQUICRequestSize = 1 << 12
+
+// Application error codes used by the server to close raw QUIC connections,
+// or to reset the request stream of WebTransport sessions.
+const (
+	// QUICErrorNone means that the subtest is over.
+	QUICErrorNone = 0x0
+	// QUICErrorBadRequest means that the request of the client is invalid.
+	QUICErrorBadRequest = 0x1
+	// QUICErrorUnavailable means that the server is shutting down.
+	QUICErrorUnavailable = 0x2
+	// QUICErrorTimeout means that the subtest exceeded its maximum runtime.
+	QUICErrorTimeout = 0x3
+)
+
 // MaxMessageSize is the minimum value of the maximum message size
 // that an implementation MAY want to configure. Messages smaller than this
 // threshold MUST always be accepted by an implementation.
@@ -55,6 +121,241 @@ const DefaultRuntime = 10 * time.Second
 // MaxRuntime is the maximum runtime of a subtest
 const MaxRuntime = 15 * time.Second
 
+// RuntimeGrace is the time during which a subtest may keep running after its
+// runtime, e.g. to complete the closing handshake. The maximum runtime of a
+// subtest is its runtime plus RuntimeGrace.
+const RuntimeGrace = MaxRuntime - DefaultRuntime
+
+// MinRuntime is the minimum runtime that a client may request.
+const MinRuntime = 1 * time.Second
+
+// MaxSamplingInterval is the maximum average sampling interval that a client
+// may request.
+const MaxSamplingInterval = 1 * time.Second
+
+// PoissonSamplingBounds returns the min and max intervals of a lambda
+// distribution of the given average, which keep the ratios of
+// MinPoissonSamplingInterval and MaxPoissonSamplingInterval to
+// AveragePoissonSamplingInterval.
+func PoissonSamplingBounds(average time.Duration) (min, max time.Duration) {
+	min = average * MinPoissonSamplingInterval / AveragePoissonSamplingInterval
+	max = average * MaxPoissonSamplingInterval / AveragePoissonSamplingInterval
+	return min, max
+}
+
+// Limits are the defaults and bounds of the runtime and of the sampling
+// interval of subtests, which are configured by the server operator.
+type Limits struct {
+	// Runtime is the runtime of subtests whose client does not request one.
+	Runtime time.Duration
+	// MaxRuntime is the maximum runtime that a client may request.
+	MaxRuntime time.Duration
+	// SamplingInterval is the average sampling interval of subtests whose
+	// client does not request one.
+	SamplingInterval time.Duration
+	// MinSamplingInterval is the minimum average sampling interval that a
+	// client may request.
+	MinSamplingInterval time.Duration
+}
+
+// DefaultLimits are the limits used unless the operator configures others.
+// Clients may only request shorter runtimes and longer sampling intervals.
+var DefaultLimits = Limits{
+	Runtime:             DefaultRuntime,
+	MaxRuntime:          DefaultRuntime,
+	SamplingInterval:    AveragePoissonSamplingInterval,
+	MinSamplingInterval: AveragePoissonSamplingInterval,
+}
+
+// Validate returns an error if the limits are inconsistent, e.g. if a default
+// is out of its bounds.
+func (l Limits) Validate() error {
+	if l.Runtime < MinRuntime || l.Runtime > l.MaxRuntime {
+		return fmt.Errorf("runtime %v out of [%v, %v]", l.Runtime, MinRuntime, l.MaxRuntime)
+	}
+	if l.MinSamplingInterval <= 0 || l.SamplingInterval < l.MinSamplingInterval ||
+		l.SamplingInterval > MaxSamplingInterval {
+		return fmt.Errorf("sampling interval %v out of [%v, %v]",
+			l.SamplingInterval, l.MinSamplingInterval, MaxSamplingInterval)
+	}
+	return nil
+}
+
+// Negotiate returns p with the runtime and the sampling interval requested
+// by the client, if any, bounded by l, or otherwise with the defaults of l.
+// A zero Limits means DefaultLimits.
+func (l Limits) Negotiate(p Params) Params {
+	if l == (Limits{}) {
+		l = DefaultLimits
+	}
+	switch {
+	case p.Runtime == 0:
+		p.Runtime = l.Runtime
+	case p.Runtime < MinRuntime:
+		p.Runtime = MinRuntime
+	case p.Runtime > l.MaxRuntime:
+		p.Runtime = l.MaxRuntime
+	}
+	switch {
+	case p.SamplingInterval == 0:
+		p.SamplingInterval = l.SamplingInterval
+	case p.SamplingInterval < l.MinSamplingInterval:
+		p.SamplingInterval = l.MinSamplingInterval
+	case p.SamplingInterval > MaxSamplingInterval:
+		p.SamplingInterval = MaxSamplingInterval
+	}
+	return p
+}
+
+// SubtestMaxRuntime returns the maximum runtime of the subtests whose client
+// requests the maximum runtime, i.e. MaxRuntime plus RuntimeGrace.
+func (l Limits) SubtestMaxRuntime() time.Duration {
+	if l == (Limits{}) {
+		l = DefaultLimits
+	}
+	return l.MaxRuntime + RuntimeGrace
+}
+
+// EarlyExitMinRuntime is the minimum runtime of subtests ending early once
+// their throughput is stable.
+const EarlyExitMinRuntime = 3 * time.Second
+
+// EarlyExitWindow is the duration over which the throughput must be stable
+// for a subtest to end early.
+const EarlyExitWindow = 2 * time.Second
+
+// EarlyExitTolerance is the maximum relative variation of a stable
+// throughput over EarlyExitWindow.
+const EarlyExitTolerance = 0.05
+
+// EndReasonRuntime means that a subtest ended after its runtime.
+const EndReasonRuntime = "runtime"
+
+// EndReasonStable means that a subtest ended early once its throughput was
+// stable.
+const EndReasonStable = "stable"
+
+// EndReasonMaxBytes means that a subtest ended once its byte budget was
+// exhausted.
+const EndReasonMaxBytes = "max-bytes"
+
+// MinByteBudget is the minimum byte budget of a subtest.
+const MinByteBudget = 1 << 20
+
+// MaxByteBudget is the maximum byte budget of a subtest.
+const MaxByteBudget = 1 << 30
+
+// MaxFlows is the maximum number of parallel connections of a multi-flow
+// session.
+const MaxFlows = 8
+
+// FlowJoinTimeout is how long the flows of a multi-flow session wait for the
+// other flows before the session starts without them.
+const FlowJoinTimeout = 5 * time.Second
+
+// MaxStreams is the maximum number of concurrent bulk streams that a client
+// may request for ndtQUIC subtests.
+const MaxStreams = 8
+
+// MinConnectionReceiveWindow is the minimum connection-level receive window
+// size, in bytes, that a client may request for ndtQUIC subtests. The maximum
+// is the one configured for the server.
+const MinConnectionReceiveWindow = 64 << 10
+
+// DefaultDatagramRate is the default number of datagrams sent per second by
+// each endpoint during the datagram subtest, i.e. one every 20 ms, like many
+// real-time applications.
+const DefaultDatagramRate = 50
+
+// MaxDatagramRate is the maximum number of datagrams per second that a client
+// may request for the datagram subtest.
+const MaxDatagramRate = 1000
+
+// DatagramHeaderSize is the size in bytes of the header of the datagrams of
+// the datagram subtest, and hence their minimum size.
+const DatagramHeaderSize = 16
+
+// DefaultDatagramSize is the default size in bytes of the datagrams of the
+// datagram subtest, excluding the QUIC and WebTransport framing.
+const DefaultDatagramSize = 200
+
+// MaxDatagramSize is the maximum size in bytes of the datagrams of the datagram
+// subtest that a client may request. Such datagrams fit in the smallest QUIC
+// packets.
+const MaxDatagramSize = 1000
+
+// Params contains the subtest parameters requested by the client using the
+// query string, as accepted by the server.
+type Params struct {
+	// Streams is the number of concurrent bulk streams of ndtQUIC subtests.
+	Streams int
+	// MaxConnectionReceiveWindow is the size up to which the server may grow
+	// the connection-level receive window of ndtQUIC subtests, in bytes. Zero
+	// means that the server configuration applies.
+	MaxConnectionReceiveWindow int64
+	// DatagramRate is the number of datagrams sent per second by the server
+	// during the datagram subtest. Zero means DefaultDatagramRate.
+	DatagramRate int
+	// DatagramSize is the size of the datagrams sent by the server during the
+	// datagram subtest, in bytes. Zero means DefaultDatagramSize.
+	DatagramSize int
+	// BulkDatagrams means that the bulk data of ndtQUIC downloads is sent in
+	// datagrams rather than on streams.
+	BulkDatagrams bool
+	// Simultaneous means that the download and the upload of the combined
+	// subtest run at the same time, rather than one after the other.
+	Simultaneous bool
+	// EarlyExit means that the subtest ends once its throughput is stable.
+	EarlyExit bool
+	// MaxBytes is the byte budget of WebSocket subtests. Zero means that
+	// there is no budget.
+	MaxBytes int64
+	// Runtime is the runtime of the subtest. Zero means DefaultRuntime.
+	Runtime time.Duration
+	// SamplingInterval is the average interval between the measurements of
+	// the subtest. Zero means AveragePoissonSamplingInterval.
+	SamplingInterval time.Duration
+	// Flows is the number of parallel connections of the multi-flow session
+	// identified by SessionID, of which the subtest is a flow, or of the
+	// session it creates if SessionID is empty. Zero means that the subtest
+	// is not part of a session.
+	Flows     int
+	SessionID string
+}
+
+// SubtestRuntime returns the runtime of the subtest, i.e. Runtime or, if
+// zero, DefaultRuntime.
+func (p Params) SubtestRuntime() time.Duration {
+	if p.Runtime == 0 {
+		return DefaultRuntime
+	}
+	return p.Runtime
+}
+
+// SubtestMaxRuntime returns the maximum runtime of the subtest, i.e. its
+// runtime plus RuntimeGrace. It is MaxRuntime by default.
+func (p Params) SubtestMaxRuntime() time.Duration {
+	return p.SubtestRuntime() + RuntimeGrace
+}
+
+// SubtestSamplingInterval returns the average sampling interval of the
+// subtest, i.e. SamplingInterval or, if zero, AveragePoissonSamplingInterval.
+func (p Params) SubtestSamplingInterval() time.Duration {
+	if p.SamplingInterval == 0 {
+		return AveragePoissonSamplingInterval
+	}
+	return p.SamplingInterval
+}
+
+// BulkDatagramSize returns the size of the datagrams carrying the bulk data of
+// ndtQUIC downloads, i.e. DatagramSize or, if zero, MaxDatagramSize.
+func (p Params) BulkDatagramSize() int {
+	if p.DatagramSize == 0 {
+		return MaxDatagramSize
+	}
+	return p.DatagramSize
+}
+
 // SubtestKind indicates the subtest kind
 type SubtestKind string
 
@@ -65,6 +366,15 @@ const (
 	// SubtestUpload is a upload subtest
 	SubtestUpload = SubtestKind("upload")
 	
+	// SubtestDatagram is a datagram subtest
+	SubtestDatagram = SubtestKind("datagram")
+
+	// SubtestCombined is a combined download and upload subtest
+	SubtestCombined = SubtestKind("combined")
+
+	// SubtestBidirectional is a bidirectional download and upload subtest
+	SubtestBidirectional = SubtestKind("bidirectional")
+
 	// SubtestDownloadQUIC is a QUIC download subtest
 	SubtestDownloadQUIC = SubtestKind("downloadQUIC")
 
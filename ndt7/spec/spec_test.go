@@ -0,0 +1,134 @@
+package spec
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoissonSamplingBounds(t *testing.T) {
+	min, max := PoissonSamplingBounds(AveragePoissonSamplingInterval)
+	if min != MinPoissonSamplingInterval || max != MaxPoissonSamplingInterval {
+		t.Errorf("PoissonSamplingBounds() = %v, %v, want %v, %v",
+			min, max, MinPoissonSamplingInterval, MaxPoissonSamplingInterval)
+	}
+	min, max = PoissonSamplingBounds(100 * time.Millisecond)
+	if min != 10*time.Millisecond || max != 250*time.Millisecond {
+		t.Errorf("PoissonSamplingBounds(100ms) = %v, %v, want 10ms, 250ms", min, max)
+	}
+}
+
+func TestLimits_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  Limits
+		wantErr bool
+	}{
+		{
+			name:   "default",
+			limits: DefaultLimits,
+		},
+		{
+			name:    "runtime-above-max",
+			limits:  Limits{Runtime: 20 * time.Second, MaxRuntime: 10 * time.Second, SamplingInterval: time.Second, MinSamplingInterval: time.Second},
+			wantErr: true,
+		},
+		{
+			name:    "runtime-below-min",
+			limits:  Limits{Runtime: time.Millisecond, MaxRuntime: 10 * time.Second, SamplingInterval: time.Second, MinSamplingInterval: time.Second},
+			wantErr: true,
+		},
+		{
+			name:    "sampling-interval-below-min",
+			limits:  Limits{Runtime: time.Second, MaxRuntime: time.Second, SamplingInterval: time.Millisecond, MinSamplingInterval: time.Second},
+			wantErr: true,
+		},
+		{
+			name:    "zero-min-sampling-interval",
+			limits:  Limits{Runtime: time.Second, MaxRuntime: time.Second, SamplingInterval: time.Second},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.limits.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLimits_Negotiate(t *testing.T) {
+	limits := Limits{
+		Runtime:             10 * time.Second,
+		MaxRuntime:          20 * time.Second,
+		SamplingInterval:    250 * time.Millisecond,
+		MinSamplingInterval: 100 * time.Millisecond,
+	}
+	tests := []struct {
+		name   string
+		limits Limits
+		params Params
+		want   Params
+	}{
+		{
+			name:   "defaults",
+			limits: limits,
+			want:   Params{Runtime: 10 * time.Second, SamplingInterval: 250 * time.Millisecond},
+		},
+		{
+			name:   "zero-limits",
+			params: Params{Streams: 2},
+			want:   Params{Streams: 2, Runtime: DefaultRuntime, SamplingInterval: AveragePoissonSamplingInterval},
+		},
+		{
+			name:   "requested",
+			limits: limits,
+			params: Params{Runtime: 5 * time.Second, SamplingInterval: 500 * time.Millisecond},
+			want:   Params{Runtime: 5 * time.Second, SamplingInterval: 500 * time.Millisecond},
+		},
+		{
+			name:   "capped",
+			limits: limits,
+			params: Params{Runtime: time.Minute, SamplingInterval: time.Millisecond},
+			want:   Params{Runtime: 20 * time.Second, SamplingInterval: 100 * time.Millisecond},
+		},
+		{
+			name:   "raised",
+			limits: limits,
+			params: Params{Runtime: time.Millisecond, SamplingInterval: time.Minute},
+			want:   Params{Runtime: MinRuntime, SamplingInterval: MaxSamplingInterval},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limits.Negotiate(tt.params); got != tt.want {
+				t.Errorf("Negotiate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimits_SubtestMaxRuntime(t *testing.T) {
+	if got := (Limits{}).SubtestMaxRuntime(); got != MaxRuntime {
+		t.Errorf("zero Limits SubtestMaxRuntime() = %v, want %v", got, MaxRuntime)
+	}
+	l := Limits{Runtime: 10 * time.Second, MaxRuntime: 20 * time.Second}
+	if got := l.SubtestMaxRuntime(); got != 20*time.Second+RuntimeGrace {
+		t.Errorf("SubtestMaxRuntime() = %v, want %v", got, 20*time.Second+RuntimeGrace)
+	}
+}
+
+func TestParams_SubtestRuntime(t *testing.T) {
+	var p Params
+	if p.SubtestRuntime() != DefaultRuntime || p.SubtestMaxRuntime() != MaxRuntime ||
+		p.SubtestSamplingInterval() != AveragePoissonSamplingInterval {
+		t.Errorf("zero Params = %v, %v, %v, want the defaults",
+			p.SubtestRuntime(), p.SubtestMaxRuntime(), p.SubtestSamplingInterval())
+	}
+	p = Params{Runtime: 3 * time.Second, SamplingInterval: time.Second}
+	if p.SubtestRuntime() != 3*time.Second || p.SubtestMaxRuntime() != 8*time.Second ||
+		p.SubtestSamplingInterval() != time.Second {
+		t.Errorf("Params = %v, %v, %v, want 3s, 8s, 1s",
+			p.SubtestRuntime(), p.SubtestMaxRuntime(), p.SubtestSamplingInterval())
+	}
+}
@@ -4,49 +4,46 @@ package sender
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"os"
+	"net/http"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt7/budget"
 	"github.com/m-lab/ndt-server/ndt7/closer"
+	"github.com/m-lab/ndt-server/ndt7/earlyexit"
 	"github.com/m-lab/ndt-server/ndt7/measurer"
 	ndt7metrics "github.com/m-lab/ndt-server/ndt7/metrics"
 	"github.com/m-lab/ndt-server/ndt7/model"
 	"github.com/m-lab/ndt-server/ndt7/ping"
 	"github.com/m-lab/ndt-server/ndt7/spec"
-	"github.com/marten-seemann/webtransport-go"
+	"github.com/m-lab/ndt-server/quicx"
 )
 
-func writeJSON(str webtransport.SendStream, v interface{}) error {
-	json.NewEncoder(os.Stdout).Encode(v)
-	err1 := json.NewEncoder(str).Encode(v)
-	err2 := str.Close()
-	if err1 != nil {
-		return err1
-	}
-	return err2
+// writeJSON writes v to the control stream as a newline-delimited JSON message.
+func writeJSON(str quicx.SendStream, v interface{}) error {
+	return json.NewEncoder(str).Encode(v)
 }
 
 // Start sends measurement messages (status messages) to the client conn. Each
-// measurement message will also be saved to data.
+// measurement message will also be saved to data. If params.EarlyExit is true,
+// the upload ends once its throughput is stable. The upload also ends once the
+// bytes received exhaust the budget b, if any.
 //
 // Liveness guarantee: the sender will not be stuck sending for more than the
 // MaxRuntime of the subtest. This is enforced by setting the write deadline to
 // Time.Now() + MaxRuntime.
-func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData) error {
+func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData, mr *measurer.Measurer, params spec.Params, b *budget.Budget) error {
 	logging.Logger.Debug("sender: start")
 	proto := ndt7metrics.ConnLabel(conn)
 
 	// Start collecting connection measurements. Measurements will be sent to
-	// src until DefaultRuntime, when the src channel is closed.
-	mr := measurer.New(conn, data.UUID)
-	src := mr.Start(ctx, spec.DefaultRuntime)
+	// src until the runtime of the subtest, when the src channel is closed.
+	src := mr.Start(ctx, params.SubtestRuntime(), params.SubtestSamplingInterval())
 	defer logging.Logger.Debug("sender: stop")
 	defer mr.Stop(src)
 
-	deadline := time.Now().Add(spec.MaxRuntime)
+	deadline := time.Now().Add(params.SubtestMaxRuntime())
 	err := conn.SetWriteDeadline(deadline) // Liveness!
 	if err != nil {
 		logging.Logger.WithError(err).Warn("sender: conn.SetWriteDeadline failed")
@@ -60,13 +57,23 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 	defer func() {
 		data.EndTime = time.Now().UTC()
 	}()
+	// finish ends the upload for the given reason.
+	finish := func(reason string) error {
+		closer.Finish(conn, proto, spec.SubtestUpload, data, reason)
+		return nil
+	}
+	stable := earlyexit.Start(spec.SubtestUpload, params, data)
 	for {
-		m, ok := <-src
+		var m model.Measurement
+		var ok bool
+		select {
+		case m, ok = <-src:
+		case <-b.Done():
+			// The receiver has received the whole budget.
+			return finish(spec.EndReasonMaxBytes)
+		}
 		if !ok { // This means that the previous step has terminated
-			closer.StartClosing(conn)
-			ndt7metrics.ClientSenderErrors.WithLabelValues(
-				proto, string(spec.SubtestUpload), "measurer-closed").Inc()
-			return nil
+			return finish(spec.EndReasonRuntime)
 		}
 		if err := conn.WriteJSON(m); err != nil {
 			logging.Logger.WithError(err).Warn("sender: conn.WriteJSON failed")
@@ -76,6 +83,12 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 		}
 		// Only save measurements sent to the client.
 		data.ServerMeasurements = append(data.ServerMeasurements, m)
+		if stable.Stable(m) {
+			return finish(spec.EndReasonStable)
+		}
+		if m.TCPInfo != nil && b.Observe(m.TCPInfo.BytesReceived) {
+			return finish(spec.EndReasonMaxBytes)
+		}
 		if err := ping.SendTicks(conn, deadline); err != nil {
 			logging.Logger.WithError(err).Warn("sender: ping.SendTicks failed")
 			ndt7metrics.ClientSenderErrors.WithLabelValues(
@@ -85,37 +98,29 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 	}
 }
 
-
-
-// Start sends measurement messages (status messages) to the client conn. Each
-// measurement message will also be saved to data.
+// StartWebTransport is like Start but for ndtQUIC sessions, i.e. WebTransport
+// sessions or raw QUIC connections. Measurement
+// messages are sent on the ctrl stream.
 //
 // Liveness guarantee: the sender will not be stuck sending for more than the
 // MaxRuntime of the subtest. This is enforced by setting the write deadline to
 // Time.Now() + MaxRuntime.
-func StartWebTransport(ctx context.Context, sess *webtransport.Session, data *model.ArchivalData, mr *measurer.WebTransportMeasurer) error {
+func StartWebTransport(ctx context.Context, sess quicx.Session, ctrl quicx.Stream, data *model.ArchivalData, mr *measurer.WebTransportMeasurer, params spec.Params) error {
 	logging.Logger.Debug("sender: start")
-	proto := "ndt+webtransport"
+	proto := ndt7metrics.SessionLabel(sess)
 
 	// Start collecting connection measurements. Measurements will be sent to
-	// src until DefaultRuntime, when the src channel is closed.
-	src := mr.Start(ctx, spec.DefaultRuntime)
+	// src until the runtime of the subtest, when the src channel is closed.
+	src := mr.Start(ctx, params.SubtestRuntime(), params.SubtestSamplingInterval())
 	defer logging.Logger.Debug("sender: stop")
 	defer mr.Stop(src)
 
-	deadline := time.Now().Add(spec.MaxRuntime)
-	str, err := sess.OpenUniStream()
+	deadline := time.Now().Add(params.SubtestMaxRuntime())
+	err := ctrl.SetWriteDeadline(deadline) // Liveness!
 	if err != nil {
-		logging.Logger.WithError(err).Warn("sender: sess.OpenUniStream failed")
+		logging.Logger.WithError(err).Warn("sender: ctrl.SetWriteDeadline failed")
 		ndt7metrics.ClientSenderErrors.WithLabelValues(
-			proto, string(spec.SubtestUpload), "open-uni-stream").Inc()
-		return err
-	}
-	err = str.SetWriteDeadline(deadline) // Liveness!
-	if err != nil {
-		logging.Logger.WithError(err).Warn("sender: str.SetWriteDeadline failed")
-		ndt7metrics.ClientSenderErrors.WithLabelValues(
-			proto, string(spec.SubtestUpload), "str-set-write-deadline").Inc()
+			proto, string(spec.SubtestUpload), "ctrl-set-write-deadline").Inc()
 		return err
 	}
 
@@ -124,36 +129,29 @@ func StartWebTransport(ctx context.Context, sess *webtransport.Session, data *mo
 	defer func() {
 		data.EndTime = time.Now().UTC()
 	}()
+	// finish ends the upload for the given reason.
+	finish := func(reason string) error {
+		closer.FinishWebTransport(ctrl, proto, spec.SubtestUpload, data, reason)
+		return nil
+	}
+	stable := earlyexit.Start(spec.SubtestUpload, params, data)
 	for {
 		m, ok := <-src
 		if !ok { // This means that the previous step has terminated
-			// TODO: start closing
-			// closer.StartClosing(str)
-			ndt7metrics.ClientSenderErrors.WithLabelValues(
-				proto, string(spec.SubtestUpload), "measurer-closed").Inc()
-			return nil
-		}
-		
-		m.QUICInfo = &model.QUICInfo{
-			QUICStreamBytesReceived: int64(mr.BytesReceived),
-		}
-
-		jsonStr, err := sess.OpenUniStreamSync(ctx)
-		if err != nil {
-			return err
+			return finish(spec.EndReasonRuntime)
 		}
-		
-		if err := writeJSON(jsonStr, m); err != nil {
-			fmt.Println("ERROR", err)
-			logging.Logger.WithError(err).Warn("sender: conn.WriteJSON failed")
+		if err := writeJSON(ctrl, m); err != nil {
+			logging.Logger.WithError(err).Warn("sender: writeJSON failed")
 			ndt7metrics.ClientSenderErrors.WithLabelValues(
 				proto, string(spec.SubtestUpload), "write-json").Inc()
 			return err
 		}
-		jsonStr.Close()
 		// Only save measurements sent to the client.
 		data.ServerMeasurements = append(data.ServerMeasurements, m)
-		if err := ping.SendTicksWebTransport(sess, deadline); err != nil {
+		if stable.Stable(m) {
+			return finish(spec.EndReasonStable)
+		}
+		if err := ping.SendTicksWebTransport(ctrl); err != nil {
 			logging.Logger.WithError(err).Warn("sender: ping.SendTicks failed")
 			ndt7metrics.ClientSenderErrors.WithLabelValues(
 				proto, string(spec.SubtestUpload), "ping-send-ticks").Inc()
@@ -161,3 +159,51 @@ func StartWebTransport(ctx context.Context, sess *webtransport.Session, data *mo
 		}
 	}
 }
+
+// StartHTTP is like Start but for subtests over plain HTTP streams, where
+// measurement messages are sent in the response body, as newline-delimited
+// JSON, while the client sends binary data (bulk upload) in the request body.
+// The proto argument is the protocol label used in metrics.
+//
+// Liveness guarantee: the sender will not be stuck sending for more than the
+// MaxRuntime of the subtest, provided that the caller closes the connection
+// underlying rw after MaxRuntime, since HTTP responses have no write deadline.
+func StartHTTP(ctx context.Context, rw http.ResponseWriter, proto string, data *model.ArchivalData, mr measurer.Sampler, params spec.Params) error {
+	logging.Logger.Debug("sender: start")
+
+	// Start collecting connection measurements. Measurements will be sent to
+	// src until the runtime of the subtest, when the src channel is closed.
+	src := mr.Start(ctx, params.SubtestRuntime(), params.SubtestSamplingInterval())
+	defer logging.Logger.Debug("sender: stop")
+	defer mr.Stop(src)
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	flusher, _ := rw.(http.Flusher)
+	enc := json.NewEncoder(rw)
+
+	// Record measurement start time, and prepare recording of the endtime on return.
+	data.StartTime = time.Now().UTC()
+	defer func() {
+		data.EndTime = time.Now().UTC()
+	}()
+	for {
+		m, ok := <-src
+		if !ok { // This means that the previous step has terminated
+			ndt7metrics.ClientSenderErrors.WithLabelValues(
+				proto, string(spec.SubtestUpload), "measurer-closed").Inc()
+			return nil
+		}
+		if err := enc.Encode(m); err != nil {
+			logging.Logger.WithError(err).Warn("sender: enc.Encode failed")
+			ndt7metrics.ClientSenderErrors.WithLabelValues(
+				proto, string(spec.SubtestUpload), "write-json").Inc()
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		// Only save measurements sent to the client.
+		data.ServerMeasurements = append(data.ServerMeasurements, m)
+	}
+}
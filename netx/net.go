@@ -1,6 +1,7 @@
 package netx
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
 	"net"
@@ -214,3 +215,19 @@ func ToConnInfo(conn net.Conn) ConnInfo {
 		return nil
 	}
 }
+
+// connContextKey is the key of the connection saved by ConnContext.
+type connContextKey struct{}
+
+// ConnContext saves conn in the returned context, which is a child of ctx. It
+// may be used as the ConnContext function of an http.Server, so that handlers
+// can find the connection underlying a request using FromContext.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// FromContext returns the connection saved in ctx by ConnContext, or nil.
+func FromContext(ctx context.Context) net.Conn {
+	conn, _ := ctx.Value(connContextKey{}).(net.Conn)
+	return conn
+}
@@ -1,6 +1,7 @@
 package netx
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -279,3 +280,16 @@ func TestToConnInfo(t *testing.T) {
 		t.Errorf("ToConnInfo() returned ConInfo for unsupported type: %#v", got)
 	}
 }
+
+func TestConnContext(t *testing.T) {
+	if got := FromContext(context.Background()); got != nil {
+		t.Errorf("FromContext() = %v, want nil", got)
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	ctx := ConnContext(context.Background(), c1)
+	if got := FromContext(ctx); got != c1 {
+		t.Errorf("FromContext() = %v, want %v", got, c1)
+	}
+}
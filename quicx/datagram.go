@@ -0,0 +1,184 @@
+package quicx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+// ErrDatagramConnClosed is returned by ReceiveDatagram once the DatagramConn
+// is closed.
+var ErrDatagramConnClosed = errors.New("datagram conn closed")
+
+// ErrDatagramsInUse is returned by WebTransportDatagrams when the session
+// already has a DatagramConn.
+var ErrDatagramsInUse = errors.New("datagrams of the session already in use")
+
+// datagramBacklog is the number of datagrams of a session that may wait to be
+// received. Further datagrams are dropped, like when the network drops them.
+const datagramBacklog = 256
+
+// DatagramConn sends and receives the unreliable datagrams (RFC 9221) of a
+// session.
+type DatagramConn interface {
+	// SendDatagram sends b in a datagram. It blocks until the datagram is
+	// packed, i.e. while the connection is congestion limited, or until ctx
+	// is done or the QUIC connection is closed. It fails if b is too large to
+	// fit in a QUIC packet.
+	SendDatagram(ctx context.Context, b []byte) error
+	// ReceiveDatagram blocks until the next datagram of the session is
+	// received, or until the DatagramConn or the QUIC connection is closed.
+	ReceiveDatagram() ([]byte, error)
+	// Close stops receiving the datagrams of the session, and unblocks
+	// ReceiveDatagram. It does not close the QUIC connection.
+	Close() error
+}
+
+// demuxes maps the QUIC connections whose datagrams are received to their
+// demultiplexers.
+var demuxes = struct {
+	sync.Mutex
+	m map[quic.Connection]*demux
+}{m: make(map[quic.Connection]*demux)}
+
+// demux receives the datagrams of a QUIC connection, and dispatches them to
+// the sessions of the connection, by quarter stream ID. Its sessions are
+// protected by the mutex of demuxes.
+type demux struct {
+	conn     quic.Connection
+	sessions map[uint64]*webTransportDatagrams
+	// done is closed, and err set, once the connection fails.
+	done chan struct{}
+	err  error
+}
+
+// run receives the datagrams of the connection until it fails. The datagrams
+// of the sessions without a DatagramConn are discarded.
+func (d *demux) run() {
+	for {
+		msg, err := d.conn.ReceiveMessage()
+		if err != nil {
+			demuxes.Lock()
+			delete(demuxes.m, d.conn)
+			demuxes.Unlock()
+			d.err = err
+			close(d.done)
+			return
+		}
+		r := bytes.NewReader(msg)
+		id, err := quicvarint.Read(r)
+		if err != nil {
+			continue // Not an HTTP/3 datagram.
+		}
+		demuxes.Lock()
+		s := d.sessions[id]
+		demuxes.Unlock()
+		if s == nil {
+			continue
+		}
+		select {
+		case s.received <- msg[len(msg)-r.Len():]:
+		default:
+		}
+	}
+}
+
+// WebTransportDatagrams returns the DatagramConn of the WebTransport session
+// established by the CONNECT request sent on the stream with the given ID of
+// conn. Datagrams are sent as HTTP/3 datagrams (RFC 9297), i.e. prefixed by
+// the quarter stream ID of the request stream. The datagrams of all the
+// sessions of conn are received by a single goroutine, until conn is closed,
+// and dispatched to the DatagramConns of their sessions. The datagrams of the
+// sessions without a DatagramConn are discarded. A session has at most one
+// DatagramConn at a time, so that its datagrams are not split between readers:
+// it fails with ErrDatagramsInUse until the DatagramConn of the session is
+// closed. The caller must call Close once the session no longer receives
+// datagrams.
+func WebTransportDatagrams(conn quic.Connection, id quic.StreamID) (DatagramConn, error) {
+	s := &webTransportDatagrams{
+		conn:      conn,
+		quarterID: uint64(id) / 4,
+		received:  make(chan []byte, datagramBacklog),
+		closed:    make(chan struct{}),
+	}
+	demuxes.Lock()
+	defer demuxes.Unlock()
+	d, ok := demuxes.m[conn]
+	if !ok {
+		d = &demux{
+			conn:     conn,
+			sessions: make(map[uint64]*webTransportDatagrams),
+			done:     make(chan struct{}),
+		}
+		demuxes.m[conn] = d
+		go d.run()
+	}
+	if d.sessions[s.quarterID] != nil {
+		return nil, ErrDatagramsInUse
+	}
+	d.sessions[s.quarterID] = s
+	s.d = d
+	return s, nil
+}
+
+type webTransportDatagrams struct {
+	conn      quic.Connection
+	quarterID uint64
+	d         *demux
+	received  chan []byte
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func (s *webTransportDatagrams) SendDatagram(ctx context.Context, b []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	msg := quicvarint.Append(make([]byte, 0, 8+len(b)), s.quarterID)
+	msg = append(msg, b...)
+	// SendMessage cannot be interrupted, but it returns once the datagram
+	// is packed or the connection is closed, and msg is not shared.
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.conn.SendMessage(msg)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *webTransportDatagrams) ReceiveDatagram() ([]byte, error) {
+	select {
+	case b := <-s.received:
+		return b, nil
+	case <-s.closed:
+		return nil, ErrDatagramConnClosed
+	case <-s.d.done:
+		// Return the datagrams received before the connection failed.
+		select {
+		case b := <-s.received:
+			return b, nil
+		default:
+			return nil, s.d.err
+		}
+	}
+}
+
+func (s *webTransportDatagrams) Close() error {
+	s.once.Do(func() {
+		demuxes.Lock()
+		if s.d.sessions[s.quarterID] == s {
+			delete(s.d.sessions, s.quarterID)
+		}
+		demuxes.Unlock()
+		close(s.closed)
+	})
+	return nil
+}
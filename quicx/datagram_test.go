@@ -0,0 +1,179 @@
+package quicx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// fakeDatagramConn is a quic.Connection that only sends and receives
+// datagrams.
+type fakeDatagramConn struct {
+	quic.Connection
+	sent     [][]byte
+	received [][]byte
+}
+
+func (c *fakeDatagramConn) SendMessage(b []byte) error {
+	c.sent = append(c.sent, b)
+	return nil
+}
+
+func (c *fakeDatagramConn) ReceiveMessage() ([]byte, error) {
+	if len(c.received) == 0 {
+		return nil, errors.New("connection closed")
+	}
+	b := c.received[0]
+	c.received = c.received[1:]
+	return b, nil
+}
+
+func TestWebTransportDatagrams(t *testing.T) {
+	conn := &fakeDatagramConn{
+		received: [][]byte{
+			{0x00, 'a'},       // Session with request stream 0.
+			{0x01, 'b'},       // Session with request stream 4.
+			{0x40},            // Truncated quarter stream ID.
+			{0x40, 0x01, 'c'}, // Session with request stream 4, 2-byte varint.
+			{0x01},            // Empty datagram.
+		},
+	}
+	dc, err := WebTransportDatagrams(conn, 4)
+	if err != nil {
+		t.Fatalf("WebTransportDatagrams() unexpected error = %v", err)
+	}
+	if err := dc.SendDatagram(context.Background(), []byte("xyz")); err != nil {
+		t.Fatalf("SendDatagram() unexpected error = %v", err)
+	}
+	if len(conn.sent) != 1 || !bytes.Equal(conn.sent[0], []byte{0x01, 'x', 'y', 'z'}) {
+		t.Errorf("SendDatagram() sent %v", conn.sent)
+	}
+	for _, want := range []string{"b", "c", ""} {
+		got, err := dc.ReceiveDatagram()
+		if err != nil || string(got) != want {
+			t.Errorf("ReceiveDatagram() = %q, %v; want %q, nil", got, err, want)
+		}
+	}
+	if _, err := dc.ReceiveDatagram(); err == nil {
+		t.Errorf("ReceiveDatagram() on closed connection: expected error")
+	}
+}
+
+// blockingDatagramConn is a quic.Connection whose datagrams are received from
+// a channel, until it is closed.
+type blockingDatagramConn struct {
+	quic.Connection
+	received chan []byte
+}
+
+func (c *blockingDatagramConn) ReceiveMessage() ([]byte, error) {
+	b, ok := <-c.received
+	if !ok {
+		return nil, errors.New("connection closed")
+	}
+	return b, nil
+}
+
+func TestWebTransportDatagrams_Sessions(t *testing.T) {
+	conn := &blockingDatagramConn{received: make(chan []byte)}
+	dc0 := mustWebTransportDatagrams(t, conn, 0)
+	dc4 := mustWebTransportDatagrams(t, conn, 4)
+
+	// A session has a single reader.
+	if _, err := WebTransportDatagrams(conn, 4); err != ErrDatagramsInUse {
+		t.Errorf("WebTransportDatagrams() of session 4 error = %v, want %v", err, ErrDatagramsInUse)
+	}
+	conn.received <- []byte{0x01, 'b'}
+	conn.received <- []byte{0x00, 'a'}
+	if got, err := dc0.ReceiveDatagram(); err != nil || string(got) != "a" {
+		t.Errorf("ReceiveDatagram() of session 0 = %q, %v; want %q, nil", got, err, "a")
+	}
+	if got, err := dc4.ReceiveDatagram(); err != nil || string(got) != "b" {
+		t.Errorf("ReceiveDatagram() of session 4 = %q, %v; want %q, nil", got, err, "b")
+	}
+
+	// Closing a DatagramConn unblocks its reader, and the datagrams of its
+	// session are then discarded.
+	done := make(chan error)
+	go func() {
+		_, err := dc0.ReceiveDatagram()
+		done <- err
+	}()
+	dc0.Close()
+	if err := <-done; err != ErrDatagramConnClosed {
+		t.Errorf("ReceiveDatagram() after Close error = %v, want %v", err, ErrDatagramConnClosed)
+	}
+	conn.received <- []byte{0x00, 'c'}
+	conn.received <- []byte{0x01, 'd'}
+	if got, err := dc4.ReceiveDatagram(); err != nil || string(got) != "d" {
+		t.Errorf("ReceiveDatagram() of session 4 = %q, %v; want %q, nil", got, err, "d")
+	}
+
+	// A later session on the same connection receives its own datagrams,
+	// and a closed session may be read again.
+	dc8 := mustWebTransportDatagrams(t, conn, 8)
+	conn.received <- []byte{0x02, 'e'}
+	if got, err := dc8.ReceiveDatagram(); err != nil || string(got) != "e" {
+		t.Errorf("ReceiveDatagram() of session 8 = %q, %v; want %q, nil", got, err, "e")
+	}
+	dc0 = mustWebTransportDatagrams(t, conn, 0)
+	conn.received <- []byte{0x00, 'f'}
+	if got, err := dc0.ReceiveDatagram(); err != nil || string(got) != "f" {
+		t.Errorf("ReceiveDatagram() of session 0 = %q, %v; want %q, nil", got, err, "f")
+	}
+	close(conn.received)
+	if _, err := dc4.ReceiveDatagram(); err == nil || err == ErrDatagramConnClosed {
+		t.Errorf("ReceiveDatagram() on closed connection error = %v, want the connection error", err)
+	}
+	dc0.Close()
+	dc4.Close()
+	dc8.Close()
+}
+
+func mustWebTransportDatagrams(t *testing.T, conn quic.Connection, id quic.StreamID) DatagramConn {
+	dc, err := WebTransportDatagrams(conn, id)
+	if err != nil {
+		t.Fatalf("WebTransportDatagrams(%d) unexpected error = %v", id, err)
+	}
+	return dc
+}
+
+// stalledDatagramConn is a quic.Connection that never sends datagrams, like a
+// congestion limited connection whose peer stops acknowledging packets, until
+// it is closed.
+type stalledDatagramConn struct {
+	quic.Connection
+	closed chan struct{}
+}
+
+func (c *stalledDatagramConn) SendMessage(b []byte) error {
+	<-c.closed
+	return errors.New("connection closed")
+}
+
+func (c *stalledDatagramConn) ReceiveMessage() ([]byte, error) {
+	<-c.closed
+	return nil, errors.New("connection closed")
+}
+
+func TestWebTransportDatagrams_SendCanceled(t *testing.T) {
+	conn := &stalledDatagramConn{closed: make(chan struct{})}
+	defer close(conn.closed)
+	dc, err := WebTransportDatagrams(conn, 0)
+	if err != nil {
+		t.Fatalf("WebTransportDatagrams() unexpected error = %v", err)
+	}
+	defer dc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := dc.SendDatagram(ctx, []byte("xyz")); err != context.DeadlineExceeded {
+		t.Errorf("SendDatagram() on a stalled connection error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := dc.SendDatagram(ctx, []byte("xyz")); err != context.DeadlineExceeded {
+		t.Errorf("SendDatagram() after the deadline error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,403 @@
+// Package quicx provides access to metadata about QUIC connections accepted by
+// quic-go servers, allowing callers to perform meta operations on the
+// connection, e.g. GetUUID, NewSessionUUID, ReadInfo, ReadParams,
+// ReadHandshake.
+//
+// quic-go does not expose the connection underlying an HTTP/3 request or a
+// WebTransport session. Instead, every connection is assigned a tracing ID,
+// which is passed to the logging.Tracer configured for the server and stored
+// in the connection and session contexts under quic.ConnectionTracingKey. The
+// Tracer in this package uses that ID to keep track of live connections, so
+// that they can later be found using ToConnInfo.
+package quicx
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/lucas-clemente/quic-go/qlog"
+	ndtlogging "github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/uuid"
+)
+
+// ErrNoConnection is returned when a context does not refer to a connection
+// known to the Tracer.
+var ErrNoConnection = errors.New("no QUIC connection found for context")
+
+// lastCookie is the last cookie used to derive the UUID of a connection or of
+// a session. It must be accessed atomically. Unlike the kernel cookies used
+// for TCP UUIDs, which only restart when the host boots, these cookies are
+// counted by the process. Starting from the process start time keeps them
+// unique and increasing across restarts of the server on the same host.
+var lastCookie = uint64(time.Now().UnixNano())
+
+// newUUID returns a UUID derived from a new cookie.
+func newUUID() string {
+	return uuid.FromCookie(atomic.AddUint64(&lastCookie, 1))
+}
+
+// Default maximum receive window sizes of quic-go, in bytes.
+const (
+	defaultMaxStreamReceiveWindow     = 6 << 20
+	defaultMaxConnectionReceiveWindow = 15 << 20
+)
+
+// connections maps tracing IDs to the connections that are currently open.
+var connections = struct {
+	sync.Mutex
+	m map[uint64]*Conn
+}{m: make(map[uint64]*Conn)}
+
+// ConnInfo provides operations on a QUIC connection.
+type ConnInfo interface {
+	GetUUID() (string, error)
+	NewSessionUUID() (string, error)
+	ReadInfo() (model.QUICConnInfo, error)
+	ReadParams() (model.QUICConnParams, error)
+	ReadHandshake() (Handshake, error)
+	LimitConnectionReceiveWindow(n int64) (int64, func())
+}
+
+// Handshake contains details about the QUIC handshake of a connection.
+type Handshake struct {
+	// Version is the QUIC version of the connection, e.g. "v1".
+	Version string
+	// Duration is the time elapsed between the start of the connection and
+	// the completion of the handshake, in microseconds.
+	Duration int64
+}
+
+func newTransportParams(tp *logging.TransportParameters) model.QUICTransportParams {
+	return model.QUICTransportParams{
+		MaxIdleTimeout:                 int64(tp.MaxIdleTimeout / time.Microsecond),
+		InitialMaxData:                 int64(tp.InitialMaxData),
+		InitialMaxStreamDataBidiLocal:  int64(tp.InitialMaxStreamDataBidiLocal),
+		InitialMaxStreamDataBidiRemote: int64(tp.InitialMaxStreamDataBidiRemote),
+		InitialMaxStreamDataUni:        int64(tp.InitialMaxStreamDataUni),
+		MaxBidiStreamNum:               int64(tp.MaxBidiStreamNum),
+		MaxUniStreamNum:                int64(tp.MaxUniStreamNum),
+		MaxDatagramFrameSize:           int64(tp.MaxDatagramFrameSize),
+	}
+}
+
+// Tracer is a logging.Tracer that keeps track of the connections accepted by a
+// quic-go server. Set it as the Tracer of the server's quic.Config.
+type Tracer struct {
+	logging.NullTracer
+
+	// QLog, if not nil, is called with the UUID of every new connection. If
+	// it returns a non-nil writer, a qlog trace of the connection is written
+	// to it, and the writer is closed when the connection is closed.
+	QLog func(uuid string) io.WriteCloser
+}
+
+// NewTracer creates a new Tracer.
+func NewTracer() *Tracer {
+	return &Tracer{}
+}
+
+// TracerForConnection registers a new connection. It is called by quic-go.
+func (t *Tracer) TracerForConnection(ctx context.Context, p logging.Perspective, odcid logging.ConnectionID) logging.ConnectionTracer {
+	id, ok := ctx.Value(quic.ConnectionTracingKey).(uint64)
+	if !ok {
+		ndtlogging.Logger.Warn("quicx: connection without tracing ID")
+		return nil
+	}
+	c := &Conn{
+		id:    id,
+		odcid: odcid,
+		uuid:  newUUID(),
+	}
+	connections.Lock()
+	connections.m[id] = c
+	connections.Unlock()
+	if t.QLog != nil {
+		if w := t.QLog(c.uuid); w != nil {
+			return logging.NewMultiplexedConnectionTracer(c, qlog.NewConnectionTracer(w, p, odcid))
+		}
+	}
+	return c
+}
+
+// Conn is the per-connection tracer created by Tracer. It provides mediated
+// access to the connection metadata.
+type Conn struct {
+	logging.NullConnectionTracer
+	id    uint64
+	odcid logging.ConnectionID
+	uuid  string
+
+	mu        sync.Mutex
+	info      model.QUICConnInfo
+	params    model.QUICConnParams
+	start     time.Time
+	handshake Handshake
+	// connWindow is the size of the connection-level receive window, and
+	// maxConnWindows counts the limits currently set on the size it may
+	// grow to, by value.
+	connWindow     int64
+	maxConnWindows map[int64]int
+	// inflight maps the number of the ack-eliciting 1-RTT packets that have
+	// neither been acknowledged nor declared lost to their size.
+	inflight map[logging.PacketNumber]logging.ByteCount
+}
+
+// UpdatedMetrics records the state of the congestion controller. It is
+// called by quic-go whenever an ack is received or a packet is sent.
+func (c *Conn) UpdatedMetrics(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, packetsInFlight int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.info.SmoothedRTT = int64(rttStats.SmoothedRTT() / time.Microsecond)
+	c.info.MinRTT = int64(rttStats.MinRTT() / time.Microsecond)
+	c.info.LatestRTT = int64(rttStats.LatestRTT() / time.Microsecond)
+	c.info.RTTVar = int64(rttStats.MeanDeviation() / time.Microsecond)
+	c.info.CongestionWindow = int64(cwnd)
+	c.info.BytesInFlight = int64(bytesInFlight)
+}
+
+// StartedConnection records the start of the connection. It is called by
+// quic-go when the first packet of the client is received.
+func (c *Conn) StartedConnection(local, remote net.Addr, srcConnID, destConnID logging.ConnectionID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.start = time.Now()
+}
+
+// DroppedEncryptionLevel records the completion of the handshake, when the
+// handshake keys are dropped. It is called by quic-go.
+func (c *Conn) DroppedEncryptionLevel(level logging.EncryptionLevel) {
+	if level != logging.EncryptionHandshake {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handshake.Duration = int64(time.Since(c.start) / time.Microsecond)
+}
+
+// SentTransportParameters records the transport parameters of the server. It
+// is called by quic-go during the handshake.
+func (c *Conn) SentTransportParameters(tp *logging.TransportParameters) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.params.Server = newTransportParams(tp)
+	c.connWindow = int64(tp.InitialMaxData)
+}
+
+// ReceivedTransportParameters records the transport parameters of the client.
+// It is called by quic-go during the handshake.
+func (c *Conn) ReceivedTransportParameters(tp *logging.TransportParameters) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.params.Client = newTransportParams(tp)
+}
+
+// SentPacket counts a packet sent on the connection.
+func (c *Conn) SentPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, ack *logging.AckFrame, frames []logging.Frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.info.PacketsSent++
+	c.info.BytesSent += int64(size)
+	// Only ack-eliciting packets are ever acknowledged or declared lost.
+	if logging.PacketTypeFromHeader(&hdr.Header) != logging.PacketType1RTT || !isAckEliciting(frames) {
+		return
+	}
+	if c.inflight == nil {
+		c.inflight = make(map[logging.PacketNumber]logging.ByteCount)
+	}
+	c.inflight[hdr.PacketNumber] = size
+}
+
+// AcknowledgedPacket counts the bytes of a packet acknowledged by the peer.
+func (c *Conn) AcknowledgedPacket(level logging.EncryptionLevel, pn logging.PacketNumber) {
+	if level != logging.Encryption1RTT {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size, ok := c.inflight[pn]; ok {
+		c.info.BytesAcked += int64(size)
+		delete(c.inflight, pn)
+	}
+}
+
+// ReceivedLongHeaderPacket counts a handshake packet received on the connection.
+func (c *Conn) ReceivedLongHeaderPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, frames []logging.Frame) {
+	c.received(size)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handshake.Version == "" && hdr != nil {
+		c.handshake.Version = hdr.Version.String()
+	}
+}
+
+// ReceivedShortHeaderPacket counts a packet received on the connection.
+func (c *Conn) ReceivedShortHeaderPacket(hdr *logging.ShortHeader, size logging.ByteCount, frames []logging.Frame) {
+	c.received(size)
+}
+
+func (c *Conn) received(size logging.ByteCount) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.info.PacketsReceived++
+	c.info.BytesReceived += int64(size)
+}
+
+// LostPacket counts a packet declared lost by the loss detection.
+func (c *Conn) LostPacket(level logging.EncryptionLevel, pn logging.PacketNumber, reason logging.PacketLossReason) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.info.PacketsLost++
+	if size, ok := c.inflight[pn]; ok && level == logging.Encryption1RTT {
+		c.info.BytesLost += int64(size)
+		delete(c.inflight, pn)
+	}
+}
+
+// isAckEliciting returns whether a packet containing frames elicits an ACK.
+func isAckEliciting(frames []logging.Frame) bool {
+	for _, f := range frames {
+		switch f.(type) {
+		case *logging.AckFrame, *logging.ConnectionCloseFrame:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// Close unregisters the connection. It is called by quic-go when the
+// connection is closed.
+func (c *Conn) Close() {
+	connections.Lock()
+	delete(connections.m, c.id)
+	connections.Unlock()
+}
+
+// GetUUID returns the connection's UUID. The UUID has the same format as the
+// ones returned by netx.Conn.GetUUID for TCP connections, i.e. the UUID prefix
+// of this host followed by a cookie that is unique for the connection.
+func (c *Conn) GetUUID() (string, error) {
+	return c.uuid, nil
+}
+
+// NewSessionUUID returns a new UUID for a session run over the connection,
+// e.g. a WebTransport session or an HTTP/3 request. Since a connection may
+// carry several sessions, each call returns a UUID that differs from those of
+// the other sessions and from the UUID of the connection.
+func (c *Conn) NewSessionUUID() (string, error) {
+	return newUUID(), nil
+}
+
+// ReadInfo returns the current state of the connection.
+func (c *Conn) ReadInfo() (model.QUICConnInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info, nil
+}
+
+// ReadParams returns the transport parameters of the connection.
+func (c *Conn) ReadParams() (model.QUICConnParams, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.params, nil
+}
+
+// ReadHandshake returns the details about the handshake of the connection.
+func (c *Conn) ReadHandshake() (Handshake, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.handshake, nil
+}
+
+// LimitConnectionReceiveWindow limits the size that the connection-level
+// receive window may grow to, in bytes, until the returned function is called,
+// and returns the limit that took effect. Since windows never shrink, the
+// limit is never lower than the current window size. The connection may carry
+// several subtests, each setting its own limit: the lowest limit applies, and
+// once all of them are removed, only the MaxConnectionReceiveWindow of the
+// quic.Config does. The limits are only enforced if
+// AllowConnectionWindowIncrease is set in the quic.Config.
+func (c *Conn) LimitConnectionReceiveWindow(n int64) (int64, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n < c.connWindow {
+		n = c.connWindow
+	}
+	if c.maxConnWindows == nil {
+		c.maxConnWindows = make(map[int64]int)
+	}
+	c.maxConnWindows[n]++
+	var once sync.Once
+	return n, func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.maxConnWindows[n]--; c.maxConnWindows[n] == 0 {
+				delete(c.maxConnWindows, n)
+			}
+		})
+	}
+}
+
+func (c *Conn) allowConnectionWindowIncrease(delta int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n := range c.maxConnWindows {
+		if c.connWindow+delta > n {
+			return false
+		}
+	}
+	c.connWindow += delta
+	return true
+}
+
+// AllowConnectionWindowIncrease enforces the limits set using
+// LimitConnectionReceiveWindow. Set it as the AllowConnectionWindowIncrease
+// of the server's quic.Config.
+func AllowConnectionWindowIncrease(conn quic.Connection, delta uint64) bool {
+	ci, err := ToConnInfo(conn.Context())
+	if err != nil {
+		return true
+	}
+	return ci.(*Conn).allowConnectionWindowIncrease(int64(delta))
+}
+
+// MaxReceiveWindows returns the sizes, in bytes, up to which quic-go grows the
+// stream-level and connection-level receive windows of the connections
+// accepted using conf, which may be nil.
+func MaxReceiveWindows(conf *quic.Config) (stream, conn int64) {
+	stream, conn = defaultMaxStreamReceiveWindow, defaultMaxConnectionReceiveWindow
+	if conf != nil && conf.MaxStreamReceiveWindow > 0 {
+		stream = int64(conf.MaxStreamReceiveWindow)
+	}
+	if conf != nil && conf.MaxConnectionReceiveWindow > 0 {
+		conn = int64(conf.MaxConnectionReceiveWindow)
+	}
+	return stream, conn
+}
+
+// ToConnInfo is a helper function for extracting the ConnInfo of the QUIC
+// connection referenced by ctx. The ctx must carry quic.ConnectionTracingKey,
+// as the contexts returned by quic.Connection.Context and
+// webtransport.Session.Context do.
+func ToConnInfo(ctx context.Context) (ConnInfo, error) {
+	id, ok := ctx.Value(quic.ConnectionTracingKey).(uint64)
+	if !ok {
+		return nil, ErrNoConnection
+	}
+	connections.Lock()
+	defer connections.Unlock()
+	c, ok := connections.m[id]
+	if !ok {
+		return nil, ErrNoConnection
+	}
+	return c, nil
+}
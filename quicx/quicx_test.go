@@ -0,0 +1,215 @@
+package quicx
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/m-lab/ndt-server/ndt7/model"
+)
+
+func TestTracer(t *testing.T) {
+	tr := NewTracer()
+	ctx1 := context.WithValue(context.Background(), quic.ConnectionTracingKey, uint64(1))
+	ctx2 := context.WithValue(context.Background(), quic.ConnectionTracingKey, uint64(2))
+
+	ct1 := tr.TracerForConnection(ctx1, logging.PerspectiveServer, logging.ConnectionID{})
+	ct2 := tr.TracerForConnection(ctx2, logging.PerspectiveServer, logging.ConnectionID{})
+	if ct1 == nil || ct2 == nil {
+		t.Fatalf("TracerForConnection() returned nil")
+	}
+
+	ci1, err := ToConnInfo(ctx1)
+	if err != nil {
+		t.Fatalf("ToConnInfo() unexpected error = %v", err)
+	}
+	ci2, err := ToConnInfo(ctx2)
+	if err != nil {
+		t.Fatalf("ToConnInfo() unexpected error = %v", err)
+	}
+	uuid1, _ := ci1.GetUUID()
+	uuid2, _ := ci2.GetUUID()
+	if uuid1 == uuid2 {
+		t.Errorf("GetUUID() returned the same UUID for different connections: %q", uuid1)
+	}
+	if strings.Compare(uuid1, uuid2) >= 0 {
+		t.Errorf("GetUUID() UUIDs are not sorted by connection: %q >= %q", uuid1, uuid2)
+	}
+
+	// Sessions over the same connection get their own UUIDs.
+	s1, err := ci1.NewSessionUUID()
+	if err != nil {
+		t.Fatalf("NewSessionUUID() unexpected error = %v", err)
+	}
+	s2, _ := ci1.NewSessionUUID()
+	if s1 == s2 || s1 == uuid1 || s1 == uuid2 || s2 == uuid1 || s2 == uuid2 {
+		t.Errorf("NewSessionUUID() returned %q and %q, want them distinct from each other and from %q and %q",
+			s1, s2, uuid1, uuid2)
+	}
+
+	// Once closed, connections can no longer be found.
+	ct1.Close()
+	if _, err := ToConnInfo(ctx1); err != ErrNoConnection {
+		t.Errorf("ToConnInfo() after Close error = %v, want %v", err, ErrNoConnection)
+	}
+	ct2.Close()
+}
+
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestTracer_QLog(t *testing.T) {
+	buf := &closeBuffer{}
+	var uuids []string
+	tr := &Tracer{QLog: func(uuid string) io.WriteCloser {
+		uuids = append(uuids, uuid)
+		if len(uuids) > 1 {
+			return nil // only trace the first connection.
+		}
+		return buf
+	}}
+	ctx1 := context.WithValue(context.Background(), quic.ConnectionTracingKey, uint64(11))
+	ctx2 := context.WithValue(context.Background(), quic.ConnectionTracingKey, uint64(12))
+	ct1 := tr.TracerForConnection(ctx1, logging.PerspectiveServer, logging.ConnectionID{})
+	ct2 := tr.TracerForConnection(ctx2, logging.PerspectiveServer, logging.ConnectionID{})
+	if _, ok := ct2.(*Conn); !ok {
+		t.Errorf("TracerForConnection() for untraced connection = %T, want *Conn", ct2)
+	}
+	ci1, err := ToConnInfo(ctx1)
+	if err != nil {
+		t.Fatalf("ToConnInfo() unexpected error = %v", err)
+	}
+	if uuid, _ := ci1.GetUUID(); len(uuids) != 2 || uuids[0] != uuid {
+		t.Errorf("QLog() called with %v, want %q first", uuids, uuid)
+	}
+	ct1.Close()
+	ct2.Close()
+	if !buf.closed || !strings.Contains(buf.String(), `"vantage_point"`) {
+		t.Errorf("qlog trace closed = %v, content = %q", buf.closed, buf.String())
+	}
+}
+
+func TestToConnInfo_NoTracingID(t *testing.T) {
+	if _, err := ToConnInfo(context.Background()); err != ErrNoConnection {
+		t.Errorf("ToConnInfo() error = %v, want %v", err, ErrNoConnection)
+	}
+	tr := NewTracer()
+	if ct := tr.TracerForConnection(context.Background(), logging.PerspectiveServer, logging.ConnectionID{}); ct != nil {
+		t.Errorf("TracerForConnection() without tracing ID = %v, want nil", ct)
+	}
+}
+
+func TestConn_ReadInfo(t *testing.T) {
+	c := &Conn{}
+	rtt := &logging.RTTStats{}
+	rtt.UpdateRTT(10*time.Millisecond, 0, time.Now())
+	c.UpdatedMetrics(rtt, 1200, 600, 1)
+	stream := []logging.Frame{&logging.StreamFrame{Length: 900}}
+	c.SentPacket(&logging.ExtendedHeader{PacketNumber: 1}, 1000, nil, stream)
+	c.SentPacket(&logging.ExtendedHeader{PacketNumber: 2}, 500, nil, stream)
+	c.SentPacket(&logging.ExtendedHeader{PacketNumber: 3}, 40, &logging.AckFrame{}, nil)
+	c.ReceivedShortHeaderPacket(nil, 100, nil)
+	c.ReceivedLongHeaderPacket(nil, 50, nil)
+	c.AcknowledgedPacket(logging.Encryption1RTT, 1)
+	c.LostPacket(logging.Encryption1RTT, 2, logging.PacketLossReorderingThreshold)
+
+	got, err := c.ReadInfo()
+	if err != nil {
+		t.Fatalf("ReadInfo() unexpected error = %v", err)
+	}
+	want := model.QUICConnInfo{
+		SmoothedRTT:      10000,
+		MinRTT:           10000,
+		LatestRTT:        10000,
+		RTTVar:           5000,
+		CongestionWindow: 1200,
+		BytesInFlight:    600,
+		PacketsSent:      3,
+		PacketsReceived:  2,
+		PacketsLost:      1,
+		BytesSent:        1540,
+		BytesReceived:    150,
+		BytesAcked:       1000,
+		BytesLost:        500,
+	}
+	if got != want {
+		t.Errorf("ReadInfo() = %+v, want %+v", got, want)
+	}
+	if len(c.inflight) != 0 {
+		t.Errorf("inflight packets = %v, want none", c.inflight)
+	}
+}
+
+func TestConn_LimitConnectionReceiveWindow(t *testing.T) {
+	c := &Conn{}
+	c.SentTransportParameters(&logging.TransportParameters{InitialMaxData: 1000, MaxIdleTimeout: time.Second})
+	c.ReceivedTransportParameters(&logging.TransportParameters{InitialMaxData: 2000})
+	p, err := c.ReadParams()
+	if err != nil {
+		t.Fatalf("ReadParams() unexpected error = %v", err)
+	}
+	if p.Server.InitialMaxData != 1000 || p.Server.MaxIdleTimeout != 1000000 || p.Client.InitialMaxData != 2000 {
+		t.Errorf("ReadParams() = %+v", p)
+	}
+
+	if !c.allowConnectionWindowIncrease(1000) {
+		t.Errorf("allowConnectionWindowIncrease() without limit = false, want true")
+	}
+	// The limit cannot be lower than the current window.
+	got, release2000 := c.LimitConnectionReceiveWindow(500)
+	if got != 2000 {
+		t.Errorf("LimitConnectionReceiveWindow() = %d, want 2000", got)
+	}
+	got, release3000 := c.LimitConnectionReceiveWindow(3000)
+	if got != 3000 {
+		t.Errorf("LimitConnectionReceiveWindow() = %d, want 3000", got)
+	}
+	// The lowest limit applies until it is removed.
+	if c.allowConnectionWindowIncrease(1) {
+		t.Errorf("allowConnectionWindowIncrease() beyond the lowest limit = true, want false")
+	}
+	release2000()
+	release2000()
+	if !c.allowConnectionWindowIncrease(1000) {
+		t.Errorf("allowConnectionWindowIncrease() up to the limit = false, want true")
+	}
+	if c.allowConnectionWindowIncrease(1) {
+		t.Errorf("allowConnectionWindowIncrease() beyond the limit = true, want false")
+	}
+	release3000()
+	if !c.allowConnectionWindowIncrease(1) {
+		t.Errorf("allowConnectionWindowIncrease() after removing the limits = false, want true")
+	}
+}
+
+func TestConn_ReadHandshake(t *testing.T) {
+	c := &Conn{}
+	c.StartedConnection(nil, nil, logging.ConnectionID{}, logging.ConnectionID{})
+	hdr := &logging.ExtendedHeader{Header: logging.Header{Version: quic.Version1}}
+	c.ReceivedLongHeaderPacket(hdr, 1200, nil)
+	c.DroppedEncryptionLevel(logging.EncryptionInitial)
+	if hs, _ := c.ReadHandshake(); hs.Duration != 0 {
+		t.Errorf("ReadHandshake() before handshake completion = %+v, want zero Duration", hs)
+	}
+	time.Sleep(time.Millisecond)
+	c.DroppedEncryptionLevel(logging.EncryptionHandshake)
+	hs, err := c.ReadHandshake()
+	if err != nil {
+		t.Fatalf("ReadHandshake() unexpected error = %v", err)
+	}
+	if hs.Version != "v1" || hs.Duration < 1000 {
+		t.Errorf("ReadHandshake() = %+v, want v1 and Duration >= 1000", hs)
+	}
+}
@@ -0,0 +1,157 @@
+package quicx
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/marten-seemann/webtransport-go"
+)
+
+// Session is the subset of the operations of WebTransport sessions and QUIC
+// connections needed by ndtQUIC subtests, which allows them to run over
+// either. Use FromWebTransport or FromQUIC to create a Session.
+type Session interface {
+	// Context returns a context carrying quic.ConnectionTracingKey, which is
+	// canceled when the session is closed.
+	Context() context.Context
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	OpenStreamSync(ctx context.Context) (Stream, error)
+	OpenUniStream() (SendStream, error)
+	AcceptUniStream(ctx context.Context) (ReceiveStream, error)
+	Close() error
+	// Protocol returns the name of the protocol of the session, i.e.
+	// "webtransport" or "quic".
+	Protocol() string
+}
+
+// SendStream is the sending side of a stream.
+type SendStream interface {
+	io.WriteCloser
+	SetWriteDeadline(t time.Time) error
+}
+
+// ReceiveStream is the receiving side of a stream.
+type ReceiveStream interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+	// CancelRead aborts receiving on the stream.
+	CancelRead()
+}
+
+// Stream is a bidirectional stream.
+type Stream interface {
+	SendStream
+	ReceiveStream
+}
+
+// FromWebTransport returns the Session for sess.
+func FromWebTransport(sess *webtransport.Session) Session {
+	return webTransportSession{sess}
+}
+
+type webTransportSession struct {
+	*webtransport.Session
+}
+
+func (s webTransportSession) Protocol() string {
+	return "webtransport"
+}
+
+func (s webTransportSession) OpenStreamSync(ctx context.Context) (Stream, error) {
+	str, err := s.Session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return webTransportStream{str}, nil
+}
+
+func (s webTransportSession) OpenUniStream() (SendStream, error) {
+	return s.Session.OpenUniStream()
+}
+
+func (s webTransportSession) AcceptUniStream(ctx context.Context) (ReceiveStream, error) {
+	str, err := s.Session.AcceptUniStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return webTransportReceiveStream{str}, nil
+}
+
+type webTransportStream struct {
+	webtransport.Stream
+}
+
+func (s webTransportStream) CancelRead() {
+	s.Stream.CancelRead(0)
+}
+
+type webTransportReceiveStream struct {
+	webtransport.ReceiveStream
+}
+
+func (s webTransportReceiveStream) CancelRead() {
+	s.ReceiveStream.CancelRead(0)
+}
+
+// FromQUIC returns the Session for conn. Closing the Session closes conn
+// with the application error code zero.
+func FromQUIC(conn quic.Connection) Session {
+	return quicSession{conn}
+}
+
+// FromQUICStream returns the Stream for str.
+func FromQUICStream(str quic.Stream) Stream {
+	return quicStream{str}
+}
+
+type quicSession struct {
+	quic.Connection
+}
+
+func (s quicSession) Protocol() string {
+	return "quic"
+}
+
+func (s quicSession) OpenStreamSync(ctx context.Context) (Stream, error) {
+	str, err := s.Connection.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return quicStream{str}, nil
+}
+
+func (s quicSession) OpenUniStream() (SendStream, error) {
+	return s.Connection.OpenUniStream()
+}
+
+func (s quicSession) AcceptUniStream(ctx context.Context) (ReceiveStream, error) {
+	str, err := s.Connection.AcceptUniStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return quicReceiveStream{str}, nil
+}
+
+func (s quicSession) Close() error {
+	return s.Connection.CloseWithError(0, "")
+}
+
+type quicStream struct {
+	quic.Stream
+}
+
+func (s quicStream) CancelRead() {
+	s.Stream.CancelRead(0)
+}
+
+type quicReceiveStream struct {
+	quic.ReceiveStream
+}
+
+func (s quicReceiveStream) CancelRead() {
+	s.ReceiveStream.CancelRead(0)
+}